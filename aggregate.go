@@ -0,0 +1,352 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+	"sort"
+	"strings"
+)
+
+// AggregateOption is an option of Aggregate, either grouping the items or aggregating a column of each group
+type AggregateOption func(a *aggregation)
+
+// aggregation is how Aggregate groups the items and what it computes for each group
+type aggregation struct {
+	groupBy []exp.Column
+	funcs   []aggregateFunc
+}
+
+type aggregateKind int
+
+const (
+	aggregateCount aggregateKind = iota
+	aggregateSum
+	aggregateMin
+	aggregateMax
+	aggregateAvg
+)
+
+// aggregateFunc is a value computed over the items of each group
+type aggregateFunc struct {
+	// name of the value in the results
+	name   string
+	kind   aggregateKind
+	column exp.Column
+}
+
+// GroupBy groups the items by the values of columns, one result per distinct combination of them
+// items without a primitive value for a column are grouped under nil
+func GroupBy(columns ...string) AggregateOption {
+	return func(a *aggregation) {
+		for _, column := range columns {
+			a.groupBy = append(a.groupBy, exp.C(column))
+		}
+	}
+}
+
+// Count counts the items of each group, named "count" in the results
+func Count() AggregateOption {
+	return aggregateOf(aggregateCount, "count", "")
+}
+
+// Sum sums the numbers of a column, named "sum(<column>)" in the results
+// the sum is an int64 if all the numbers are integers, or a float64 otherwise, or if it overflows an int64
+func Sum(column string) AggregateOption {
+	return aggregateOf(aggregateSum, "sum", column)
+}
+
+// Min finds the smallest number or string of a column, named "min(<column>)" in the results
+func Min(column string) AggregateOption {
+	return aggregateOf(aggregateMin, "min", column)
+}
+
+// Max finds the largest number or string of a column, named "max(<column>)" in the results
+func Max(column string) AggregateOption {
+	return aggregateOf(aggregateMax, "max", column)
+}
+
+// Avg averages the numbers of a column as a float64, named "avg(<column>)" in the results
+func Avg(column string) AggregateOption {
+	return aggregateOf(aggregateAvg, "avg", column)
+}
+
+func aggregateOf(kind aggregateKind, name string, column string) AggregateOption {
+	if column != "" {
+		name = fmt.Sprintf("%s(%s)", name, column)
+	}
+	return func(a *aggregation) {
+		a.funcs = append(a.funcs, aggregateFunc{name: name, kind: kind, column: exp.C(column)})
+	}
+}
+
+// accumulator holds the values aggregated over the items of a group so far
+type accumulator struct {
+	// number of values seen, which are numbers for sums and averages
+	count    int64
+	intSum   int64
+	floatSum float64
+	// whether any number summed is a float, or the integers summed overflow an int64
+	float bool
+	// smallest or largest value seen
+	extreme any
+}
+
+func (acc *accumulator) add(f aggregateFunc, item map[string]any) {
+	if f.kind == aggregateCount {
+		acc.count++
+		return
+	}
+	value, found := exp.ReadColumn(item, f.column)
+	if !found {
+		return
+	}
+	v := primValue(value)
+	switch f.kind {
+	case aggregateSum, aggregateAvg:
+		switch n := v.(type) {
+		case int64:
+			sum := acc.intSum + n
+			if (sum > acc.intSum) != (n > 0) {
+				// wrapped around, so only the float sum holds
+				acc.float = true
+			}
+			acc.intSum = sum
+			acc.floatSum += float64(n)
+		case float64:
+			acc.float = true
+			acc.floatSum += n
+		default:
+			return
+		}
+		acc.count++
+	case aggregateMin:
+		if acc.count == 0 || compareValues(v, acc.extreme) < 0 {
+			acc.extreme = v
+		}
+		acc.count++
+	case aggregateMax:
+		if acc.count == 0 || compareValues(v, acc.extreme) > 0 {
+			acc.extreme = v
+		}
+		acc.count++
+	}
+}
+
+// result of the aggregate, nil if no values have been seen other than for counts
+func (acc *accumulator) result(f aggregateFunc) any {
+	if f.kind == aggregateCount {
+		return acc.count
+	}
+	if acc.count == 0 {
+		return nil
+	}
+	switch f.kind {
+	case aggregateSum:
+		if acc.float {
+			return acc.floatSum
+		}
+		return acc.intSum
+	case aggregateAvg:
+		return acc.floatSum / float64(acc.count)
+	default:
+		return acc.extreme
+	}
+}
+
+// group is the items sharing the same values of the grouped columns
+type group struct {
+	values       []any
+	accumulators []accumulator
+}
+
+// Aggregate computes aggregates over the items matching an expression, grouped by the GroupBy option if given.
+// Results have the values of the grouped columns along with the aggregates by their names, ordered by the grouped values,
+// e.g. Aggregate(ex, GroupBy("Category"), Sum("Count"), Count()) gives rows like
+// {"Category": "books", "sum(Count)": int64(10), "count": int64(2)}.
+// Items are aggregated as they are scanned, so only the groups are held in memory.
+// Without GroupBy, there is exactly one result even if no items match.
+// An error is returned if any grouped columns or aggregates share a name, such as GroupBy("count") with Count()
+func (t *GledTable[T]) Aggregate(ex exp.Ex, opts ...AggregateOption) (results []map[string]any, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	s := txm.Snapshot()
+	defer txm.Release(s)
+	return t.aggregateSnapshot(s, ex, opts)
+}
+
+// aggregate the items visible in a snapshot
+func (t *baseTable) aggregateSnapshot(s *storage.Snapshot, ex exp.Ex, opts []AggregateOption) (results []map[string]any, err error) {
+	a := &aggregation{}
+	for _, opt := range opts {
+		opt(a)
+	}
+	err = a.checkNames()
+	if err != nil {
+		return
+	}
+	groups := map[string]*group{}
+	if len(a.groupBy) == 0 {
+		// all items are of the same group, which is there even if no items match
+		_, err = a.group(groups, nil)
+		if err != nil {
+			return
+		}
+	}
+	c := t.newCursor(s, nil, ex, nil)
+	defer c.close()
+	for {
+		var row cursorRow
+		var ok bool
+		row, ok, err = c.next()
+		if err != nil {
+			err = fmt.Errorf("failed to aggregate items: %w", err)
+			return
+		}
+		if !ok {
+			break
+		}
+		var item map[string]any
+		item, err = row.decoded()
+		if err != nil {
+			return
+		}
+		var g *group
+		g, err = a.group(groups, item)
+		if err != nil {
+			return
+		}
+		for i, f := range a.funcs {
+			g.accumulators[i].add(f, item)
+		}
+	}
+
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		for k := range a.groupBy {
+			if c := compareValues(sorted[i].values[k], sorted[j].values[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	for _, g := range sorted {
+		result := make(map[string]any, len(a.groupBy)+len(a.funcs))
+		for i, column := range a.groupBy {
+			result[string(column)] = g.values[i]
+		}
+		for i, f := range a.funcs {
+			result[f.name] = g.accumulators[i].result(f)
+		}
+		results = append(results, result)
+	}
+	return
+}
+
+// checkNames checks that the grouped columns and the aggregates have distinct names in the results
+func (a *aggregation) checkNames() error {
+	names := map[string]bool{}
+	for _, column := range a.groupBy {
+		if names[string(column)] {
+			return fmt.Errorf("column %s is grouped by more than once", column)
+		}
+		names[string(column)] = true
+	}
+	for _, f := range a.funcs {
+		if names[f.name] {
+			return fmt.Errorf("aggregate %s collides with another grouped column or aggregate of the same name", f.name)
+		}
+		names[f.name] = true
+	}
+	return nil
+}
+
+// group finds the group of an item, adding it if it's new
+func (a *aggregation) group(groups map[string]*group, item map[string]any) (g *group, err error) {
+	values := make([]any, len(a.groupBy))
+	for i, column := range a.groupBy {
+		if value, found := exp.ReadColumn(item, column); found {
+			values[i] = primValue(value)
+		}
+	}
+	key, err := msgpack.Marshal(values)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal group: %w", err)
+		return
+	}
+	g = groups[string(key)]
+	if g == nil {
+		g = &group{values: values, accumulators: make([]accumulator, len(a.funcs))}
+		groups[string(key)] = g
+	}
+	return
+}
+
+// primValue converts a primitive operand into an int64, a float64 or a string
+func primValue(value exp.OpPrimValue) any {
+	switch v := value.(type) {
+	case exp.Int32:
+		return int64(v)
+	case exp.Int64:
+		return int64(v)
+	case exp.Float32:
+		return float64(v)
+	case exp.Float64:
+		return float64(v)
+	case exp.String:
+		return string(v)
+	default:
+		return nil
+	}
+}
+
+// compareValues orders normalized primitive values, numbers by value and strings lexically
+// nil comes first, then numbers, then strings
+func compareValues(a any, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		default:
+			return 2
+		}
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			return compareOrdered(x, y)
+		}
+		return compareOrdered(float64(x), b.(float64))
+	case float64:
+		if y, ok := b.(int64); ok {
+			return compareOrdered(x, float64(y))
+		}
+		return compareOrdered(x, b.(float64))
+	case string:
+		return strings.Compare(x, b.(string))
+	default:
+		return 0
+	}
+}
+
+func compareOrdered[V int64 | float64](a V, b V) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
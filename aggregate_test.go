@@ -0,0 +1,83 @@
+package gled
+
+import (
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+type product struct {
+	Name     string
+	Category string
+	Count    int
+	Price    float64
+}
+
+func TestAggregate(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	products, err := Table[product](db, "products")
+	assert.NoError(t, err)
+	defer products.Close()
+	for _, p := range []product{
+		{Name: "a", Category: "books", Count: 3, Price: 10},
+		{Name: "b", Category: "toys", Count: 1, Price: 2.5},
+		{Name: "c", Category: "books", Count: 7, Price: 30},
+		{Name: "d", Category: "games", Count: 100000000000, Price: 5},
+		{Name: "e", Count: 2},
+	} {
+		assert.NoError(t, products.Insert(p))
+	}
+
+	results, err := products.Aggregate(exp.C("Count").Lt(1000), GroupBy("Category"), Sum("Count"), Count(), Avg("Price"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"Category": "", "sum(Count)": int64(2), "count": int64(1), "avg(Price)": float64(0)},
+		{"Category": "books", "sum(Count)": int64(10), "count": int64(2), "avg(Price)": float64(20)},
+		{"Category": "toys", "sum(Count)": int64(1), "count": int64(1), "avg(Price)": 2.5},
+	}, results)
+
+	results, err = products.Aggregate(exp.AndEx{}, Count(), Sum("Price"), Min("Count"), Max("Count"), Max("Name"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{
+		"count":      int64(5),
+		"sum(Price)": 47.5,
+		"min(Count)": int64(1),
+		"max(Count)": int64(100000000000),
+		"max(Name)":  "e",
+	}}, results)
+
+	// an index narrows down the items aggregated
+	assert.NoError(t, products.CreateIndex("Category"))
+	results, err = products.Aggregate(exp.C("Category").Eq("books"), GroupBy("Category", "Name"), Max("Price"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"Category": "books", "Name": "a", "max(Price)": float64(10)},
+		{"Category": "books", "Name": "c", "max(Price)": float64(30)},
+	}, results)
+
+	// aggregates of no values are nil, other than counts
+	results, err = products.Aggregate(exp.C("Name").Eq("x"), Count(), Sum("Count"), Min("Missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"count": int64(0), "sum(Count)": nil, "min(Missing)": nil}}, results)
+	results, err = products.Aggregate(exp.C("Name").Eq("x"), GroupBy("Category"), Count())
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	// integer sums overflowing an int64 are given as floats rather than wrapping around
+	assert.NoError(t, products.Insert(product{Name: "f", Category: "huge", Count: math.MaxInt64}))
+	assert.NoError(t, products.Insert(product{Name: "g", Category: "huge", Count: 1}))
+	assert.NoError(t, products.Insert(product{Name: "h", Category: "huge", Count: -1}))
+	results, err = products.Aggregate(exp.C("Category").Eq("huge"), Sum("Count"))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"sum(Count)": float64(math.MaxInt64)}}, results)
+
+	// grouped columns and aggregates sharing a name are rejected rather than overwritten
+	_, err = products.Aggregate(exp.AndEx{}, GroupBy("count"), Count())
+	assert.Error(t, err)
+	_, err = products.Aggregate(exp.AndEx{}, Sum("Count"), Sum("Count"))
+	assert.Error(t, err)
+	_, err = products.Aggregate(exp.AndEx{}, GroupBy("Category", "Category"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,479 @@
+package gled
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// name of the table recording the tables of a db
+	catalogTableName = "gled_catalog"
+)
+
+var (
+	// ErrTableNotFound is returned when a table is not recorded in the catalog
+	ErrTableNotFound = errors.New("table not found")
+	// ErrIncompatibleType is returned when a table is opened with a type its items cannot be decoded into
+	ErrIncompatibleType = errors.New("incompatible item type")
+)
+
+// TableInfo is the catalog entry of a table
+type TableInfo struct {
+	Name      string
+	CreatedAt time.Time
+	// name of the Go type of the items, empty if the table has no fixed type,
+	// e.g. tables created by SQL statements
+	Type string
+	// kind of the Go type of the items, as the types of fields
+	Kind string
+	// digest of the fields of the type, which changes whenever the fields do
+	Fingerprint string
+	// fields of the items, with dots separating the names of nested fields
+	Fields []FieldInfo
+	// schema version of the items, starting from 1 and increased by each migration of the type
+	Version int
+	// fingerprints of the types of each version, starting from version 1
+	Versions []string
+	// oldest version of the items stored in the table, raised by Migrate
+	MinVersion int
+	// field of the primary key declared by the `gled` tags of the type, empty if there's none
+	PrimaryKey string
+	// whether integer primary keys are generated for items inserted without one
+	AutoIncrement bool
+	// fields whose values are unique, including the primary key
+	Unique []string
+}
+
+// FieldInfo is a field of the items of a table
+type FieldInfo struct {
+	Name string
+	// kind of the values of the field, one of "bool", "int", "float", "string", "bytes", "time",
+	// "array", "map", "struct" and "any"
+	Type string
+}
+
+// schemaless returns whether the table has no fixed item type
+func (info *TableInfo) schemaless() bool {
+	return info.Type == ""
+}
+
+// fill in the versions of entries recorded before tables were versioned
+func (info *TableInfo) normalize() {
+	if info.Version > 0 {
+		return
+	}
+	info.Version = 1
+	info.MinVersion = 1
+	if !info.schemaless() {
+		info.Versions = []string{info.Fingerprint}
+	}
+}
+
+// typeInfo describes the items of type T as a catalog entry of table |name|
+func typeInfo[T any](name string) (info *TableInfo) {
+	info = &TableInfo{Name: name}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	kind := fieldType(t)
+	if kind == "map" || kind == "any" {
+		return
+	}
+	info.Type = t.String()
+	info.Kind = kind
+	if kind == "struct" {
+		info.Fields = structFields(t, "", map[reflect.Type]bool{})
+	}
+	h := sha256.New()
+	h.Write([]byte(kind))
+	for _, field := range info.Fields {
+		h.Write([]byte(fmt.Sprintf("\n%s:%s", field.Name, field.Type)))
+	}
+	info.Fingerprint = hex.EncodeToString(h.Sum(nil)[:8])
+	return
+}
+
+// structFields lists the fields of a struct type as encoded by msgpack, recursing into nested structs
+// |seen| holds the struct types being listed, so that recursive types end
+func structFields(t reflect.Type, prefix string, seen map[reflect.Type]bool) (fields []FieldInfo) {
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("msgpack"), ",")
+		if name == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		kind := fieldType(ft)
+		// msgpack inlines the fields of embedded structs
+		if f.Anonymous && name == "" && kind == "struct" {
+			if !seen[ft] {
+				fields = append(fields, structFields(ft, prefix, seen)...)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, FieldInfo{Name: prefix + name, Type: kind})
+		if kind == "struct" && !seen[ft] {
+			fields = append(fields, structFields(ft, prefix+name+".", seen)...)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return
+}
+
+// fieldType is the kind of values of a type, where types decoding the same values share a kind
+func fieldType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "time"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "array"
+	case reflect.Map:
+		return "map"
+	case reflect.Struct:
+		return "struct"
+	case reflect.Interface:
+		return "any"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// checkCompatible checks that items recorded as |recorded| can be decoded as |info|
+// fields only one of them has are fine, since they are left empty when decoding
+func checkCompatible(recorded *TableInfo, info *TableInfo) (err error) {
+	if recorded.schemaless() || info.schemaless() || recorded.Fingerprint == info.Fingerprint {
+		return
+	}
+	if recorded.Kind != info.Kind || info.Kind != "struct" {
+		return fmt.Errorf("%w: table %s holds %s but opened with %s", ErrIncompatibleType, info.Name, recorded.Type, info.Type)
+	}
+	recordedTypes := map[string]string{}
+	for _, field := range recorded.Fields {
+		recordedTypes[field.Name] = field.Type
+	}
+	for _, field := range info.Fields {
+		recordedType, ok := recordedTypes[field.Name]
+		if !ok || recordedType == field.Type || recordedType == "any" || field.Type == "any" {
+			continue
+		}
+		return fmt.Errorf("%w: field %s of table %s is %s but %s in %s",
+			ErrIncompatibleType, field.Name, info.Name, recordedType, field.Type, info.Type)
+	}
+	return
+}
+
+// catalogTable gets the catalog of the db, opening it if needed
+// a new catalog records the tables already in the directory, without their types.
+// Must be called with db.catalogMu held
+func (db *GledDB) catalogTable() (catalog *GledTable[TableInfo], err error) {
+	if db.catalog != nil {
+		return db.catalog, nil
+	}
+	_, statErr := os.Stat(path.Join(db.dir, fmt.Sprintf("%s.gled", catalogTableName)))
+	created := os.IsNotExist(statErr)
+	base, err := db.openBaseTable(catalogTableName, schemaVersions{current: 1})
+	if err != nil {
+		err = fmt.Errorf("failed to open catalog: %w", err)
+		return
+	}
+	catalog = &GledTable[TableInfo]{baseTable: base}
+	if created {
+		err = adoptTables(db.dir, catalog)
+		if err != nil {
+			_ = catalog.Close()
+			return
+		}
+	}
+	db.catalog = catalog
+	return
+}
+
+// adoptTables records the tables found in a directory into a new catalog
+func adoptTables(dir string, catalog *GledTable[TableInfo]) (err error) {
+	matches, err := filepath.Glob(path.Join(dir, "*.gled"))
+	if err != nil {
+		err = fmt.Errorf("failed to list table files: %w", err)
+		return
+	}
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), ".gled")
+		if name == catalogTableName || !tableNameRegex.MatchString(name) {
+			// not a table, e.g. the free space map of one
+			continue
+		}
+		var stat os.FileInfo
+		stat, err = os.Stat(match)
+		if err != nil {
+			err = fmt.Errorf("failed to check table file %s: %w", match, err)
+			return
+		}
+		err = catalog.Insert(TableInfo{Name: name, CreatedAt: stat.ModTime()})
+		if err != nil {
+			err = fmt.Errorf("failed to record table %s: %w", name, err)
+			return
+		}
+	}
+	return
+}
+
+// lookupTable finds the catalog entry of a table
+// returns ErrTableNotFound if there's none. Must be called with db.catalogMu held
+func (db *GledDB) lookupTable(name string) (info TableInfo, loc storage.TupleLocation, err error) {
+	catalog, err := db.catalogTable()
+	if err != nil {
+		return
+	}
+	items, locations, err := catalog.Select(exp.C("Name").Eq(name))
+	if err != nil {
+		err = fmt.Errorf("failed to read catalog: %w", err)
+		return
+	}
+	if len(items) == 0 {
+		err = fmt.Errorf("%w: %s", ErrTableNotFound, name)
+		return
+	}
+	items[0].normalize()
+	return items[0], locations[0], nil
+}
+
+// recordTable checks that a table can be opened with the item type described by |info|,
+// recording the table if it's new, or the type if it changed compatibly or by registered migrations.
+// Returns the entry of the table, and whether its schema version is increased.
+// Must be called with db.catalogMu held
+func (db *GledDB) recordTable(info *TableInfo) (recorded TableInfo, migrated bool, err error) {
+	recorded, loc, err := db.lookupTable(info.Name)
+	if errors.Is(err, ErrTableNotFound) {
+		recorded = *info
+		recorded.CreatedAt = time.Now()
+		recorded.normalize()
+		err = db.catalog.Insert(recorded)
+		if err != nil {
+			err = fmt.Errorf("failed to record table %s: %w", info.Name, err)
+			return
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	if info.schemaless() || recorded.Fingerprint == info.Fingerprint {
+		return
+	}
+	if steps := db.migrationPath(info.Name, recorded.Fingerprint, info.Fingerprint); steps != nil {
+		db.mu.Lock()
+		_, opened := db.tables[info.Name]
+		db.mu.Unlock()
+		if opened {
+			err = fmt.Errorf("table %s must be closed to be migrated to %s", info.Name, info.Type)
+			return
+		}
+		for _, step := range steps {
+			recorded.Versions = append(recorded.Versions, step.to)
+		}
+		recorded.Version += len(steps)
+		migrated = true
+	} else {
+		for _, fingerprint := range recorded.Versions {
+			if fingerprint == info.Fingerprint {
+				err = fmt.Errorf("%w: table %s has been migrated from %s to %s", ErrIncompatibleType, info.Name, info.Type, recorded.Type)
+				return
+			}
+		}
+		err = checkCompatible(&recorded, info)
+		if err != nil {
+			return
+		}
+		// the type changes compatibly within the current version
+		if recorded.schemaless() {
+			recorded.Versions = []string{info.Fingerprint}
+		} else {
+			recorded.Versions[len(recorded.Versions)-1] = info.Fingerprint
+		}
+	}
+	recorded.Type = info.Type
+	recorded.Kind = info.Kind
+	recorded.Fingerprint = info.Fingerprint
+	recorded.Fields = info.Fields
+	err = db.catalog.Update(loc, recorded)
+	if err != nil {
+		err = fmt.Errorf("failed to record type of table %s: %w", info.Name, err)
+		return
+	}
+	return
+}
+
+// ListTables lists the tables of the db by name
+func (db *GledDB) ListTables() (tables []TableInfo, err error) {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	catalog, err := db.catalogTable()
+	if err != nil {
+		return
+	}
+	tables, _, err = catalog.Select(exp.AndEx{})
+	if err != nil {
+		err = fmt.Errorf("failed to read catalog: %w", err)
+		return
+	}
+	for i := range tables {
+		tables[i].normalize()
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+	return
+}
+
+// DropTable deletes a table along with its indexes
+// the table must not be opened
+func (db *GledDB) DropTable(name string) (err error) {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	_, loc, err := db.lookupTable(name)
+	if err != nil {
+		return
+	}
+	err = db.checkClosed(name)
+	if err != nil {
+		return
+	}
+	files, err := tableFiles(db.dir, name)
+	if err != nil {
+		return
+	}
+	// files are removed before the entry, so that a crash in between leaves an empty table
+	// rather than files of a dropped table to be picked up by a new one of the same name
+	for _, file := range files {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			err = fmt.Errorf("failed to remove %s: %w", file, err)
+			return
+		}
+	}
+	err = db.catalog.Delete(loc)
+	if err != nil {
+		err = fmt.Errorf("failed to remove table %s from catalog: %w", name, err)
+		return
+	}
+	return
+}
+
+// RenameTable renames a table along with its indexes
+// the table must not be opened, and no table may be named |newName| already
+func (db *GledDB) RenameTable(oldName string, newName string) (err error) {
+	if !tableNameRegex.MatchString(newName) || newName == catalogTableName {
+		return fmt.Errorf("invalid table name: %s", newName)
+	}
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	info, loc, err := db.lookupTable(oldName)
+	if err != nil {
+		return
+	}
+	_, _, err = db.lookupTable(newName)
+	if err == nil {
+		return fmt.Errorf("table %s already exists", newName)
+	}
+	if !errors.Is(err, ErrTableNotFound) {
+		return
+	}
+	err = db.checkClosed(oldName)
+	if err != nil {
+		return
+	}
+	files, err := tableFiles(db.dir, oldName)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		renamed := path.Join(db.dir, newName+strings.TrimPrefix(filepath.Base(file), oldName))
+		err = os.Rename(file, renamed)
+		if err != nil && !os.IsNotExist(err) {
+			err = fmt.Errorf("failed to rename %s: %w", file, err)
+			return
+		}
+	}
+	info.Name = newName
+	err = db.catalog.Update(loc, info)
+	if err != nil {
+		err = fmt.Errorf("failed to rename table %s in catalog: %w", oldName, err)
+		return
+	}
+	return
+}
+
+// checkClosed checks that a table is not opened,
+// and checkpoints the write-ahead log so that it no longer refers to the files of the table
+func (db *GledDB) checkClosed(name string) (err error) {
+	wal, _, err := db.open()
+	if err != nil {
+		return
+	}
+	db.mu.Lock()
+	_, opened := db.tables[name]
+	db.mu.Unlock()
+	if opened {
+		return fmt.Errorf("table %s is still opened", name)
+	}
+	err = wal.Checkpoint()
+	if err != nil {
+		err = fmt.Errorf("failed to checkpoint wal: %w", err)
+		return
+	}
+	return
+}
+
+// tableFiles lists the files of a table, including those of its indexes
+func tableFiles(dir string, name string) (files []string, err error) {
+	files = []string{
+		path.Join(dir, fmt.Sprintf("%s.gled", name)),
+		path.Join(dir, fmt.Sprintf("%s.fsm.gled", name)),
+		path.Join(dir, fmt.Sprintf("%s.ovf.gled", name)),
+	}
+	columns, err := findIndexedColumns(dir, name)
+	if err != nil {
+		return
+	}
+	for _, column := range columns {
+		files = append(files, indexPath(dir, name, column))
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package gled
+
+import (
+	"errors"
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+type catalogBook struct {
+	Name  string
+	Count int
+	Info  struct {
+		Pages int32
+	}
+}
+
+// catalogBook with a wider number, an added field and a removed one
+type catalogBookV2 struct {
+	Name  string
+	Count int64
+	Price float64
+}
+
+type catalogBookBad struct {
+	Name  string
+	Count string
+}
+
+func TestCatalog(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+
+	books, err := Table[catalogBook](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, books.Insert(catalogBook{Name: "a", Count: 1}))
+	assert.NoError(t, books.Close())
+	_, err = db.Query("INSERT INTO notes (Text) VALUES ('x')")
+	assert.NoError(t, err)
+
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tables))
+	assert.Equal(t, "books", tables[0].Name)
+	assert.Equal(t, "gled.catalogBook", tables[0].Type)
+	assert.Equal(t, []FieldInfo{
+		{Name: "Count", Type: "int"},
+		{Name: "Info", Type: "struct"},
+		{Name: "Info.Pages", Type: "int"},
+		{Name: "Name", Type: "string"},
+	}, tables[0].Fields)
+	assert.False(t, tables[0].CreatedAt.IsZero())
+	assert.Equal(t, "notes", tables[1].Name)
+	assert.Equal(t, "", tables[1].Type)
+
+	// fields of the same kinds may be added and removed
+	booksV2, err := Table[catalogBookV2](db, "books")
+	assert.NoError(t, err)
+	items, _, err := booksV2.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []catalogBookV2{{Name: "a", Count: 1}}, items)
+	assert.NoError(t, booksV2.Close())
+	_, err = Table[catalogBookBad](db, "books")
+	assert.True(t, errors.Is(err, ErrIncompatibleType))
+	_, err = Table[string](db, "books")
+	assert.True(t, errors.Is(err, ErrIncompatibleType))
+	// tables without a type take the first one they are opened with
+	notes, err := Table[catalogBookBad](db, "notes")
+	assert.NoError(t, err)
+	assert.NoError(t, notes.Close())
+	_, err = Table[catalogBook](db, "notes")
+	assert.True(t, errors.Is(err, ErrIncompatibleType))
+	rows, err := Table[map[string]any](db, "notes")
+	assert.NoError(t, err)
+	assert.NoError(t, rows.Close())
+
+	_, err = Table[catalogBook](db, catalogTableName)
+	assert.Error(t, err)
+}
+
+func TestDropAndRenameTable(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+
+	books, err := Table[catalogBook](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, books.CreateIndex("Name"))
+	assert.NoError(t, books.Insert(catalogBook{Name: "a", Count: 1}))
+	assert.Error(t, db.RenameTable("books", "novels"))
+	assert.Error(t, db.DropTable("books"))
+	assert.NoError(t, books.Close())
+
+	assert.NoError(t, db.RenameTable("books", "novels"))
+	assert.True(t, errors.Is(db.RenameTable("books", "novels"), ErrTableNotFound))
+	_, err = os.Stat(path.Join(db.dir, "books.gled"))
+	assert.True(t, os.IsNotExist(err))
+	novels, err := Table[catalogBook](db, "novels")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(novels.indexes))
+	items, _, err := novels.Select(exp.C("Name").Eq("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(items))
+	assert.NoError(t, novels.Close())
+
+	_, err = db.Query("INSERT INTO notes (Text) VALUES ('x')")
+	assert.NoError(t, err)
+	assert.Error(t, db.RenameTable("novels", "notes"))
+
+	assert.NoError(t, db.DropTable("novels"))
+	assert.True(t, errors.Is(db.DropTable("novels"), ErrTableNotFound))
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tables))
+	assert.Equal(t, "notes", tables[0].Name)
+	for _, name := range []string{"novels.gled", "novels.fsm.gled", "novels.ovf.gled", "novels.Name.idx.gled"} {
+		_, err = os.Stat(path.Join(db.dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// a table created again after dropping starts empty
+	novels, err = Table[catalogBook](db, "novels")
+	assert.NoError(t, err)
+	items, _, err = novels.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	assert.NoError(t, novels.Close())
+}
+
+func TestCatalogAdoptsTables(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir)
+	books, err := Table[catalogBook](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, books.Insert(catalogBook{Name: "a"}))
+	assert.NoError(t, books.Close())
+	assert.NoError(t, db.Close())
+
+	// a directory created before tables were cataloged
+	for _, suffix := range []string{".gled", ".fsm.gled", ".ovf.gled"} {
+		assert.NoError(t, os.Remove(path.Join(dir, catalogTableName+suffix)))
+	}
+	db = NewGleDB(dir)
+	defer db.Close()
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tables))
+	assert.Equal(t, "books", tables[0].Name)
+	assert.Equal(t, "", tables[0].Type)
+}
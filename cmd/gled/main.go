@@ -0,0 +1,42 @@
+// Command gled inspects and queries gled dbs
+//
+//	gled shell <dir>
+//
+// starts an interactive shell on the db in directory <dir>, which is opened for writing
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: gled shell <dir>
+
+commands:
+  shell    start an interactive shell on the db in directory <dir>,
+           opened for writing, so creating the files of a db if there are none
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "shell":
+		if len(os.Args) != 3 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		err := runShell(os.Args[2], os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gled: %v\n", err)
+			os.Exit(1)
+		}
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "gled: unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/luminocean/gled"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const shellHelp = `statements, one per line:
+  SELECT columns FROM table [WHERE condition]
+  INSERT INTO table (columns) VALUES (values), ...
+  DELETE FROM table [WHERE condition]
+conditions compare columns with values, combined by AND, OR and parentheses,
+e.g. Count >= 10 AND (Name = 'a' OR Info.Pages < 100)
+
+commands:
+  .tables              list the tables of the db
+  .mode table|json     print rows as an aligned table or as JSON
+  .help                show this help
+  .quit                leave the shell
+`
+
+// shell is an interactive session on a db
+type shell struct {
+	db  *gled.GledDB
+	out io.Writer
+	// whether rows are printed as JSON rather than as a table
+	json bool
+}
+
+// runShell reads statements and commands from |in| and runs them on the db in directory |dir|
+// until |in| ends or ".quit" is entered.
+// The db is opened for writing like by any other program, even if only selecting: the first statement or command
+// replays and truncates its write-ahead log, and creates its catalog and log files if there are none.
+// So it shouldn't be run on a db used by another process, nor on a directory that is not a db
+func runShell(dir string, in io.Reader, out io.Writer) (err error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		err = fmt.Errorf("failed to open db: %w", err)
+		return
+	}
+	if !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+		return
+	}
+	s := &shell{db: gled.NewGleDB(dir), out: out}
+	defer s.db.Close()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "gled> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == ".quit" || line == ".exit" {
+			break
+		}
+		err = s.handle(line)
+		if err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		err = fmt.Errorf("failed to read input: %w", err)
+		return
+	}
+	return
+}
+
+// handle runs a line of input
+func (s *shell) handle(line string) (err error) {
+	if !strings.HasPrefix(line, ".") {
+		return s.query(line)
+	}
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".help":
+		fmt.Fprint(s.out, shellHelp)
+	case ".tables":
+		var tables []gled.TableInfo
+		tables, err = s.db.ListTables()
+		if err != nil {
+			return
+		}
+		rows := make([]map[string]any, len(tables))
+		for i, table := range tables {
+			rows[i] = map[string]any{
+				"name":    table.Name,
+				"type":    table.Type,
+				"created": table.CreatedAt.Format(time.RFC3339),
+			}
+		}
+		if s.json {
+			return printJSON(s.out, rows)
+		}
+		return printTable(s.out, []string{"name", "type", "created"}, rows)
+	case ".mode":
+		if len(fields) != 2 || fields[1] != "table" && fields[1] != "json" {
+			return fmt.Errorf("usage: .mode table|json")
+		}
+		s.json = fields[1] == "json"
+	default:
+		return fmt.Errorf("unknown command %s, see .help", fields[0])
+	}
+	return
+}
+
+// query runs a statement and prints its result
+func (s *shell) query(statement string) (err error) {
+	result, err := s.db.Exec(statement)
+	if err != nil {
+		return
+	}
+	// only SELECT gives rows, even if none is selected
+	if result.Rows == nil {
+		fmt.Fprintf(s.out, "%d rows affected\n", result.RowsAffected)
+		return
+	}
+	if s.json {
+		return printJSON(s.out, result.Rows)
+	}
+	return printTable(s.out, result.Columns, result.Rows)
+}
+
+func printJSON(out io.Writer, rows []map[string]any) (err error) {
+	data, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("failed to format rows: %w", err)
+		return
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return
+}
+
+// printTable prints rows as a table aligned by columns
+func printTable(out io.Writer, columns []string, rows []map[string]any) (err error) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if len(columns) > 0 {
+		separators := make([]string, len(columns))
+		for i, column := range columns {
+			separators[i] = strings.Repeat("-", len(column))
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+		fmt.Fprintln(w, strings.Join(separators, "\t"))
+	}
+	for _, row := range rows {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = formatCell(row[column])
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	fmt.Fprintf(w, "(%d rows)\n", len(rows))
+	return w.Flush()
+}
+
+// formatCell formats a value of a row, with nested fields and arrays as JSON
+func formatCell(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case map[string]any, []any:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestShell(t *testing.T) {
+	dir := t.TempDir()
+	input := strings.Join([]string{
+		"INSERT INTO books (Name, Count) VALUES ('a', 10), ('bb', 200)",
+		"INSERT INTO authors (Name) VALUES ('x')",
+		"SELECT Name, Count FROM books WHERE Count > 5 AND Name = 'bb'",
+		"DELETE FROM books WHERE Name = 'a'",
+		".mode json",
+		"SELECT Name FROM books",
+		"SELECT * FROM missing",
+		".quit",
+		"SELECT * FROM books",
+	}, "\n")
+	var out bytes.Buffer
+	assert.NoError(t, runShell(dir, strings.NewReader(input), &out))
+	assert.Equal(t, strings.Join([]string{
+		"gled> 2 rows affected",
+		"gled> 1 rows affected",
+		"gled> Name  Count",
+		"----  -----",
+		"bb    200",
+		"(1 rows)",
+		"gled> 1 rows affected",
+		"gled> gled> [",
+		"  {",
+		`    "Name": "bb"`,
+		"  }",
+		"]",
+		"gled> error: table not found: missing",
+		"gled> ",
+	}, "\n"), out.String())
+
+	assert.Error(t, runShell(dir+"/missing", strings.NewReader(""), &out))
+
+	out.Reset()
+	assert.NoError(t, runShell(dir, strings.NewReader(".tables"), &out))
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, 7, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "gled> name"))
+	assert.True(t, strings.HasPrefix(lines[2], "authors "))
+	assert.True(t, strings.HasPrefix(lines[3], "books "))
+	assert.Equal(t, "(2 rows)", lines[4])
+}
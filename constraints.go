@@ -0,0 +1,484 @@
+package gled
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrUniqueViolation is returned when a change would leave two items with the same value of a unique field
+	ErrUniqueViolation = errors.New("unique constraint violated")
+)
+
+// UniqueViolationError is the ErrUniqueViolation of a value of a unique column, which errors.Is matches with it
+type UniqueViolationError struct {
+	Table  string
+	Column string
+	// value taken more than once, an int64, a float64 or a string
+	Value any
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("%s: %s of table %s is already %v", ErrUniqueViolation, e.Column, e.Table, e.Value)
+}
+
+// Is tells errors.Is that the error is an ErrUniqueViolation
+func (e *UniqueViolationError) Is(target error) bool {
+	return target == ErrUniqueViolation
+}
+
+// constraints are declared by `gled` tags on the fields of item types, with comma separated options:
+//
+//	pk             primary key, which is unique and looked up by GetByKey
+//	autoincrement  along with pk, an integer key generated for items inserted without one
+//	unique         no two items have the same value
+//	index          indexed for selects
+//
+// e.g. `gled:"pk,autoincrement"`. Constraints are recorded in the catalog,
+// and enforced on all changes to the table, including those made by SQL statements
+type constraints struct {
+	// column of the primary key, empty if there's none
+	pk            string
+	autoincrement bool
+	// columns of unique values, including the primary key
+	unique []string
+	// columns to index, including the unique ones
+	indexed []string
+}
+
+// constraintsOf parses the constraints declared by the tags of type T
+// returns nil if T is not a struct, since there are no fields to tag
+func constraintsOf[T any]() (c *constraints, err error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	c = &constraints{}
+	err = c.parse(t)
+	if err != nil {
+		err = fmt.Errorf("invalid gled tags of %s: %w", t, err)
+		return nil, err
+	}
+	return
+}
+
+func (c *constraints) parse(t reflect.Type) (err error) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("msgpack"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// msgpack inlines the fields of embedded structs
+			err = c.parse(f.Type)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		tag, tagged := f.Tag.Lookup("gled")
+		if !tagged || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if !columnNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid column name: %s", name)
+		}
+		var pk, autoincrement bool
+		for _, option := range strings.Split(tag, ",") {
+			switch strings.TrimSpace(option) {
+			case "pk":
+				pk = true
+			case "autoincrement":
+				autoincrement = true
+			case "unique":
+				c.addUnique(name)
+			case "index":
+				c.addIndexed(name)
+			case "":
+			default:
+				return fmt.Errorf("unknown option %s of field %s", option, name)
+			}
+		}
+		if pk {
+			if c.pk != "" {
+				return fmt.Errorf("both %s and %s are pk", c.pk, name)
+			}
+			c.pk = name
+			c.addUnique(name)
+		}
+		if autoincrement {
+			if !pk {
+				return fmt.Errorf("autoincrement field %s is not pk", name)
+			}
+			if fieldType(f.Type) != "int" {
+				return fmt.Errorf("autoincrement field %s is not an integer", name)
+			}
+			c.autoincrement = true
+		}
+	}
+	return
+}
+
+func (c *constraints) addUnique(column string) {
+	if !containsString(c.unique, column) {
+		c.unique = append(c.unique, column)
+	}
+	c.addIndexed(column)
+}
+
+func (c *constraints) addIndexed(column string) {
+	if !containsString(c.indexed, column) {
+		c.indexed = append(c.indexed, column)
+	}
+}
+
+// constraints recorded in a catalog entry
+func (info *TableInfo) constraints() *constraints {
+	c := &constraints{pk: info.PrimaryKey, autoincrement: info.AutoIncrement}
+	for _, column := range info.Unique {
+		c.addUnique(column)
+	}
+	return c
+}
+
+// recorded tells whether the constraints are the ones recorded in a catalog entry
+func (c *constraints) recorded(info *TableInfo) bool {
+	if c.pk != info.PrimaryKey || c.autoincrement != info.AutoIncrement || len(c.unique) != len(info.Unique) {
+		return false
+	}
+	for _, column := range c.unique {
+		if !containsString(info.Unique, column) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordConstraints records the constraints of a table in the catalog
+// Must be called with db.catalogMu held
+func (db *GledDB) recordConstraints(name string, c *constraints) (err error) {
+	info, loc, err := db.lookupTable(name)
+	if err != nil {
+		return
+	}
+	if c.recorded(&info) {
+		return
+	}
+	info.PrimaryKey = c.pk
+	info.AutoIncrement = c.autoincrement
+	info.Unique = c.unique
+	err = db.catalog.Update(loc, info)
+	if err != nil {
+		err = fmt.Errorf("failed to record constraints of table %s: %w", name, err)
+		return
+	}
+	return
+}
+
+// constrain applies constraints to the table, creating the indexes they need.
+// Unique columns not in |checked| are checked against the items in the table
+func (t *baseTable) constrain(c *constraints, checked []string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, column := range c.indexed {
+		if t.indexOn(exp.C(column)) != nil {
+			continue
+		}
+		err = t.createIndex(column)
+		if err != nil {
+			return
+		}
+	}
+	for _, column := range c.unique {
+		if containsString(checked, column) {
+			continue
+		}
+		err = t.checkUnique(column)
+		if err != nil {
+			return
+		}
+	}
+	if t.constraints.pk != c.pk {
+		t.keyLoaded = false
+	}
+	t.constraints = *c
+	return
+}
+
+// checkUnique checks that no two items in the table have the same value of a column
+func (t *baseTable) checkUnique(column string) (err error) {
+	idx := t.indexOn(exp.C(column))
+	// keys in the tree may be truncated, so values with the same truncated key are told apart by their full keys
+	var group []byte
+	var values map[string]storage.TupleLocation
+	return idx.tree.Range(nil, nil, func(key []byte, loc storage.TupleLocation) (cont bool, err error) {
+		if values == nil || !bytes.Equal(key, group) {
+			group = key
+			values = map[string]storage.TupleLocation{}
+		}
+		full, value, live, err := t.latestKey(idx, loc)
+		if err != nil || !live {
+			return err == nil, err
+		}
+		if other, found := values[string(full)]; found && other != loc {
+			err = &UniqueViolationError{Table: t.name, Column: column, Value: primValue(value)}
+			return
+		}
+		values[string(full)] = loc
+		return true, nil
+	})
+}
+
+// latestKey gets the key in an index of the latest version of the item at a location, along with its value
+// returns false if the item is deleted or has no key
+func (t *baseTable) latestKey(idx *index, loc storage.TupleLocation) (key []byte, value exp.OpPrimValue, ok bool, err error) {
+	tuple, err := t.table.GetLatest(loc)
+	if errors.Is(err, storage.ErrTupleNotFound) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return
+	}
+	tuple, err = t.upgrade(tuple)
+	if err != nil {
+		return
+	}
+	var item map[string]any
+	err = msgpack.Unmarshal(tuple, &item)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal item: %w", err)
+		return
+	}
+	value, ok = exp.ReadColumn(item, idx.column)
+	if ok {
+		key = encodeIndexKey(value)
+	}
+	return
+}
+
+// enforceConstraints generates the keys of inserted items without one,
+// and checks that the changes keep unique columns unique, considering the changes made by one another.
+// Returns the changes with the generated keys. The changed tables must be locked for writing
+func enforceConstraints(ops []txOp) (enforced []txOp, err error) {
+	enforced = make([]txOp, len(ops))
+	copy(enforced, ops)
+	defer func() {
+		if err != nil {
+			// keys generated for changes not applied are given again
+			for _, op := range ops {
+				op.table.keyLoaded = false
+			}
+		}
+	}()
+	// items deleted or updated, whose current values no longer count, with the last changes to them
+	replaced := map[*baseTable]map[storage.TupleLocation]int{}
+	for i, op := range ops {
+		if op.kind == opInsert || len(op.table.constraints.unique) == 0 {
+			continue
+		}
+		if replaced[op.table] == nil {
+			replaced[op.table] = map[storage.TupleLocation]int{}
+		}
+		replaced[op.table][op.loc] = i
+	}
+	// keys taken by the changes by table and column
+	taken := map[*baseTable]map[string]map[string]bool{}
+	for i := range enforced {
+		op := &enforced[i]
+		c := op.table.constraints
+		if op.kind == opDelete || len(c.unique) == 0 {
+			continue
+		}
+		if op.kind == opUpdate && replaced[op.table][op.loc] != i {
+			// overwritten by a later update of the same item
+			continue
+		}
+		var item map[string]any
+		err = msgpack.Unmarshal(op.tuple, &item)
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal item: %w", err)
+			return
+		}
+		if op.kind == opInsert && c.autoincrement {
+			op.tuple, err = op.table.generateKey(item, op.tuple)
+			if err != nil {
+				return
+			}
+		}
+		if taken[op.table] == nil {
+			taken[op.table] = map[string]map[string]bool{}
+		}
+		for _, column := range c.unique {
+			if taken[op.table][column] == nil {
+				taken[op.table][column] = map[string]bool{}
+			}
+			err = op.table.checkUniqueValue(column, item, replaced[op.table], taken[op.table][column])
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// checkUniqueValue checks that no other item has the value of a unique column of an item
+// |replaced| holds the locations of items being deleted or updated, |taken| holds the keys of items being written
+func (t *baseTable) checkUniqueValue(column string, item map[string]any, replaced map[storage.TupleLocation]int, taken map[string]bool) (err error) {
+	value, found := exp.ReadColumn(item, exp.C(column))
+	if !found {
+		// missing values do not conflict
+		return
+	}
+	key := encodeIndexKey(value)
+	if key == nil {
+		return
+	}
+	violation := &UniqueViolationError{Table: t.name, Column: column, Value: primValue(value)}
+	if taken[string(key)] {
+		return violation
+	}
+	idx := t.indexOn(exp.C(column))
+	err = idx.tree.Range(key, key, func(_ []byte, loc storage.TupleLocation) (cont bool, err error) {
+		if _, found := replaced[loc]; found {
+			return true, nil
+		}
+		other, _, live, err := t.latestKey(idx, loc)
+		if err != nil {
+			return
+		}
+		if live && bytes.Equal(other, key) {
+			return false, violation
+		}
+		return true, nil
+	})
+	if err != nil {
+		return
+	}
+	taken[string(key)] = true
+	return
+}
+
+// generateKey sets the primary key of an item inserted without one, i.e. with a missing or zero key
+// returns the item encoded again if the key is generated, or |tuple| otherwise
+func (t *baseTable) generateKey(item map[string]any, tuple storage.Tuple) (generated storage.Tuple, err error) {
+	err = t.loadLastKey()
+	if err != nil {
+		return
+	}
+	switch key := normalizeValue(item[t.constraints.pk]).(type) {
+	case nil:
+	case int64:
+		if key != 0 {
+			if key > t.lastKey {
+				t.lastKey = key
+			}
+			return tuple, nil
+		}
+	default:
+		return tuple, nil
+	}
+	t.lastKey++
+	item[t.constraints.pk] = t.lastKey
+	generated, err = msgpack.Marshal(item)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal item: %w", err)
+		return
+	}
+	return
+}
+
+// loadLastKey finds the largest integer primary key ever given, from the index of the key
+// deleted items count until the table is vacuumed, so that their keys are less likely to be reused
+func (t *baseTable) loadLastKey() (err error) {
+	if t.keyLoaded {
+		return
+	}
+	idx := t.indexOn(exp.C(t.constraints.pk))
+	t.lastKey = 0
+	err = idx.tree.Range([]byte{indexKeyInt64}, []byte{indexKeyInt64 + 1}, func(key []byte, _ storage.TupleLocation) (bool, error) {
+		if len(key) == 9 && key[0] == indexKeyInt64 {
+			if last := int64(binary.BigEndian.Uint64(key[1:]) ^ (1 << 63)); last > t.lastKey {
+				t.lastKey = last
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to find the last key of table %s: %w", t.name, err)
+		return
+	}
+	t.keyLoaded = true
+	return
+}
+
+// GetByKey gets the item with a primary key, looked up in the index of the key
+// returns storage.ErrTupleNotFound if there's no such item
+func (t *GledTable[T]) GetByKey(key any) (item T, loc storage.TupleLocation, err error) {
+	ex, err := t.keyEx(key)
+	if err != nil {
+		return
+	}
+	items, locations, err := t.Select(ex)
+	if err != nil {
+		return
+	}
+	return firstItem(key, items, locations)
+}
+
+// GetByKey gets the item with a primary key as of when the transaction began
+// returns storage.ErrTupleNotFound if there's no such item
+func (v *GledTxTable[T]) GetByKey(key any) (item T, loc storage.TupleLocation, err error) {
+	ex, err := v.table.keyEx(key)
+	if err != nil {
+		return
+	}
+	items, locations, err := v.Select(ex)
+	if err != nil {
+		return
+	}
+	return firstItem(key, items, locations)
+}
+
+// expression selecting the item with a primary key
+func (t *baseTable) keyEx(key any) (ex exp.Ex, err error) {
+	t.mu.RLock()
+	pk := t.constraints.pk
+	t.mu.RUnlock()
+	if pk == "" {
+		err = fmt.Errorf("table %s has no primary key", t.name)
+		return
+	}
+	return exp.C(pk).Eq(key), nil
+}
+
+// firstItem takes the item selected by a key
+func firstItem[T any](key any, items []T, locations []storage.TupleLocation) (item T, loc storage.TupleLocation, err error) {
+	if len(items) == 0 {
+		err = fmt.Errorf("failed to get item with key %v: %w", key, storage.ErrTupleNotFound)
+		return
+	}
+	return items[0], locations[0], nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
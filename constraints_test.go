@@ -0,0 +1,173 @@
+package gled
+
+import (
+	"errors"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+type account struct {
+	ID    int64  `gled:"pk,autoincrement"`
+	Email string `gled:"unique"`
+	Name  string `gled:"index"`
+}
+
+func TestConstraintsOf(t *testing.T) {
+	c, err := constraintsOf[account]()
+	assert.NoError(t, err)
+	assert.Equal(t, &constraints{
+		pk:            "ID",
+		autoincrement: true,
+		unique:        []string{"ID", "Email"},
+		indexed:       []string{"ID", "Email", "Name"},
+	}, c)
+	c, err = constraintsOf[map[string]any]()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	_, err = constraintsOf[struct {
+		A int `gled:"pk"`
+		B int `gled:"pk"`
+	}]()
+	assert.Error(t, err)
+	_, err = constraintsOf[struct {
+		A string `gled:"pk,autoincrement"`
+	}]()
+	assert.Error(t, err)
+	_, err = constraintsOf[struct {
+		A int `gled:"unique,autoincrement"`
+	}]()
+	assert.Error(t, err)
+	_, err = constraintsOf[struct {
+		A int `gled:"primary"`
+	}]()
+	assert.Error(t, err)
+}
+
+func TestConstraints(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir)
+	accounts, err := Table[account](db, "accounts")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(accounts.indexes))
+
+	// keys are generated for items inserted without one
+	assert.NoError(t, accounts.Insert(account{Email: "a@x", Name: "a"}))
+	assert.NoError(t, accounts.Insert(account{Email: "b@x", Name: "b"}))
+	assert.NoError(t, accounts.Insert(account{ID: 10, Email: "c@x", Name: "c"}))
+	assert.NoError(t, accounts.Insert(account{Email: "d@x", Name: "d"}))
+	item, loc, err := accounts.GetByKey(2)
+	assert.NoError(t, err)
+	assert.Equal(t, account{ID: 2, Email: "b@x", Name: "b"}, item)
+	item, _, err = accounts.GetByKey(int64(11))
+	assert.NoError(t, err)
+	assert.Equal(t, "d@x", item.Email)
+	_, _, err = accounts.GetByKey(5)
+	assert.True(t, errors.Is(err, storage.ErrTupleNotFound))
+
+	err = accounts.Insert(account{Email: "a@x"})
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	var violation *UniqueViolationError
+	assert.True(t, errors.As(err, &violation))
+	assert.Equal(t, UniqueViolationError{Table: "accounts", Column: "Email", Value: "a@x"}, *violation)
+	err = accounts.Insert(account{ID: 1, Email: "e@x"})
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	assert.True(t, errors.As(err, &violation))
+	assert.Equal(t, UniqueViolationError{Table: "accounts", Column: "ID", Value: int64(1)}, *violation)
+	err = accounts.Update(loc, account{ID: 2, Email: "c@x"})
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	// an item may keep its own values
+	assert.NoError(t, accounts.Update(loc, account{ID: 2, Email: "b@x", Name: "bb"}))
+	// and values of deleted items may be taken again
+	assert.NoError(t, accounts.Delete(loc))
+	assert.NoError(t, accounts.Insert(account{Email: "b@x"}))
+	_, err = db.Query("INSERT INTO accounts (ID, Email) VALUES (20, 'a@x')")
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+
+	// changes in a transaction are checked against one another
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	view, err := TxTable(tx, accounts)
+	assert.NoError(t, err)
+	assert.NoError(t, view.Insert(account{Email: "f@x"}))
+	assert.NoError(t, view.Insert(account{Email: "f@x"}))
+	assert.True(t, errors.Is(tx.Commit(), ErrUniqueViolation))
+	items, _, err := accounts.Select(exp.C("Email").Eq("f@x"))
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	assert.NoError(t, accounts.Close())
+	assert.NoError(t, db.Close())
+
+	// constraints are recorded, and kept for handles of other types
+	db = NewGleDB(dir)
+	defer db.Close()
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, "ID", tables[0].PrimaryKey)
+	assert.True(t, tables[0].AutoIncrement)
+	assert.Equal(t, []string{"ID", "Email"}, tables[0].Unique)
+	_, err = db.Query("INSERT INTO accounts (Email) VALUES ('c@x')")
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	_, err = db.Query("INSERT INTO accounts (Email) VALUES ('g@x')")
+	assert.NoError(t, err)
+	rows, err := db.Query("SELECT ID FROM accounts WHERE Email = 'g@x'")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"ID": int64(13)}}, rows)
+}
+
+type note struct {
+	Title string
+}
+
+type uniqueNote struct {
+	Title string `gled:"unique"`
+}
+
+func TestConstraintsOnExistingItems(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	notes, err := Table[note](db, "notes")
+	assert.NoError(t, err)
+	assert.NoError(t, notes.Insert(note{Title: "a"}))
+	assert.NoError(t, notes.Insert(note{Title: "a"}))
+	assert.NoError(t, notes.Close())
+
+	_, err = Table[uniqueNote](db, "notes")
+	assert.True(t, errors.Is(err, ErrUniqueViolation))
+	var violation *UniqueViolationError
+	assert.True(t, errors.As(err, &violation))
+	assert.Equal(t, UniqueViolationError{Table: "notes", Column: "Title", Value: "a"}, *violation)
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Empty(t, tables[0].Unique)
+
+	notes, err = Table[note](db, "notes")
+	assert.NoError(t, err)
+	_, locations, err := notes.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.NoError(t, notes.Delete(locations[0]))
+	assert.NoError(t, notes.Close())
+	unique, err := Table[uniqueNote](db, "notes")
+	assert.NoError(t, err)
+	defer unique.Close()
+	_, _, err = unique.GetByKey("a")
+	assert.Error(t, err, "table has no primary key")
+	assert.True(t, errors.Is(unique.Insert(uniqueNote{Title: "a"}), ErrUniqueViolation))
+}
+
+type pricedItem struct {
+	Price float64 `gled:"unique"`
+}
+
+func TestUniqueNegativeZero(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	items, err := Table[pricedItem](db, "items")
+	assert.NoError(t, err)
+	defer items.Close()
+	assert.NoError(t, items.Insert(pricedItem{Price: math.Copysign(0, -1)}))
+	assert.True(t, errors.Is(items.Insert(pricedItem{Price: 0}), ErrUniqueViolation))
+}
@@ -0,0 +1,449 @@
+package gled
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// number of entries of an index that a cursor fetches at a time
+	cursorBatchSize = 256
+)
+
+var (
+	// ErrTableVacuumed is returned by a cursor whose table is fully vacuumed while iterating,
+	// since the items it has not pulled yet are moved
+	ErrTableVacuumed = errors.New("table fully vacuumed while iterating")
+)
+
+// cursorRow is an item pulled by a cursor
+type cursorRow struct {
+	tuple storage.Tuple
+	loc   storage.TupleLocation
+	// the item decoded, nil until needed
+	item map[string]any
+	// key of the item in the index it's found through, if any
+	key []byte
+}
+
+// decoded decodes the item if it's not yet
+func (r *cursorRow) decoded() (item map[string]any, err error) {
+	if r.item == nil {
+		err = msgpack.Unmarshal(r.tuple, &r.item)
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal item: %w", err)
+			return
+		}
+	}
+	return r.item, nil
+}
+
+// cursor pulls the items matching an expression from a table as of a snapshot, a page at a time.
+// The table is locked only while fetching a page, so the items can be used in between
+type cursor struct {
+	t  *baseTable
+	ex exp.Ex
+	q  *selectQuery
+	s  *storage.Snapshot
+	// releases the snapshot, nil if the snapshot is not owned by the cursor
+	release func()
+	// whether the items to fetch are planned
+	planned bool
+	// the expression compiled when planned
+	predicate exp.Predicate
+	// relocations of the table when planned
+	relocations int
+	// index to fetch the items through and the range of its keys, if an index is used
+	idx *index
+	lo  []byte
+	hi  []byte
+	// the last entry of the index fetched, nil before the first batch
+	lastKey []byte
+	lastLoc storage.TupleLocation
+	// next page to scan and the number of pages, if the table is scanned
+	page  int64
+	pages int64
+	// offset of the tuple pointer to scan the next page from
+	from uint32
+	// items fetched but not pulled yet
+	rows []cursorRow
+	// items sorted, if ordered
+	sorter *sorter
+	merged *sortMerger
+	// number of items pulled, and skipped by the offset
+	count   int
+	skipped int
+	// position of the last item pulled
+	last *sortRow
+	done bool
+}
+
+func (t *baseTable) newCursor(s *storage.Snapshot, release func(), ex exp.Ex, opts []SelectOption) *cursor {
+	return &cursor{t: t, ex: ex, q: newSelectQuery(opts), s: s, release: release}
+}
+
+// next pulls the next item, false if there's none left
+func (c *cursor) next() (row cursorRow, ok bool, err error) {
+	if c.done || c.count == c.q.limit {
+		c.close()
+		return
+	}
+	err = c.q.err
+	if err == nil && c.q.after != nil && len(c.q.after.keys) != len(c.q.orderBy) {
+		err = fmt.Errorf("%w: the token is made by a select sorted differently", ErrInvalidToken)
+	}
+	for err == nil {
+		var keys []any
+		if len(c.q.orderBy) > 0 {
+			row, keys, ok, err = c.nextSorted()
+		} else {
+			row, ok, err = c.fetch()
+		}
+		if err != nil || !ok {
+			break
+		}
+		if c.skipped == c.q.offset {
+			c.last = &sortRow{loc: row.loc, keys: keys}
+			if row.key != nil {
+				c.last.index, c.last.key = c.idx.column, row.key
+			}
+			break
+		}
+		c.skipped++
+	}
+	if err != nil || !ok {
+		c.close()
+		return
+	}
+	c.count++
+	return
+}
+
+// nextSorted pulls the next item in order along with its sort keys, sorting all items first
+func (c *cursor) nextSorted() (row cursorRow, keys []any, ok bool, err error) {
+	if c.merged == nil {
+		limit := c.q.limit
+		if limit >= 0 {
+			limit += c.q.offset
+		}
+		c.sorter = c.t.db.newSorter(c.q.orderBy, limit)
+		for {
+			row, ok, err = c.fetch()
+			if err != nil {
+				return
+			}
+			if !ok {
+				break
+			}
+			var item map[string]any
+			item, err = row.decoded()
+			if err != nil {
+				return
+			}
+			sorted := c.sorter.row(row.tuple, row.loc, item)
+			if c.q.after != nil && c.sorter.compare(&sorted, c.q.after) <= 0 {
+				continue
+			}
+			err = c.sorter.add(sorted)
+			if err != nil {
+				return
+			}
+		}
+		c.merged, err = c.sorter.sorted()
+		if err != nil {
+			return
+		}
+	}
+	sorted, ok, err := c.merged.next()
+	if err != nil || !ok {
+		return
+	}
+	return cursorRow{tuple: sorted.tuple, loc: sorted.loc}, sorted.keys, true, nil
+}
+
+// fetch pulls the next item matching the expression in the order of the table or the index
+func (c *cursor) fetch() (row cursorRow, ok bool, err error) {
+	for len(c.rows) == 0 {
+		var more bool
+		more, err = c.fill()
+		if err != nil || !more {
+			return
+		}
+	}
+	row = c.rows[0]
+	c.rows = c.rows[1:]
+	return row, true, nil
+}
+
+// fill fetches the matching items of the next page, or the next batch of entries of the index
+// returns false if all are fetched
+func (c *cursor) fill() (more bool, err error) {
+	c.t.mu.RLock()
+	defer c.t.mu.RUnlock()
+	if !c.planned {
+		err = c.plan()
+		if err != nil {
+			return
+		}
+	}
+	if c.relocations != c.t.relocations {
+		err = ErrTableVacuumed
+		return
+	}
+	if c.idx != nil {
+		return c.fillIndexed()
+	}
+	if c.page >= c.pages {
+		return false, nil
+	}
+	_, err = c.t.table.ScanPage(c.s, c.page, c.from, c.match)
+	if err != nil {
+		return
+	}
+	c.page++
+	c.from = 0
+	return true, nil
+}
+
+// fillIndexed fetches the matching items of the next batch of entries in the range of the index,
+// resuming from the last entry fetched so that the range is never held in memory as a whole
+func (c *cursor) fillIndexed() (more bool, err error) {
+	var batch []cursorRow
+	collect := func(key []byte, loc storage.TupleLocation) (cont bool, err error) {
+		batch = append(batch, cursorRow{loc: loc, key: key})
+		return len(batch) < cursorBatchSize, nil
+	}
+	if c.lastKey == nil {
+		err = c.idx.tree.Range(c.lo, c.hi, collect)
+	} else {
+		err = c.idx.tree.RangeAfter(c.lastKey, c.lastLoc, c.hi, collect)
+	}
+	if err != nil || len(batch) == 0 {
+		return
+	}
+	c.lastKey, c.lastLoc = batch[len(batch)-1].key, batch[len(batch)-1].loc
+	for _, entry := range batch {
+		var tuple storage.Tuple
+		tuple, err = c.t.table.GetSnapshot(c.s, entry.loc)
+		if errors.Is(err, storage.ErrTupleNotFound) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		err = c.matchIndexed(tuple, entry.loc, entry.key)
+		if err != nil {
+			return
+		}
+	}
+	return true, nil
+}
+
+// plan whether to fetch the items through an index or by scanning the table.
+// Unsorted, the items are fetched from the one after the resume token,
+// through the index the token is made with, or by scanning the table if it's made without one.
+// Must be called with t.mu held
+func (c *cursor) plan() (err error) {
+	c.predicate = exp.Compile(c.ex)
+	var after *sortRow
+	if len(c.q.orderBy) == 0 {
+		after = c.q.after
+	}
+	idx, lo, hi, ok := c.t.planIndexScan(c.ex)
+	if after != nil && after.index == "" {
+		ok = false
+	} else if after != nil && (!ok || idx.column != after.index) {
+		// the items left in another order can't be told apart from the ones already pulled
+		err = fmt.Errorf("%w: the token is made through the index on %s, which the select is not planned with", ErrInvalidToken, after.index)
+		return
+	}
+	if ok {
+		c.idx, c.lo, c.hi = idx, lo, hi
+		if after != nil && bytes.Compare(after.key, lo) >= 0 {
+			c.lastKey, c.lastLoc = after.key, after.loc
+		}
+	} else {
+		c.pages, err = c.t.table.PageCount()
+		if err != nil {
+			err = fmt.Errorf("failed to plan select: %w", err)
+			return
+		}
+		if after != nil {
+			c.page, c.from = after.loc.Page, after.loc.Offset+1
+		}
+	}
+	c.relocations = c.t.relocations
+	c.planned = true
+	return
+}
+
+// match keeps an item fetched if it matches the expression
+func (c *cursor) match(tuple storage.Tuple, loc storage.TupleLocation) (cont bool, err error) {
+	tuple, err = c.t.upgrade(tuple)
+	if err != nil {
+		return
+	}
+	// the item is decoded only if it matches
+	matched, err := c.predicate(tuple)
+	if err != nil {
+		err = fmt.Errorf("failed to evaluate item at %v: %w", loc, err)
+		return
+	}
+	if matched {
+		c.rows = append(c.rows, cursorRow{tuple: tuple, loc: loc})
+	}
+	return true, nil
+}
+
+// matchIndexed keeps an item found under a key of the index if it matches the expression.
+// The location of an item is in the index under the keys of all its versions,
+// so the item is kept only under the key of the version visible, to be pulled once
+func (c *cursor) matchIndexed(tuple storage.Tuple, loc storage.TupleLocation, key []byte) (err error) {
+	n := len(c.rows)
+	_, err = c.match(tuple, loc)
+	if err != nil || len(c.rows) == n {
+		return
+	}
+	item, err := c.rows[n].decoded()
+	if err != nil {
+		return
+	}
+	visible, ok := c.idx.key(item)
+	if ok && len(visible) > storage.MaxBTreeKeySize {
+		visible = visible[:storage.MaxBTreeKeySize]
+	}
+	if !ok || !bytes.Equal(visible, key) {
+		c.rows = c.rows[:n]
+		return
+	}
+	c.rows[n].key = key
+	return
+}
+
+// close releases the snapshot and the temporary files of the cursor
+func (c *cursor) close() {
+	c.done = true
+	c.rows = nil
+	if c.sorter != nil {
+		c.sorter.close()
+		c.sorter = nil
+		c.merged = nil
+	}
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// Cursor iterates over selected items one at a time, pulling them from the table as needed
+// e.g.
+//
+//	c := table.Iter(ex)
+//	defer c.Close()
+//	for c.Next() {
+//		item := c.Item()
+//	}
+//	err := c.Err()
+//
+// The items are as of when the cursor is made, and a full vacuum of the table meanwhile stops it with ErrTableVacuumed.
+// A cursor is not safe for concurrent use
+type Cursor[T any] struct {
+	c    *cursor
+	item T
+	loc  storage.TupleLocation
+	err  error
+}
+
+// Iter makes a cursor over the items matching an expression, taking the same options as Select
+// the cursor must be closed unless all its items are iterated.
+// Items found through an index are pulled a batch of index entries at a time, in the order of their keys
+// rather than of the table, so a resume token of such a cursor continues through the same index
+func (t *GledTable[T]) Iter(ex exp.Ex, opts ...SelectOption) (c *Cursor[T]) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return &Cursor[T]{err: err}
+	}
+	s := txm.Snapshot()
+	return &Cursor[T]{c: t.newCursor(s, func() { txm.Release(s) }, ex, opts)}
+}
+
+// Iter makes a cursor over the items matching an expression as of when the transaction began
+func (v *GledTxTable[T]) Iter(ex exp.Ex, opts ...SelectOption) (c *Cursor[T]) {
+	tx := v.tx
+	tx.mu.Lock()
+	done := tx.done
+	tx.mu.Unlock()
+	if done {
+		return &Cursor[T]{err: ErrTxDone}
+	}
+	return &Cursor[T]{c: v.table.newCursor(tx.stx.Snapshot(), nil, ex, opts)}
+}
+
+// Next moves to the next item, false if there's none left or an error occurs
+func (c *Cursor[T]) Next() bool {
+	if c.err != nil || c.c == nil {
+		return false
+	}
+	row, ok, err := c.c.next()
+	if err == nil && ok {
+		var item T
+		err = msgpack.Unmarshal(row.tuple, &item)
+		c.item, c.loc = item, row.loc
+	}
+	if err != nil {
+		c.err = fmt.Errorf("failed to select items: %w", err)
+		c.c.close()
+		return false
+	}
+	return ok
+}
+
+// Item returns the current item
+func (c *Cursor[T]) Item() T {
+	return c.item
+}
+
+// Location returns the location of the current item
+func (c *Cursor[T]) Location() storage.TupleLocation {
+	return c.loc
+}
+
+// Err returns the error that stops the iteration, if any
+func (c *Cursor[T]) Err() error {
+	return c.err
+}
+
+// Close stops the iteration, releasing the resources held by the cursor
+func (c *Cursor[T]) Close() error {
+	if c.c != nil {
+		c.c.close()
+	}
+	return nil
+}
+
+// All iterates over the items matching an expression, taking the same options as Select.
+// The iteration stops once |yield| returns false, or after yielding an error, e.g.
+//
+//	table.All(ex)(func(item T, err error) bool {
+//		...
+//		return true
+//	})
+func (t *GledTable[T]) All(ex exp.Ex, opts ...SelectOption) func(yield func(item T, err error) bool) {
+	return func(yield func(item T, err error) bool) {
+		c := t.Iter(ex, opts...)
+		defer c.Close()
+		for c.Next() {
+			if !yield(c.Item(), nil) {
+				return
+			}
+		}
+		if err := c.Err(); err != nil {
+			var zero T
+			yield(zero, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package gled
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+type cursorBook struct {
+	Name  string
+	Count int
+}
+
+func TestIter(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[cursorBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, books.Insert(cursorBook{Name: fmt.Sprintf("book-%04d", i), Count: i % 10}))
+	}
+	pages, err := books.table.PageCount()
+	assert.NoError(t, err)
+	assert.Greater(t, pages, int64(1))
+
+	// items are pulled as of when the cursor is made, and can be changed in between
+	c := books.Iter(exp.C("Count").Eq(3))
+	count := 0
+	for c.Next() {
+		assert.Equal(t, 3, c.Item().Count)
+		item, err := books.Get(c.Location())
+		assert.NoError(t, err)
+		assert.Equal(t, c.Item(), item)
+		if count == 0 {
+			assert.NoError(t, books.Insert(cursorBook{Name: "new", Count: 3}))
+		}
+		count++
+	}
+	assert.NoError(t, c.Err())
+	assert.NoError(t, c.Close())
+	assert.Equal(t, 100, count)
+
+	// or stopped early
+	c = books.Iter(exp.AndEx{}, OrderBy("Name", Desc))
+	assert.True(t, c.Next())
+	assert.Equal(t, "new", c.Item().Name)
+	assert.True(t, c.Next())
+	assert.Equal(t, "book-0999", c.Item().Name)
+	assert.NoError(t, c.Close())
+	assert.False(t, c.Next())
+
+	// items found by an index are pulled in batches
+	assert.NoError(t, books.CreateIndex("Name"))
+	c = books.Iter(exp.C("Name").Gte("book-0500"), Limit(300))
+	count = 0
+	for c.Next() {
+		count++
+	}
+	assert.NoError(t, c.Err())
+	assert.Equal(t, 300, count)
+	// in the order of the keys, under the key of the version visible only
+	_, err = books.UpdateWhere(exp.C("Name").Eq("book-0500"), func(item *cursorBook) { item.Name = "book-0999a" })
+	assert.NoError(t, err)
+	var found []string
+	c = books.Iter(exp.C("Name").Gte("book-0500"))
+	for c.Next() {
+		found = append(found, c.Item().Name)
+	}
+	assert.NoError(t, c.Err())
+	assert.Equal(t, 501, len(found))
+	assert.Equal(t, []string{"book-0501", "book-0999", "book-0999a", "new"}, []string{found[0], found[498], found[499], found[500]})
+
+	var names []string
+	books.All(exp.C("Count").Eq(9))(func(item cursorBook, err error) bool {
+		assert.NoError(t, err)
+		names = append(names, item.Name)
+		return len(names) < 3
+	})
+	assert.Equal(t, []string{"book-0009", "book-0019", "book-0029"}, names)
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	view, err := TxTable(tx, books)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+	c = view.Iter(exp.AndEx{})
+	assert.False(t, c.Next())
+	assert.True(t, errors.Is(c.Err(), ErrTxDone))
+
+	// expressions that can never match select nothing, like Eval
+	none, _, err := books.Select(exp.C("Name").Eq(true))
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestIterVacuum(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[cursorBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	padding := strings.Repeat("x", 500)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, books.Insert(cursorBook{Name: fmt.Sprintf("book-%03d-%s", i, padding), Count: i}))
+	}
+	_, err = books.DeleteWhere(exp.C("Count").Lt(100))
+	assert.NoError(t, err)
+	iterate := func(c *Cursor[cursorBook], vacuum func() error) (count int) {
+		for c.Next() {
+			if count == 0 {
+				assert.NoError(t, vacuum())
+			}
+			count++
+		}
+		return
+	}
+
+	// items keep their locations in a vacuum
+	c := books.Iter(exp.AndEx{})
+	assert.Equal(t, 100, iterate(c, books.Vacuum))
+	assert.NoError(t, c.Err())
+
+	// but not in a full one, which moves the items left to pull
+	c = books.Iter(exp.AndEx{})
+	iterate(c, books.VacuumFull)
+	assert.True(t, errors.Is(c.Err(), ErrTableVacuumed))
+	assert.NoError(t, books.CreateIndex("Count"))
+	c = books.Iter(exp.C("Count").Gte(100))
+	iterate(c, books.VacuumFull)
+	assert.True(t, errors.Is(c.Err(), ErrTableVacuumed))
+	c = books.Iter(exp.AndEx{})
+	assert.Equal(t, 100, iterate(c, func() error { return nil }))
+	assert.NoError(t, c.Err())
+}
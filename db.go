@@ -5,17 +5,213 @@ import (
 	"github.com/luminocean/gled/storage"
 	"os"
 	"path"
+	"sync"
+)
+
+const (
+	// default bytes of table pages cached in memory
+	defaultBufferPoolSize = 16 * 1024 * 1024
 )
 
 type GledDB struct {
 	dir string
+	// buffer pool caching pages of all tables, nil if pages are not cached
+	pool *storage.BufferPool
+	// whether large items are compressed
+	compress bool
+	// bytes of items a sort or a join holds in memory before spilling them into temporary files
+	sortMemory int64
+	// write-ahead log shared by all tables in the directory, opened with the first table
+	wal *storage.Wal
+	// manager of the transactions versioning tuples of all tables, opened along with the log
+	txm *storage.TxManager
+	// tables opened by name, shared by all handles of the same table
+	tables map[string]*baseTable
+	mu     sync.Mutex
+	// table recording the tables of the db, opened with the first table
+	catalog *GledTable[TableInfo]
+	// migrations of item types registered by table name, guarded by catalogMu
+	migrations map[string][]*migration
+	// held while reading or changing the catalog, before mu if both are held
+	catalogMu sync.Mutex
 }
 
-func NewGleDB(directory string) *GledDB {
-	return &GledDB{dir: directory}
+// DBOption configures a db
+type DBOption func(db *GledDB)
+
+// WithBufferPoolSize sets the bytes of table pages cached in memory, shared by all tables of the db
+// a size of 0 disables caching
+func WithBufferPoolSize(size int64) DBOption {
+	return func(db *GledDB) {
+		if size <= 0 {
+			db.pool = nil
+			return
+		}
+		db.pool = storage.NewBufferPool(size)
+	}
 }
 
+// WithCompression sets whether items too large to be stored in line are compressed
+func WithCompression(enabled bool) DBOption {
+	return func(db *GledDB) {
+		db.compress = enabled
+	}
+}
+
+// WithSortMemory sets the bytes of items each sort or join holds in memory, beyond which they are spilled into temporary files
+// a size of 0 or less takes the default
+func WithSortMemory(size int64) DBOption {
+	return func(db *GledDB) {
+		db.sortMemory = size
+	}
+}
+
+func NewGleDB(directory string, opts ...DBOption) *GledDB {
+	db := &GledDB{
+		dir:        directory,
+		pool:       storage.NewBufferPool(defaultBufferPoolSize),
+		sortMemory: defaultSortMemory,
+		tables:     map[string]*baseTable{},
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// BufferPoolStats returns the access counters of the buffer pool of the db
+func (db *GledDB) BufferPoolStats() storage.BufferPoolStats {
+	if db.pool == nil {
+		return storage.BufferPoolStats{}
+	}
+	return db.pool.Stats()
+}
+
+// Close closes the catalog, the write-ahead log and the transaction manager of the db.
+// All tables of the db should be closed before
+func (db *GledDB) Close() (err error) {
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	if db.catalog != nil {
+		err = db.catalog.Close()
+		if err != nil {
+			err = fmt.Errorf("failed to close catalog: %w", err)
+			return
+		}
+		db.catalog = nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal == nil {
+		return
+	}
+	err = db.wal.Close()
+	if err != nil {
+		return
+	}
+	err = db.txm.Close()
+	if err != nil {
+		return
+	}
+	db.wal = nil
+	db.txm = nil
+	return
+}
+
+// get the write-ahead log and the transaction manager of the db, opening them if needed
+// opening the log also recovers operations interrupted by a previous crash
+func (db *GledDB) open() (wal *storage.Wal, txm *storage.TxManager, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal == nil {
+		db.txm, err = storage.OpenTxManager(db.dir)
+		if err != nil {
+			err = fmt.Errorf("failed to open transaction manager: %w", err)
+			return
+		}
+		db.wal, err = storage.OpenWal(db.dir)
+		if err != nil {
+			_ = db.txm.Close()
+			db.txm = nil
+			err = fmt.Errorf("failed to open wal: %w", err)
+			return
+		}
+	}
+	return db.wal, db.txm, nil
+}
+
+// Table opens a table of items of type T, creating it if it does not exist.
+// Handles of the same table opened more than once share the table, which is closed with the last of them.
+// Returns ErrIncompatibleType if the table holds items that cannot be decoded as T
 func Table[T any](db *GledDB, name string) (table *GledTable[T], err error) {
+	c, err := constraintsOf[T]()
+	if err != nil {
+		return
+	}
+	base, err := db.openTable(typeInfo[T](name), c)
+	if err != nil {
+		return
+	}
+	table = &GledTable[T]{baseTable: base}
+	return
+}
+
+// open a table by name, or share it if it's already opened
+// the table is recorded in the catalog if it's new, and checked against |info| otherwise.
+// The table is then constrained by |c|, or by the recorded constraints if |c| is nil
+func (db *GledDB) openTable(info *TableInfo, c *constraints) (table *baseTable, err error) {
+	if info.Name == catalogTableName {
+		err = fmt.Errorf("table name %s is reserved", info.Name)
+		return
+	}
+	err = db.checkTableName(info.Name)
+	if err != nil {
+		return
+	}
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	recorded, migrated, err := db.recordTable(info)
+	if err != nil {
+		return
+	}
+	versions, err := db.schemaVersions(recorded)
+	if err != nil {
+		return
+	}
+	table, err = db.openBaseTable(info.Name, versions)
+	if err != nil {
+		return
+	}
+	if migrated {
+		// indexes hold the keys of the items as of their older versions
+		table.mu.Lock()
+		err = table.rebuildIndexes(table.indexes...)
+		table.mu.Unlock()
+		if err != nil {
+			err = fmt.Errorf("failed to rebuild indexes of migrated table %s: %w", info.Name, err)
+			_ = table.release()
+			table = nil
+			return
+		}
+	}
+	if c == nil {
+		c = recorded.constraints()
+	}
+	// recorded unique columns have been checked when they were first constrained
+	err = table.constrain(c, recorded.Unique)
+	if err == nil {
+		err = db.recordConstraints(info.Name, c)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to constrain table %s: %w", info.Name, err)
+		_ = table.release()
+		table = nil
+		return
+	}
+	return
+}
+
+func (db *GledDB) checkTableName(name string) (err error) {
 	dirInfo, err := os.Stat(db.dir)
 	if err != nil {
 		err = fmt.Errorf("failed to check db directory: %w", err)
@@ -29,8 +225,25 @@ func Table[T any](db *GledDB, name string) (table *GledTable[T], err error) {
 		err = fmt.Errorf("invalid db name: %s", name)
 		return
 	}
+	return
+}
+
+// open the files of a table, or share them if the table is already opened
+// |versions| gives the schema versions of the items if the table is not opened yet
+func (db *GledDB) openBaseTable(name string, versions schemaVersions) (table *baseTable, err error) {
+	wal, txm, err := db.open()
+	if err != nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if table = db.tables[name]; table != nil {
+		table.refs++
+		return
+	}
 	dataPath := path.Join(db.dir, fmt.Sprintf("%s.gled", name))
 	fsmPath := path.Join(db.dir, fmt.Sprintf("%s.fsm.gled", name))
+	ovfPath := path.Join(db.dir, fmt.Sprintf("%s.ovf.gled", name))
 
 	dataFile, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, filePerm)
 	if err != nil {
@@ -39,11 +252,44 @@ func Table[T any](db *GledDB, name string) (table *GledTable[T], err error) {
 	}
 	fsmFile, err := os.OpenFile(fsmPath, os.O_RDWR|os.O_CREATE, filePerm)
 	if err != nil {
+		_ = dataFile.Close()
 		err = fmt.Errorf("failed to open fsm file %s: %w", fsmPath, err)
 		return
 	}
-	table = &GledTable[T]{
-		table: storage.NewTable(dataFile, fsmFile),
+	ovfFile, err := os.OpenFile(ovfPath, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		_ = dataFile.Close()
+		_ = fsmFile.Close()
+		err = fmt.Errorf("failed to open overflow file %s: %w", ovfPath, err)
+		return
+	}
+	storageTable, err := storage.OpenTable(dataFile, fsmFile, storage.TableOptions{
+		Wal:       wal,
+		TxManager: txm,
+		Pool:      db.pool,
+		Overflow:  ovfFile,
+		Compress:  db.compress,
+	})
+	if err != nil {
+		_ = dataFile.Close()
+		_ = fsmFile.Close()
+		_ = ovfFile.Close()
+		err = fmt.Errorf("failed to open table %s: %w", name, err)
+		return
+	}
+	table = &baseTable{
+		db:       db,
+		name:     name,
+		table:    storageTable,
+		versions: versions,
+		refs:     1,
+	}
+	err = table.openIndexes()
+	if err != nil {
+		_ = table.close()
+		table = nil
+		return
 	}
+	db.tables[name] = table
 	return
 }
@@ -0,0 +1,78 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+type document struct {
+	Title string
+	Body  string
+}
+
+func TestLargeItems(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		db := NewGleDB(t.TempDir(), WithCompression(compress))
+		docs, err := Table[document](db, "docs")
+		assert.NoError(t, err)
+
+		body := strings.Repeat("lorem ipsum dolor sit amet ", 2000)
+		assert.NoError(t, docs.Insert(document{Title: "long", Body: body}))
+		assert.NoError(t, docs.Insert(document{Title: "short", Body: "tl;dr"}))
+		items, _, err := docs.Select(exp.C("Title").Eq("long"))
+		assert.NoError(t, err)
+		assert.Equal(t, []document{{Title: "long", Body: body}}, items)
+
+		// still readable after reopening
+		assert.NoError(t, docs.Close())
+		assert.NoError(t, db.Close())
+		db = NewGleDB(db.dir)
+		docs, err = Table[document](db, "docs")
+		assert.NoError(t, err)
+		items, _, err = docs.Select(exp.AndEx{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(items))
+		assert.Equal(t, body, items[0].Body)
+		assert.NoError(t, docs.Close())
+		assert.NoError(t, db.Close())
+	}
+}
+
+func TestStableLocations(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	docs, err := Table[document](db, "docs")
+	assert.NoError(t, err)
+	defer docs.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, docs.Insert(document{Title: fmt.Sprintf("doc-%d", i)}))
+	}
+	items, locations, err := docs.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(locations))
+
+	// locations of the remaining items survive deletes and vacuuming
+	assert.NoError(t, docs.Delete(locations[1]))
+	assert.NoError(t, docs.Delete(locations[3]))
+	assert.NoError(t, docs.Vacuum())
+	for _, i := range []int{0, 2, 4} {
+		item, err := docs.Get(locations[i])
+		assert.NoError(t, err)
+		assert.Equal(t, items[i], item)
+	}
+	_, err = docs.Get(locations[1])
+	assert.ErrorIs(t, err, storage.ErrTupleNotFound)
+	_, err = docs.Get(storage.TupleLocation{Page: 10})
+	assert.ErrorIs(t, err, storage.ErrTupleNotFound)
+
+	// and select still agrees with them
+	selected, selectedLocations, err := docs.Select(exp.C("Title").Eq("doc-4"))
+	assert.NoError(t, err)
+	assert.Equal(t, []document{items[4]}, selected)
+	assert.Equal(t, []storage.TupleLocation{locations[4]}, selectedLocations)
+}
@@ -0,0 +1,244 @@
+// Package driver registers gled as a database/sql driver named "gled"
+// whose data source name is the directory of the db:
+//
+//	db, err := sql.Open("gled", "/path/to/dir")
+//
+// Connections to the same directory share one GledDB, so a directory should not be
+// opened by gled.NewGleDB while it is used through the driver
+package driver
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled"
+	gledsql "github.com/luminocean/gled/sql"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	sql.Register("gled", &Driver{})
+}
+
+// Driver opens connections to gled dbs
+type Driver struct{}
+
+// a db shared by the connections to its directory
+type sharedDB struct {
+	db   *gled.GledDB
+	refs int
+}
+
+var (
+	dbs   = map[string]*sharedDB{}
+	dbsMu sync.Mutex
+)
+
+// Open opens a connection to the db in directory |dsn|
+func (d *Driver) Open(dsn string) (conn sqldriver.Conn, err error) {
+	dir, err := filepath.Abs(dsn)
+	if err != nil {
+		err = fmt.Errorf("failed to resolve directory %s: %w", dsn, err)
+		return
+	}
+	dbsMu.Lock()
+	defer dbsMu.Unlock()
+	shared, ok := dbs[dir]
+	if !ok {
+		shared = &sharedDB{db: gled.NewGleDB(dir)}
+		dbs[dir] = shared
+	}
+	shared.refs++
+	return &Conn{dir: dir, db: shared.db}, nil
+}
+
+// Conn is a connection to a gled db
+type Conn struct {
+	dir string
+	db  *gled.GledDB
+	// the running transaction, nil if statements are committed automatically
+	tx     *gled.GledTx
+	closed bool
+}
+
+// Prepare parses a statement
+func (c *Conn) Prepare(query string) (stmt sqldriver.Stmt, err error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	parsed, err := gledsql.Parse(query)
+	if err != nil {
+		return
+	}
+	return &Stmt{conn: c, query: query, params: gledsql.NumParams(parsed)}, nil
+}
+
+// Close closes the connection, closing the db when it's the last connection to it
+// a running transaction is rolled back
+func (c *Conn) Close() (err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.tx != nil {
+		_ = c.tx.Rollback()
+		c.tx = nil
+	}
+	dbsMu.Lock()
+	defer dbsMu.Unlock()
+	shared := dbs[c.dir]
+	shared.refs--
+	if shared.refs > 0 {
+		return
+	}
+	delete(dbs, c.dir)
+	err = shared.db.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to close db: %w", err)
+		return
+	}
+	return
+}
+
+// Begin begins a transaction, which the following statements on the connection run in
+func (c *Conn) Begin() (tx sqldriver.Tx, err error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	if c.tx != nil {
+		err = errors.New("transaction already running")
+		return
+	}
+	c.tx, err = c.db.Begin()
+	if err != nil {
+		return
+	}
+	return &Tx{conn: c}, nil
+}
+
+// run a statement, within the running transaction if any
+func (c *Conn) exec(query string, args []sqldriver.Value) (result *gled.Result, err error) {
+	if c.closed {
+		return nil, sqldriver.ErrBadConn
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	if c.tx != nil {
+		return c.tx.Exec(query, values...)
+	}
+	return c.db.Exec(query, values...)
+}
+
+// Tx is a transaction of a connection
+type Tx struct {
+	conn *Conn
+}
+
+func (t *Tx) Commit() (err error) {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return gled.ErrTxDone
+	}
+	return tx.Commit()
+}
+
+func (t *Tx) Rollback() (err error) {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return gled.ErrTxDone
+	}
+	return tx.Rollback()
+}
+
+// Stmt is a prepared statement, with "?" placeholders bound to the arguments it's run with
+type Stmt struct {
+	conn  *Conn
+	query string
+	// number of placeholders
+	params int
+}
+
+func (s *Stmt) Close() error {
+	return nil
+}
+
+func (s *Stmt) NumInput() int {
+	return s.params
+}
+
+func (s *Stmt) Exec(args []sqldriver.Value) (result sqldriver.Result, err error) {
+	r, err := s.conn.exec(s.query, args)
+	if err != nil {
+		return
+	}
+	return sqldriver.RowsAffected(r.RowsAffected), nil
+}
+
+func (s *Stmt) Query(args []sqldriver.Value) (rows sqldriver.Rows, err error) {
+	r, err := s.conn.exec(s.query, args)
+	if err != nil {
+		return
+	}
+	return &Rows{columns: r.Columns, rows: r.Rows}, nil
+}
+
+// Rows iterates over the rows selected by a statement
+// nested fields and arrays are returned as JSON
+type Rows struct {
+	columns []string
+	rows    []map[string]any
+	pos     int
+}
+
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+func (r *Rows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *Rows) Next(dest []sqldriver.Value) (err error) {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.pos]
+	r.pos++
+	for i, column := range r.columns {
+		dest[i], err = value(row[column])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// value converts a value of a row into one of the types allowed by database/sql
+func value(v any) (dv sqldriver.Value, err error) {
+	switch v := v.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time:
+		return v, nil
+	case uint64:
+		// too large for an int64
+		return strconv.FormatUint(v, 10), nil
+	default:
+		var data []byte
+		data, err = json.Marshal(v)
+		if err != nil {
+			err = fmt.Errorf("failed to convert %v of type %T: %w", v, v, err)
+			return
+		}
+		return data, nil
+	}
+}
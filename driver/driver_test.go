@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDriver(t *testing.T) {
+	db, err := sql.Open("gled", t.TempDir())
+	assert.NoError(t, err)
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO books (Name, Count) VALUES (?, ?), ('b', 20)", "a", 10)
+	assert.NoError(t, err)
+	affected, err := result.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), affected)
+
+	stmt, err := db.Prepare("SELECT Name, Count AS n FROM books WHERE Count > ?")
+	assert.NoError(t, err)
+	defer stmt.Close()
+	rows, err := stmt.Query(15)
+	assert.NoError(t, err)
+	columns, err := rows.Columns()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Name", "n"}, columns)
+	var names []string
+	for rows.Next() {
+		var name string
+		var count int
+		assert.NoError(t, rows.Scan(&name, &count))
+		assert.Equal(t, 20, count)
+		names = append(names, name)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []string{"b"}, names)
+
+	_, err = db.Exec("SELECT * FROM books WHERE Count > ?")
+	assert.Error(t, err)
+}
+
+func TestDriverTx(t *testing.T) {
+	db, err := sql.Open("gled", t.TempDir())
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO books (Name, Count) VALUES ('a', 1)")
+	assert.NoError(t, err)
+
+	count := func() (n int) {
+		rows, err := db.Query("SELECT Name FROM books")
+		assert.NoError(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			n++
+		}
+		return
+	}
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO books (Name, Count) VALUES ('b', 2)")
+	assert.NoError(t, err)
+	var name string
+	assert.NoError(t, tx.QueryRow("SELECT Name FROM books WHERE Count = 1").Scan(&name))
+	assert.Equal(t, "a", name)
+	assert.Equal(t, 1, count())
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, count())
+
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec("DELETE FROM books WHERE Name = ?", "a")
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+	assert.Equal(t, 2, count())
+}
+
+func TestDriverTime(t *testing.T) {
+	db, err := sql.Open("gled", t.TempDir())
+	assert.NoError(t, err)
+	defer db.Close()
+
+	at := time.Date(2022, 5, 1, 12, 30, 0, 0, time.UTC)
+	_, err = db.Exec("INSERT INTO evs (Name, At) VALUES (?, ?)", "a", at)
+	assert.NoError(t, err)
+	rows, err := db.Query("SELECT At FROM evs")
+	assert.NoError(t, err)
+	defer rows.Close()
+	assert.True(t, rows.Next())
+	var scanned time.Time
+	assert.NoError(t, rows.Scan(&scanned))
+	assert.True(t, at.Equal(scanned))
+	assert.False(t, rows.Next())
+	assert.NoError(t, rows.Err())
+}
@@ -14,6 +14,7 @@ type Book struct {
 func main() {
 	// table files will be created under "."
 	db := gled.NewGleDB(".")
+	defer db.Close()
 
 	// create a new table for books
 	table, _ := gled.Table[Book](db, "basic")
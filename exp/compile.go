@@ -0,0 +1,184 @@
+package exp
+
+import (
+	"strings"
+)
+
+// Predicate evaluates whether an item encoded by msgpack matches the expression it's compiled from
+type Predicate func(tuple []byte) (matched bool, err error)
+
+// Compile compiles an expression into a predicate evaluating it like EvalTuple does.
+// The column paths and operands are resolved once, so the predicate can be evaluated on many items faster.
+// Expressions that can never match, such as comparisons by unknown operators or with values of
+// unsupported types, compile into predicates that match nothing, as Eval does
+func Compile(ex Ex) Predicate {
+	switch expression := ex.(type) {
+	case ComparisonEx:
+		return compileComparison(expression)
+	case OrEx:
+		// true for empty exp
+		if len(expression.Exps) == 0 {
+			return always
+		}
+		ps := compileAll(expression.Exps)
+		return func(tuple []byte) (matched bool, err error) {
+			for _, p := range ps {
+				matched, err = p(tuple)
+				if err != nil || matched {
+					return
+				}
+			}
+			return false, nil
+		}
+	case AndEx:
+		if len(expression.Exps) == 0 {
+			return always
+		}
+		ps := compileAll(expression.Exps)
+		return func(tuple []byte) (matched bool, err error) {
+			for _, p := range ps {
+				matched, err = p(tuple)
+				if err != nil || !matched {
+					return
+				}
+			}
+			return true, nil
+		}
+	case NotEx:
+		inner := Compile(expression.Exp)
+		return func(tuple []byte) (matched bool, err error) {
+			matched, err = inner(tuple)
+			return !matched && err == nil, err
+		}
+	case ExistsEx:
+		path := compilePath(expression.column)
+		return func(tuple []byte) (matched bool, err error) {
+			r, found, err := seekTuplePath(tuple, path)
+			if err != nil || !found {
+				return false, err
+			}
+			return r.notNil()
+		}
+	default:
+		return never
+	}
+}
+
+// always matches any item
+func always([]byte) (bool, error) {
+	return true, nil
+}
+
+// never matches no item
+func never([]byte) (bool, error) {
+	return false, nil
+}
+
+func compileAll(exps []Ex) (ps []Predicate) {
+	for _, ex := range exps {
+		ps = append(ps, Compile(ex))
+	}
+	return
+}
+
+func compileComparison(ex ComparisonEx) Predicate {
+	left := compileOperand(ex.left)
+	if values, ok := ex.right.(Values); ok {
+		return compileIn(left, ex.op, values)
+	}
+	right := compileOperand(ex.right)
+	op := ex.op
+	return func(tuple []byte) (matched bool, err error) {
+		l, found, err := left(tuple)
+		if err != nil || !found {
+			return
+		}
+		r, found, err := right(tuple)
+		if err != nil || !found {
+			return
+		}
+		return compareRaw(l, op, r), nil
+	}
+}
+
+func compileIn(left operand, opCode OpCode, values Values) Predicate {
+	if opCode != ExOpIn && opCode != ExOpNotIn {
+		return never
+	}
+	set := newRawSet(values)
+	in := opCode == ExOpIn
+	return func(tuple []byte) (matched bool, err error) {
+		v, found, err := left(tuple)
+		if err != nil || !found {
+			return
+		}
+		return set.contains(v) == in, nil
+	}
+}
+
+// rawSet is a set of primitive values, numbers being of the widest types of their kinds.
+// A value is in the set if it equals any of them by compareRaw
+type rawSet struct {
+	ints    map[int64]struct{}
+	floats  map[float64]struct{}
+	strings map[string]struct{}
+}
+
+func newRawSet(values Values) rawSet {
+	set := rawSet{ints: map[int64]struct{}{}, floats: map[float64]struct{}{}, strings: map[string]struct{}{}}
+	for _, value := range values {
+		v := raw(value)
+		switch v.kind {
+		case rawInt:
+			set.ints[v.i] = struct{}{}
+		case rawFloat:
+			set.floats[v.f] = struct{}{}
+		case rawString:
+			set.strings[v.s] = struct{}{}
+		}
+	}
+	return set
+}
+
+// contains reports whether a value equals any value of the set
+func (s rawSet) contains(v rawValue) (found bool) {
+	switch v.kind {
+	case rawInt:
+		_, found = s.ints[v.i]
+	case rawFloat:
+		_, found = s.floats[v.f]
+	case rawString:
+		if v.encoded {
+			_, found = s.strings[string(v.b)]
+		} else {
+			_, found = s.strings[v.s]
+		}
+	}
+	return
+}
+
+// operand resolves the value of an operand for an item, false if the item has no value for it
+type operand func(tuple []byte) (v rawValue, found bool, err error)
+
+// compileOperand resolves an operand like resolveToPrimValue does,
+// operands of unsupported types being invalid values that equal nothing
+func compileOperand(value OpValue) operand {
+	if column, ok := value.(Column); ok {
+		path := compilePath(column)
+		return func(tuple []byte) (rawValue, bool, error) {
+			return readTuplePath(tuple, path)
+		}
+	}
+	var constant rawValue
+	if prim, ok := value.(OpPrimValue); ok {
+		constant = raw(prim)
+	}
+	return func([]byte) (rawValue, bool, error) {
+		return constant, true, nil
+	}
+}
+
+// compilePath splits a column into the names of nested fields
+func compilePath(column Column) []string {
+	return strings.Split(string(column), ".")
+}
@@ -0,0 +1,65 @@
+package exp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"math"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	data := map[string]any{
+		"key1": "value",
+		"key2": 100,
+		"key3": map[string]any{"key4": 10.25},
+		"nan":  math.NaN(),
+	}
+	tuple, err := msgpack.Marshal(data)
+	assert.NoError(t, err)
+	for _, ex := range []Ex{
+		C("key1").Eq("value"),
+		C("key1").Neq("value"),
+		C("key1").Gte(C("key1")),
+		C("key2").Lte(100),
+		C("key2").Gt(99.5),
+		C("key3.key4").Lt(11),
+		C("key3.key4").Lt(11.0),
+		C("key3.missing").Eq(1),
+		C("nan").Neq(0.0),
+		C("nan").Eq(C("nan")),
+		OrEx{Exps: []Ex{C("key1").Eq("another-value"), C("key2").Lt(120)}},
+		AndEx{Exps: []Ex{C("key1").Eq("value"), OrEx{Exps: []Ex{C("key2").Gt(100)}}}},
+		OrEx{},
+		AndEx{},
+	} {
+		matched, err := Compile(ex)(tuple)
+		assert.NoError(t, err)
+		assert.Equal(t, Eval(data, ex), matched, "%v", ex)
+	}
+
+	p := Compile(AndEx{Exps: []Ex{C("key3.key4").Gt(5.12), C("key1").Eq("another-value")}})
+	matched := true
+	allocs := testing.AllocsPerRun(100, func() {
+		matched, _ = p(tuple)
+	})
+	assert.False(t, matched)
+	assert.Equal(t, 0.0, allocs)
+
+	// expressions that can never match are evaluated like Eval does rather than rejected
+	for _, ex := range []Ex{
+		nil,
+		Not(nil),
+		C("key1").Eq(true),
+		C("key1").Eq(nil),
+		Not(C("key1").Eq(true)),
+		C("key1").In("value", true),
+		C("key1").NotIn("value", true),
+		ComparisonEx{left: C("key1"), op: ExOpEq, right: Values{String("value")}},
+		OrEx{Exps: []Ex{C("key2").Gt(1000), C("key1..key4").Eq(1)}},
+		ComparisonEx{left: C("key1"), op: "like", right: String("value")},
+	} {
+		matched, err := Compile(ex)(tuple)
+		assert.NoError(t, err)
+		assert.Equal(t, Eval(data, ex), matched, "%v", ex)
+	}
+}
@@ -1,7 +1,6 @@
 package exp
 
 import (
-	"reflect"
 	"strings"
 )
 
@@ -28,6 +27,11 @@ func Eval(data map[string]any, exp Ex) bool {
 			}
 		}
 		return true
+	case NotEx:
+		return !Eval(data, expression.Exp)
+	case ExistsEx:
+		value, found := lookup(data, expression.column)
+		return found && value != nil
 	default:
 		return false
 	}
@@ -39,30 +43,59 @@ func evalField(data map[string]any, left OpValue, opCode OpCode, right OpValue)
 	if !found {
 		return false
 	}
+	if values, ok := right.(Values); ok {
+		return evalIn(lopv, opCode, values)
+	}
 	ropv, found = resolveToPrimValue(data, right)
 	if !found {
 		return false
 	}
-	if reflect.TypeOf(lopv) != reflect.TypeOf(ropv) {
+	return comparePrimValues(lopv, opCode, ropv)
+}
+
+// evalIn evaluates whether a value is in a set of values
+func evalIn(value OpPrimValue, opCode OpCode, values Values) bool {
+	var in bool
+	for _, v := range values {
+		if comparePrimValues(value, ExOpEq, v) {
+			in = true
+			break
+		}
+	}
+	switch opCode {
+	case ExOpIn:
+		return in
+	case ExOpNotIn:
+		return !in
+	default:
+		return false
+	}
+}
+
+func comparePrimValues(lopv OpPrimValue, opCode OpCode, ropv OpPrimValue) bool {
+	return compareRaw(raw(lopv), opCode, raw(ropv))
+}
+
+// compareRaw compares primitive values by an operator, the rules shared by Eval, EvalTuple and Compile.
+// Integers and floats of different widths are compared as the widest ones of their kinds,
+// and values of different kinds, or invalid ones, never match
+func compareRaw(left rawValue, opCode OpCode, right rawValue) bool {
+	if left.kind != right.kind {
 		return false
 	}
-	switch lv := lopv.(type) {
-	case String:
-		return compareField(lv, opCode, ropv.(String))
-	case Int32:
-		return compareField(lv, opCode, ropv.(Int32))
-	case Int64:
-		return compareField(lv, opCode, ropv.(Int64))
-	case Float32:
-		return compareField(lv, opCode, ropv.(Float32))
-	case Float64:
-		return compareField(lv, opCode, ropv.(Float64))
+	switch left.kind {
+	case rawInt:
+		return compareField(left.i, opCode, right.i)
+	case rawFloat:
+		return compareField(left.f, opCode, right.f)
+	case rawString:
+		return compareField(compareStrings(left, right), opCode, 0)
 	default:
 		return false
 	}
 }
 
-func compareField[T String | Int32 | Int64 | Float32 | Float64](left T, opCode OpCode, right T) bool {
+func compareField[T int | int64 | float64](left T, opCode OpCode, right T) bool {
 	switch opCode {
 	case ExOpGt:
 		return left > right
@@ -95,30 +128,35 @@ func resolveToPrimValue(data map[string]any, value OpValue) (OpPrimValue, bool)
 	return opv, true
 }
 
+// ReadColumn reads the primitive value of a column from the data map
+// returns false if the column does not exist or its value is not primitive
+func ReadColumn(data map[string]any, column Column) (OpPrimValue, bool) {
+	return readColumn(data, column)
+}
+
 // read a primitive value from the data map
 func readColumn(data map[string]any, key Column) (OpPrimValue, bool) {
-	// value to be compared with
-	var value any
+	value, found := lookup(data, key)
+	if !found {
+		return nil, false
+	}
+	opv := convertToOpPrimValue(value)
+	return opv, opv != nil
+}
+
+// lookup finds the value of a column in the data map
+// returns false if the column does not exist, or any field it's nested in is not a map
+func lookup(data map[string]any, key Column) (value any, found bool) {
+	value = data
 	for _, segment := range strings.Split(string(key), ".") {
-		// value already resolved, cannot accept more sub paths
-		if value != nil {
+		fields, ok := value.(map[string]any)
+		if !ok {
 			return nil, false
 		}
-		if next, exists := data[segment]; exists {
-			if m, ok := next.(map[string]any); ok {
-				data = m
-			} else {
-				value = next
-			}
-		} else {
-			return nil, false
+		value, found = fields[segment]
+		if !found {
+			return
 		}
 	}
-	var opv OpPrimValue
-	opv = convertToOpPrimValue(value)
-	if opv != nil {
-		return opv, true
-	} else {
-		return nil, false
-	}
+	return
 }
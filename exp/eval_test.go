@@ -2,6 +2,8 @@ package exp
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"math"
 	"testing"
 )
 
@@ -26,3 +28,156 @@ func TestEval(t *testing.T) {
 		C("key2").Gt(80),
 	}}))
 }
+
+func TestEvalNumberWidths(t *testing.T) {
+	// as decoded from msgpack, in the narrowest types holding the numbers
+	data := map[string]any{
+		"small":  int8(10),
+		"medium": uint16(300),
+		"large":  int64(1 << 40),
+		"ratio":  float32(0.5),
+	}
+	assert.True(t, Eval(data, C("small").Eq(int64(10))))
+	assert.True(t, Eval(data, C("medium").Eq(300)))
+	assert.True(t, Eval(data, C("medium").Lt(int64(1<<40))))
+	assert.True(t, Eval(data, C("large").Gt(300)))
+	assert.True(t, Eval(data, C("large").Gt(C("medium"))))
+	assert.True(t, Eval(data, C("ratio").Eq(0.5)))
+	assert.False(t, Eval(data, C("small").Eq(10.0)))
+
+	// unsigned integers too large for an int64 never match, rather than wrapping around to negative numbers
+	data = map[string]any{"huge": uint64(1 << 63), "max": uint64(math.MaxInt64)}
+	tuple, err := msgpack.Marshal(data)
+	assert.NoError(t, err)
+	for _, ex := range []Ex{C("huge").Gt(0), C("huge").Lt(0), C("huge").Neq(0), C("max").Lt(0)} {
+		assert.False(t, Eval(data, ex), "%v", ex)
+		matched, err := EvalTuple(tuple, ex)
+		assert.NoError(t, err)
+		assert.False(t, matched, "%v", ex)
+	}
+	assert.True(t, Eval(data, C("max").Eq(uint64(math.MaxInt64))))
+	assert.False(t, Eval(data, C("max").Neq(uint64(1<<63))))
+	matched, err := Compile(C("max").Neq(uint64(1 << 63)))(tuple)
+	assert.NoError(t, err)
+	assert.False(t, matched)
+}
+
+func TestEvalTuple(t *testing.T) {
+	data := map[string]any{
+		"key1":  "value",
+		"key2":  100,
+		"key3":  map[string]any{"key4": 10.25, "key5": []any{1, "a", nil}},
+		"small": int8(-10),
+		"large": uint64(1 << 40),
+		"ratio": float32(0.5),
+		"flag":  true,
+		"blob":  []byte("value"),
+	}
+	tuple, err := msgpack.Marshal(data)
+	assert.NoError(t, err)
+	for _, ex := range []Ex{
+		C("key1").Eq("value"),
+		C("key1").Gt("va"),
+		C("key1").Lt("w"),
+		C("key1").Eq(C("key1")),
+		C("key2").Gt(1),
+		C("key2").Eq(100.0),
+		C("key3.key4").Gt(5.12),
+		C("key3.key4").Lte(10.25),
+		C("key3.key5").Eq(1),
+		C("key3.missing").Eq(1),
+		C("key1.key4").Eq(1),
+		C("key3").Neq(1),
+		C("small").Lt(0),
+		C("large").Gt(C("key2")),
+		C("ratio").Eq(0.5),
+		C("flag").Eq(1),
+		C("blob").Eq("value"),
+		C("missing").Neq("value"),
+		OrEx{Exps: []Ex{C("key1").Eq("another-value"), C("key2").Lt(120)}},
+		AndEx{Exps: []Ex{C("key1").Eq("value"), C("key2").Gt(100)}},
+		OrEx{},
+		AndEx{},
+	} {
+		matched, err := EvalTuple(tuple, ex)
+		assert.NoError(t, err)
+		assert.Equal(t, Eval(data, ex), matched, "%v", ex)
+	}
+
+	// items that don't match are evaluated without allocating
+	ex := AndEx{Exps: []Ex{C("key3.key4").Gt(5.12), C("key1").Eq("another-value")}}
+	matched := true
+	allocs := testing.AllocsPerRun(100, func() {
+		matched, _ = EvalTuple(tuple, ex)
+	})
+	assert.False(t, matched)
+	assert.Equal(t, 0.0, allocs)
+
+	_, err = EvalTuple(tuple[:len(tuple)-3], C("missing").Eq(1))
+	assert.ErrorIs(t, err, ErrMalformedTuple)
+}
+
+func TestEvalNotInBetweenNull(t *testing.T) {
+	data := map[string]any{
+		"name":  "value",
+		"count": int8(10),
+		"ratio": 0.5,
+		"none":  nil,
+		"inner": map[string]any{"count": uint16(300), "none": nil, "list": []any{1}},
+	}
+	tuple, err := msgpack.Marshal(data)
+	assert.NoError(t, err)
+	for _, c := range []struct {
+		ex       Ex
+		expected bool
+	}{
+		{Not(C("name").Eq("value")), false},
+		{Not(C("missing").Eq("value")), true},
+		{Not(Not(C("count").Gt(5))), true},
+		{C("name").In("a", "value"), true},
+		{C("name").In("a", "b"), false},
+		{C("count").In(1, int64(10)), true},
+		{C("count").In(10.0), false},
+		{C("ratio").In(0.5, float32(1)), true},
+		{C("inner.count").In(300), true},
+		{C("name").In(), false},
+		{C("name").NotIn("a", "b"), true},
+		{C("name").NotIn("a", "value"), false},
+		{C("missing").NotIn("a"), false},
+		{C("inner.missing").NotIn(1), false},
+		{C("count").Between(10, 20), true},
+		{C("count").Between(11, 20), false},
+		{C("inner.count").Between(100, 300), true},
+		{C("name").Between("a", "z"), true},
+		{C("name").Exists(), true},
+		{C("inner").Exists(), true},
+		{C("inner.list").Exists(), true},
+		{C("none").Exists(), false},
+		{C("inner.none").Exists(), false},
+		{C("inner.missing").Exists(), false},
+		{C("name.missing").Exists(), false},
+		{C("none.missing").Exists(), false},
+		{C("name").IsNull(), false},
+		{C("none").IsNull(), true},
+		{C("missing").IsNull(), true},
+		{C("inner.none").IsNull(), true},
+		{C("inner.count").IsNull(), false},
+		{C("count.missing").IsNull(), true},
+		{Not(OrEx{Exps: []Ex{C("none").Exists()}}), true},
+		{AndEx{Exps: []Ex{Not(C("count").In(1, 2))}}, true},
+	} {
+		ex, expected := c.ex, c.expected
+		assert.Equal(t, expected, Eval(data, ex), "%v", ex)
+		matched, err := EvalTuple(tuple, ex)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, matched, "%v", ex)
+		matched, err = Compile(ex)(tuple)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, matched, "%v", ex)
+	}
+	for _, ex := range []Ex{C("name").In("a", true), Not(nil)} {
+		matched, err := Compile(ex)(tuple)
+		assert.NoError(t, err)
+		assert.Equal(t, Eval(data, ex), matched, "%v", ex)
+	}
+}
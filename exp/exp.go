@@ -13,6 +13,21 @@ type ComparisonEx struct {
 
 func (ex ComparisonEx) IsExpression() {}
 
+// Left returns the left operand of the comparison
+func (ex ComparisonEx) Left() OpValue {
+	return ex.left
+}
+
+// Op returns the comparison operator
+func (ex ComparisonEx) Op() OpCode {
+	return ex.op
+}
+
+// Right returns the right operand of the comparison
+func (ex ComparisonEx) Right() OpValue {
+	return ex.right
+}
+
 type OrEx struct {
 	Exps []Ex
 }
@@ -24,3 +39,27 @@ type AndEx struct {
 }
 
 func (ex AndEx) IsExpression() {}
+
+// NotEx matches items that the expression does not match
+type NotEx struct {
+	Exp Ex
+}
+
+func (ex NotEx) IsExpression() {}
+
+// Not negates an expression
+func Not(ex Ex) Ex {
+	return NotEx{Exp: ex}
+}
+
+// ExistsEx matches items with a value in a column that is not nil
+type ExistsEx struct {
+	column Column
+}
+
+func (ex ExistsEx) IsExpression() {}
+
+// Column returns the column tested
+func (ex ExistsEx) Column() Column {
+	return ex.column
+}
@@ -1,5 +1,7 @@
 package exp
 
+import "math"
+
 type OpCode string
 
 const (
@@ -9,6 +11,9 @@ const (
 	ExOpLte OpCode = "lte"
 	ExOpEq  OpCode = "eq"
 	ExOpNeq OpCode = "neq"
+	// the right operands of these are Values
+	ExOpIn    OpCode = "in"
+	ExOpNotIn OpCode = "nin"
 )
 
 type OpValue interface {
@@ -45,6 +50,11 @@ type String string
 func (v String) IsOpValue()     {}
 func (v String) IsOpPrimValue() {}
 
+// Values is a set of primitive values to find the value of a column in
+type Values []OpPrimValue
+
+func (v Values) IsOpValue() {}
+
 // Column represents a table column
 type Column string
 
@@ -78,6 +88,46 @@ func (c Column) Neq(other any) Ex {
 	return ComparisonEx{left: c, op: ExOpNeq, right: convertToOpValue(other)}
 }
 
+// In matches items with a value in the column equal to any of the values
+func (c Column) In(values ...any) Ex {
+	return ComparisonEx{left: c, op: ExOpIn, right: convertToValues(values)}
+}
+
+// NotIn matches items with a value in the column equal to none of the values
+// like Neq, items without a value in the column are not matched
+func (c Column) NotIn(values ...any) Ex {
+	return ComparisonEx{left: c, op: ExOpNotIn, right: convertToValues(values)}
+}
+
+// Between matches items with a value in the column between lo and hi, inclusively
+func (c Column) Between(lo any, hi any) Ex {
+	return AndEx{Exps: []Ex{c.Gte(lo), c.Lte(hi)}}
+}
+
+// Exists matches items with a value in the column that is not nil
+func (c Column) Exists() Ex {
+	return ExistsEx{column: c}
+}
+
+// IsNull matches items without a value in the column, or with a nil value,
+// including those missing any of the fields of a nested column
+func (c Column) IsNull() Ex {
+	return NotEx{Exp: ExistsEx{column: c}}
+}
+
+// convertToValues converts values into a set of primitive operands, nil if any of them is not primitive
+func convertToValues(values []any) OpValue {
+	set := make(Values, 0, len(values))
+	for _, value := range values {
+		prim := convertToOpPrimValue(value)
+		if prim == nil {
+			return nil
+		}
+		set = append(set, prim)
+	}
+	return set
+}
+
 func convertToOpValue(value any) OpValue {
 	prim := convertToOpPrimValue(value)
 	if prim != nil {
@@ -89,12 +139,15 @@ func convertToOpValue(value any) OpValue {
 	return nil
 }
 
+// convertToOpPrimValue converts a value into a primitive operand
+// integers are Int32 if they fit, since msgpack decodes integers into the narrowest types holding them.
+// Unsigned integers too large for an Int64 are not primitive, like other values that can't be compared
 func convertToOpPrimValue(value any) OpPrimValue {
 	switch v := value.(type) {
 	case string:
 		return String(v)
 	case int:
-		return Int32(v)
+		return integer(int64(v))
 	case int8:
 		return Int32(v)
 	case int16:
@@ -102,7 +155,17 @@ func convertToOpPrimValue(value any) OpPrimValue {
 	case int32:
 		return Int32(v)
 	case int64:
-		return Int64(v)
+		return integer(v)
+	case uint:
+		return unsigned(uint64(v))
+	case uint8:
+		return Int32(v)
+	case uint16:
+		return Int32(v)
+	case uint32:
+		return integer(int64(v))
+	case uint64:
+		return unsigned(v)
 	case float32:
 		return Float32(v)
 	case float64:
@@ -111,3 +174,18 @@ func convertToOpPrimValue(value any) OpPrimValue {
 		return nil
 	}
 }
+
+func integer(value int64) OpPrimValue {
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		return Int32(value)
+	}
+	return Int64(value)
+}
+
+// unsigned converts an unsigned integer into a primitive operand, nil if it's too large for an Int64
+func unsigned(value uint64) OpPrimValue {
+	if value > math.MaxInt64 {
+		return nil
+	}
+	return integer(int64(value))
+}
@@ -0,0 +1,434 @@
+package exp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"math"
+	"strings"
+)
+
+var (
+	// ErrMalformedTuple is returned when evaluating an item that is not encoded by msgpack properly
+	ErrMalformedTuple = errors.New("malformed tuple")
+)
+
+// EvalTuple evaluates whether an item encoded by msgpack matches query expressions like Eval does,
+// but reads the values of the columns compared straight from the encoded item without decoding it
+func EvalTuple(tuple []byte, exp Ex) (matched bool, err error) {
+	switch expression := exp.(type) {
+	case ComparisonEx:
+		return evalTupleField(tuple, expression.left, expression.op, expression.right)
+	case OrEx:
+		// true for empty exp
+		if len(expression.Exps) == 0 {
+			return true, nil
+		}
+		for _, ex := range expression.Exps {
+			matched, err = EvalTuple(tuple, ex)
+			if err != nil || matched {
+				return
+			}
+		}
+		return false, nil
+	case AndEx:
+		for _, ex := range expression.Exps {
+			matched, err = EvalTuple(tuple, ex)
+			if err != nil || !matched {
+				return
+			}
+		}
+		return true, nil
+	case NotEx:
+		matched, err = EvalTuple(tuple, expression.Exp)
+		return !matched && err == nil, err
+	case ExistsEx:
+		r, found, err := seekTupleColumn(tuple, expression.column)
+		if err != nil || !found {
+			return false, err
+		}
+		return r.notNil()
+	default:
+		return false, nil
+	}
+}
+
+func evalTupleField(tuple []byte, left OpValue, opCode OpCode, right OpValue) (matched bool, err error) {
+	lv, found, err := resolveTupleValue(tuple, left)
+	if err != nil || !found {
+		return
+	}
+	if values, ok := right.(Values); ok {
+		in := false
+		for _, v := range values {
+			if compareRaw(lv, ExOpEq, raw(v)) {
+				in = true
+				break
+			}
+		}
+		return (opCode == ExOpIn && in) || (opCode == ExOpNotIn && !in), nil
+	}
+	rv, found, err := resolveTupleValue(tuple, right)
+	if err != nil || !found {
+		return
+	}
+	return compareRaw(lv, opCode, rv), nil
+}
+
+// rawKind is the kind of a primitive value, numbers being of the widest types of their kinds
+type rawKind uint8
+
+const (
+	rawInvalid rawKind = iota
+	rawInt
+	rawFloat
+	rawString
+)
+
+// rawValue is a primitive value read from an encoded item or an operand, held without allocating
+type rawValue struct {
+	kind rawKind
+	i    int64
+	f    float64
+	// strings read from encoded items are kept as bytes, operands as strings
+	b       []byte
+	s       string
+	encoded bool
+}
+
+// raw converts a primitive operand into a raw value, invalid for nil
+func raw(value OpPrimValue) rawValue {
+	switch v := value.(type) {
+	case Int32:
+		return rawValue{kind: rawInt, i: int64(v)}
+	case Int64:
+		return rawValue{kind: rawInt, i: int64(v)}
+	case Float32:
+		return rawValue{kind: rawFloat, f: float64(v)}
+	case Float64:
+		return rawValue{kind: rawFloat, f: float64(v)}
+	case String:
+		return rawValue{kind: rawString, s: string(v)}
+	default:
+		return rawValue{}
+	}
+}
+
+func resolveTupleValue(tuple []byte, value OpValue) (v rawValue, found bool, err error) {
+	if column, ok := value.(Column); ok {
+		return readTupleColumn(tuple, column)
+	}
+	if prim, ok := value.(OpPrimValue); ok {
+		v = raw(prim)
+	}
+	return v, true, nil
+}
+
+// compareStrings compares raw strings without converting bytes into strings
+func compareStrings(left, right rawValue) int {
+	switch {
+	case left.encoded && right.encoded:
+		return bytes.Compare(left.b, right.b)
+	case left.encoded:
+		if string(left.b) == right.s {
+			return 0
+		} else if string(left.b) < right.s {
+			return -1
+		}
+		return 1
+	case right.encoded:
+		return -compareStrings(right, left)
+	default:
+		return strings.Compare(left.s, right.s)
+	}
+}
+
+// readTupleColumn reads the primitive value of a column from an encoded item like readColumn does
+func readTupleColumn(tuple []byte, column Column) (value rawValue, found bool, err error) {
+	r, found, err := seekTupleColumn(tuple, column)
+	if err != nil || !found {
+		return
+	}
+	return r.value()
+}
+
+// seekTupleColumn makes a reader of the value of a column of an encoded item, false if there's none
+func seekTupleColumn(tuple []byte, column Column) (r tupleReader, found bool, err error) {
+	r = tupleReader{data: tuple}
+	path := string(column)
+	for nested := true; nested; {
+		var segment string
+		segment, path, nested = strings.Cut(path, ".")
+		found, err = r.field(segment)
+		if err != nil || !found {
+			return
+		}
+	}
+	return
+}
+
+// readTuplePath reads the primitive value of a column split into the names of nested fields
+func readTuplePath(tuple []byte, path []string) (value rawValue, found bool, err error) {
+	r, found, err := seekTuplePath(tuple, path)
+	if err != nil || !found {
+		return
+	}
+	return r.value()
+}
+
+// seekTuplePath makes a reader of the value of a column split into the names of nested fields
+func seekTuplePath(tuple []byte, path []string) (r tupleReader, found bool, err error) {
+	r = tupleReader{data: tuple}
+	for _, segment := range path {
+		found, err = r.field(segment)
+		if err != nil || !found {
+			return
+		}
+	}
+	return
+}
+
+// tupleReader reads the values of an item encoded by msgpack
+type tupleReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *tupleReader) malformed() error {
+	return fmt.Errorf("%w: unexpected end at %d", ErrMalformedTuple, r.pos)
+}
+
+// next reads the next |n| bytes
+func (r *tupleReader) next(n uint64) (b []byte, err error) {
+	if n > uint64(len(r.data)-r.pos) {
+		err = r.malformed()
+		return
+	}
+	b = r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return
+}
+
+func (r *tupleReader) code() (code byte, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return
+	}
+	return b[0], nil
+}
+
+// uint reads an unsigned integer of |size| bytes
+func (r *tupleReader) uint(size int) (v uint64, err error) {
+	b, err := r.next(uint64(size))
+	if err != nil {
+		return
+	}
+	switch size {
+	case 1:
+		v = uint64(b[0])
+	case 2:
+		v = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		v = uint64(binary.BigEndian.Uint32(b))
+	default:
+		v = binary.BigEndian.Uint64(b)
+	}
+	return
+}
+
+// mapLen reads the header of a map, false if the next value is not a map
+func (r *tupleReader) mapLen() (n int, isMap bool, err error) {
+	code, err := r.code()
+	if err != nil {
+		return
+	}
+	var size uint64
+	switch {
+	case msgpcode.IsFixedMap(code):
+		size = uint64(code & msgpcode.FixedMapMask)
+	case code == msgpcode.Map16:
+		size, err = r.uint(2)
+	case code == msgpcode.Map32:
+		size, err = r.uint(4)
+	default:
+		return
+	}
+	return int(size), err == nil, err
+}
+
+// field moves to the value of a field of the next value, false if it's not a map or has no such field
+func (r *tupleReader) field(name string) (found bool, err error) {
+	n, isMap, err := r.mapLen()
+	if err != nil || !isMap {
+		return
+	}
+	return r.seek(n, name)
+}
+
+// seek moves to the value of a key among the |n| entries of a map
+// keys that are not strings are skipped
+func (r *tupleReader) seek(n int, key string) (found bool, err error) {
+	for i := 0; i < n; i++ {
+		var b []byte
+		var isString bool
+		b, isString, err = r.str()
+		if err != nil {
+			return
+		}
+		if isString && string(b) == key {
+			return true, nil
+		}
+		err = r.skip()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// str reads a string, or skips the next value if it's not a string
+func (r *tupleReader) str() (b []byte, isString bool, err error) {
+	code, err := r.code()
+	if err != nil {
+		return
+	}
+	var size uint64
+	switch {
+	case msgpcode.IsFixedString(code):
+		size = uint64(code & msgpcode.FixedStrMask)
+	case code == msgpcode.Str8:
+		size, err = r.uint(1)
+	case code == msgpcode.Str16:
+		size, err = r.uint(2)
+	case code == msgpcode.Str32:
+		size, err = r.uint(4)
+	default:
+		r.pos--
+		err = r.skip()
+		return
+	}
+	if err != nil {
+		return
+	}
+	b, err = r.next(size)
+	return b, err == nil, err
+}
+
+// notNil reads whether the next value is not nil
+func (r *tupleReader) notNil() (bool, error) {
+	code, err := r.code()
+	return err == nil && code != msgpcode.Nil, err
+}
+
+// value reads a primitive value, false if the next value is not primitive
+func (r *tupleReader) value() (v rawValue, found bool, err error) {
+	code, err := r.code()
+	if err != nil {
+		return
+	}
+	var u uint64
+	switch {
+	case msgpcode.IsFixedNum(code):
+		return rawValue{kind: rawInt, i: int64(int8(code))}, true, nil
+	case msgpcode.IsString(code):
+		r.pos--
+		v.kind, v.encoded = rawString, true
+		v.b, _, err = r.str()
+		return v, err == nil, err
+	case code == msgpcode.Uint8, code == msgpcode.Uint16, code == msgpcode.Uint32, code == msgpcode.Uint64:
+		u, err = r.uint(1 << (code - msgpcode.Uint8))
+		if u > math.MaxInt64 {
+			// too large to compare, like in convertToOpPrimValue
+			return v, false, err
+		}
+		v = rawValue{kind: rawInt, i: int64(u)}
+	case code == msgpcode.Int8:
+		u, err = r.uint(1)
+		v = rawValue{kind: rawInt, i: int64(int8(u))}
+	case code == msgpcode.Int16:
+		u, err = r.uint(2)
+		v = rawValue{kind: rawInt, i: int64(int16(u))}
+	case code == msgpcode.Int32:
+		u, err = r.uint(4)
+		v = rawValue{kind: rawInt, i: int64(int32(u))}
+	case code == msgpcode.Int64:
+		u, err = r.uint(8)
+		v = rawValue{kind: rawInt, i: int64(u)}
+	case code == msgpcode.Float:
+		u, err = r.uint(4)
+		v = rawValue{kind: rawFloat, f: float64(math.Float32frombits(uint32(u)))}
+	case code == msgpcode.Double:
+		u, err = r.uint(8)
+		v = rawValue{kind: rawFloat, f: math.Float64frombits(u)}
+	default:
+		return
+	}
+	return v, err == nil, err
+}
+
+// skip skips the next value
+func (r *tupleReader) skip() (err error) {
+	code, err := r.code()
+	if err != nil {
+		return
+	}
+	// number of bytes of the value, and of the values nested in it
+	var size, values uint64
+	switch {
+	case msgpcode.IsFixedNum(code), code == msgpcode.Nil, code == msgpcode.False, code == msgpcode.True:
+	case msgpcode.IsFixedMap(code):
+		values = 2 * uint64(code&msgpcode.FixedMapMask)
+	case msgpcode.IsFixedArray(code):
+		values = uint64(code & msgpcode.FixedArrayMask)
+	case msgpcode.IsFixedString(code):
+		size = uint64(code & msgpcode.FixedStrMask)
+	case code == msgpcode.Uint8, code == msgpcode.Int8:
+		size = 1
+	case code == msgpcode.Uint16, code == msgpcode.Int16:
+		size = 2
+	case code == msgpcode.Uint32, code == msgpcode.Int32, code == msgpcode.Float:
+		size = 4
+	case code == msgpcode.Uint64, code == msgpcode.Int64, code == msgpcode.Double:
+		size = 8
+	case code == msgpcode.Str8, code == msgpcode.Bin8:
+		size, err = r.uint(1)
+	case code == msgpcode.Str16, code == msgpcode.Bin16:
+		size, err = r.uint(2)
+	case code == msgpcode.Str32, code == msgpcode.Bin32:
+		size, err = r.uint(4)
+	case code == msgpcode.Array16:
+		values, err = r.uint(2)
+	case code == msgpcode.Array32:
+		values, err = r.uint(4)
+	case code == msgpcode.Map16:
+		values, err = r.uint(2)
+		values *= 2
+	case code == msgpcode.Map32:
+		values, err = r.uint(4)
+		values *= 2
+	case msgpcode.IsFixedExt(code):
+		// type and data
+		size = 1 + 1<<(code-msgpcode.FixExt1)
+	case code == msgpcode.Ext8:
+		size, err = r.uint(1)
+		size++
+	case code == msgpcode.Ext16:
+		size, err = r.uint(2)
+		size++
+	case code == msgpcode.Ext32:
+		size, err = r.uint(4)
+		size++
+	default:
+		return fmt.Errorf("%w: unexpected code %x at %d", ErrMalformedTuple, code, r.pos-1)
+	}
+	if err != nil {
+		return
+	}
+	_, err = r.next(size)
+	for ; err == nil && values > 0; values-- {
+		err = r.skip()
+	}
+	return
+}
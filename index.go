@@ -0,0 +1,334 @@
+package gled
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// suffix of index files, which are named as <table>.<column>.idx.gled
+	indexFileSuffix = ".idx.gled"
+)
+
+// type tags leading encoded index keys
+// keys of different types never interleave since their first bytes differ.
+// Numbers of the same kind are compared regardless of their widths, so they share the tag
+// of the widest type, leaving the tags of the narrower types unused
+const (
+	indexKeyInt32 byte = iota + 1
+	indexKeyInt64
+	indexKeyFloat32
+	indexKeyFloat64
+	indexKeyString
+)
+
+var (
+	columnNameRegex = regexp.MustCompile(`^[0-9a-zA-Z_]{1,64}(\.[0-9a-zA-Z_]{1,64})*$`)
+)
+
+// index is a secondary index on a table column, backed by a b+tree file
+type index struct {
+	column exp.Column
+	file   *os.File
+	tree   *storage.BTree
+}
+
+func indexPath(dir string, table string, column exp.Column) string {
+	return path.Join(dir, fmt.Sprintf("%s.%s%s", table, column, indexFileSuffix))
+}
+
+// find the columns indexed for a table from the index files in the db directory
+func findIndexedColumns(dir string, table string) (columns []exp.Column, err error) {
+	matches, err := filepath.Glob(path.Join(dir, fmt.Sprintf("%s.*%s", table, indexFileSuffix)))
+	if err != nil {
+		err = fmt.Errorf("failed to list index files: %w", err)
+		return
+	}
+	for _, match := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), table+"."), indexFileSuffix)
+		if !columnNameRegex.MatchString(name) {
+			continue
+		}
+		columns = append(columns, exp.C(name))
+	}
+	return
+}
+
+func openIndex(dir string, table string, column exp.Column) (idx *index, err error) {
+	indexPath := indexPath(dir, table, column)
+	file, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		err = fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+		return
+	}
+	tree, err := storage.OpenBTree(file)
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("failed to open index %s: %w", indexPath, err)
+		return
+	}
+	idx = &index{
+		column: column,
+		file:   file,
+		tree:   tree,
+	}
+	return
+}
+
+func (idx *index) close() (err error) {
+	err = idx.tree.Close()
+	if err != nil {
+		_ = idx.file.Close()
+		return
+	}
+	return idx.file.Close()
+}
+
+// key of an item for the index
+// returns false if the item has no primitive value for the indexed column
+func (idx *index) key(data map[string]any) ([]byte, bool) {
+	value, found := exp.ReadColumn(data, idx.column)
+	if !found {
+		return nil, false
+	}
+	return encodeIndexKey(value), true
+}
+
+// encodeIndexKey encodes a primitive value into an index key
+// byte-wise order of keys with the same type follows the order of the values
+func encodeIndexKey(value exp.OpPrimValue) []byte {
+	switch v := value.(type) {
+	case exp.Int32:
+		return encodeIndexKey(exp.Int64(v))
+	case exp.Int64:
+		key := make([]byte, 9)
+		key[0] = indexKeyInt64
+		binary.BigEndian.PutUint64(key[1:], uint64(v)^(1<<63))
+		return key
+	case exp.Float32:
+		return encodeIndexKey(exp.Float64(v))
+	case exp.Float64:
+		if v == 0 {
+			// -0 equals 0, so they share the key
+			v = 0
+		}
+		bits := math.Float64bits(float64(v))
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		key := make([]byte, 9)
+		key[0] = indexKeyFloat64
+		binary.BigEndian.PutUint64(key[1:], bits)
+		return key
+	case exp.String:
+		return append([]byte{indexKeyString}, v...)
+	default:
+		return nil
+	}
+}
+
+// indexKeyRange finds the range of index keys holding all values
+// that satisfy "column op value"
+// The range can be wider than needed, so items found should still be evaluated.
+func indexKeyRange(op exp.OpCode, value exp.OpPrimValue) (lo []byte, hi []byte, ok bool) {
+	key := encodeIndexKey(value)
+	if key == nil {
+		return nil, nil, false
+	}
+	// the keys of the same type lay between these two
+	typeLo := []byte{key[0]}
+	typeHi := []byte{key[0] + 1}
+	switch op {
+	case exp.ExOpEq:
+		return key, key, true
+	case exp.ExOpGt, exp.ExOpGte:
+		return key, typeHi, true
+	case exp.ExOpLt, exp.ExOpLte:
+		return typeLo, key, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// columnComparison rewrites a comparison between a column and a constant
+// as "column op constant"
+func columnComparison(ex exp.ComparisonEx) (column exp.Column, op exp.OpCode, value exp.OpPrimValue, ok bool) {
+	if c, isColumn := ex.Left().(exp.Column); isColumn {
+		if v, isPrim := ex.Right().(exp.OpPrimValue); isPrim {
+			return c, ex.Op(), v, true
+		}
+	}
+	if c, isColumn := ex.Right().(exp.Column); isColumn {
+		if v, isPrim := ex.Left().(exp.OpPrimValue); isPrim {
+			op = ex.Op()
+			switch op {
+			case exp.ExOpGt:
+				op = exp.ExOpLt
+			case exp.ExOpGte:
+				op = exp.ExOpLte
+			case exp.ExOpLt:
+				op = exp.ExOpGt
+			case exp.ExOpLte:
+				op = exp.ExOpGte
+			}
+			return c, op, v, true
+		}
+	}
+	return
+}
+
+// CreateIndex creates an index on a column, so that selects comparing the column
+// with a constant can find matching items without scanning the whole table
+func (t *GledTable[T]) CreateIndex(column string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !columnNameRegex.MatchString(column) {
+		err = fmt.Errorf("invalid column name: %s", column)
+		return
+	}
+	if t.indexOn(exp.C(column)) != nil {
+		err = fmt.Errorf("index on %s already exists", column)
+		return
+	}
+	return t.createIndex(column)
+}
+
+// create an index on a column, built from all tuples in the table
+// Must be called with t.mu held for writing
+func (t *baseTable) createIndex(column string) (err error) {
+	idx, err := openIndex(t.db.dir, t.name, exp.C(column))
+	if err != nil {
+		return
+	}
+	err = t.rebuildIndexes(idx)
+	if err != nil {
+		_ = idx.close()
+		_ = os.Remove(indexPath(t.db.dir, t.name, idx.column))
+		err = fmt.Errorf("failed to build index on %s: %w", column, err)
+		return
+	}
+	t.indexes = append(t.indexes, idx)
+	return
+}
+
+// indexOn finds the index on a column, nil if there's none
+func (t *baseTable) indexOn(column exp.Column) *index {
+	for _, idx := range t.indexes {
+		if idx.column == column {
+			return idx
+		}
+	}
+	return nil
+}
+
+// open all existing indexes of the table, rebuilding the ones left stale by a crash
+func (t *baseTable) openIndexes() (err error) {
+	columns, err := findIndexedColumns(t.db.dir, t.name)
+	if err != nil {
+		return
+	}
+	var stale []*index
+	for _, column := range columns {
+		var idx *index
+		idx, err = openIndex(t.db.dir, t.name, column)
+		if err != nil {
+			return
+		}
+		t.indexes = append(t.indexes, idx)
+		if !idx.tree.Clean() {
+			log.Warn().Msgf("rebuilding index %s of table %s which is not closed properly", column, t.name)
+			stale = append(stale, idx)
+		}
+	}
+	return t.rebuildIndexes(stale...)
+}
+
+// rebuild indexes from all tuples in the table,
+// including the deleted ones that are still visible to some snapshots
+func (t *baseTable) rebuildIndexes(indexes ...*index) (err error) {
+	if len(indexes) == 0 {
+		return
+	}
+	for _, idx := range indexes {
+		err = idx.tree.Clear()
+		if err != nil {
+			return
+		}
+	}
+	return t.table.ScanSnapshot(nil, func(tuple storage.Tuple, loc storage.TupleLocation) (cont bool, err error) {
+		tuple, err = t.upgrade(tuple)
+		if err != nil {
+			return
+		}
+		err = indexTuple(indexes, tuple, loc)
+		cont = err == nil
+		return
+	})
+}
+
+// add the keys of a tuple to indexes
+func indexTuple(indexes []*index, tuple storage.Tuple, loc storage.TupleLocation) (err error) {
+	if len(indexes) == 0 {
+		return
+	}
+	var unmarshalled map[string]any
+	err = msgpack.Unmarshal(tuple, &unmarshalled)
+	if err != nil {
+		return
+	}
+	for _, idx := range indexes {
+		key, ok := idx.key(unmarshalled)
+		if !ok {
+			continue
+		}
+		err = idx.tree.Insert(key, loc)
+		if err != nil {
+			err = fmt.Errorf("failed to update index on %s: %w", idx.column, err)
+			return
+		}
+	}
+	return
+}
+
+// planIndexScan finds an index that narrows down the tuples to evaluate an expression against
+// returns the index with the range of keys to scan
+func (t *baseTable) planIndexScan(ex exp.Ex) (idx *index, lo []byte, hi []byte, ok bool) {
+	switch expression := ex.(type) {
+	case exp.ComparisonEx:
+		column, op, value, isComparison := columnComparison(expression)
+		if !isComparison {
+			return
+		}
+		for _, candidate := range t.indexes {
+			if candidate.column != column {
+				continue
+			}
+			lo, hi, ok = indexKeyRange(op, value)
+			if ok {
+				idx = candidate
+			}
+			return
+		}
+	case exp.AndEx:
+		// all sub expressions must hold, so any of them can narrow down the tuples
+		for _, sub := range expression.Exps {
+			idx, lo, hi, ok = t.planIndexScan(sub)
+			if ok {
+				return
+			}
+		}
+	}
+	return
+}
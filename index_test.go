@@ -0,0 +1,198 @@
+package gled
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"sort"
+	"testing"
+)
+
+type indexedBook struct {
+	Name  string
+	Count int
+	Price float64
+}
+
+func TestIndexKeyOrder(t *testing.T) {
+	values := [][]exp.OpPrimValue{
+		{exp.Int32(-100), exp.Int32(-1), exp.Int32(0), exp.Int32(1), exp.Int32(100)},
+		{exp.Int64(-1 << 40), exp.Int64(-1), exp.Int64(0), exp.Int64(1 << 40)},
+		{exp.Float64(-1e10), exp.Float64(-0.5), exp.Float64(0), exp.Float64(0.25), exp.Float64(1e10)},
+		{exp.String(""), exp.String("a"), exp.String("ab"), exp.String("b")},
+	}
+	for _, sameType := range values {
+		for i := 1; i < len(sameType); i++ {
+			assert.Equal(t, -1, bytes.Compare(encodeIndexKey(sameType[i-1]), encodeIndexKey(sameType[i])),
+				"%v should be ordered before %v", sameType[i-1], sameType[i])
+		}
+	}
+	// numbers of different widths share the same keys
+	assert.Equal(t, encodeIndexKey(exp.Int64(100)), encodeIndexKey(exp.Int32(100)))
+	assert.Equal(t, -1, bytes.Compare(encodeIndexKey(exp.Int32(100)), encodeIndexKey(exp.Int64(1<<40))))
+	assert.Equal(t, encodeIndexKey(exp.Float64(0.25)), encodeIndexKey(exp.Float32(0.25)))
+	// so do zeros of both signs, which are equal
+	assert.Equal(t, encodeIndexKey(exp.Float64(0)), encodeIndexKey(exp.Float64(math.Copysign(0, -1))))
+}
+
+func TestIndexSelect(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir)
+	defer db.Close()
+	table, err := Table[indexedBook](db, "books")
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, table.Insert(indexedBook{
+			Name:  fmt.Sprintf("book-%04d", i),
+			Count: i%200 - 100,
+			Price: float64(i) / 4,
+		}))
+	}
+	assert.NoError(t, table.CreateIndex("Count"))
+	assert.NoError(t, table.CreateIndex("Name"))
+	assert.Error(t, table.CreateIndex("Name"))
+	_, err = os.Stat(indexPath(dir, "books", "Count"))
+	assert.NoError(t, err)
+
+	names := func(books []indexedBook) []string {
+		result := []string{}
+		for _, book := range books {
+			result = append(result, book.Name)
+		}
+		sort.Strings(result)
+		return result
+	}
+	expressions := []exp.Ex{
+		exp.C("Count").Eq(5),
+		exp.C("Count").Lt(-95),
+		exp.C("Name").Gte("book-0990"),
+		exp.AndEx{Exps: []exp.Ex{
+			exp.C("Price").Lt(100.0),
+			exp.C("Count").Gt(95),
+		}},
+		exp.C("Count").Between(-3, 3),
+	}
+	for _, ex := range expressions {
+		idx, _, _, ok := table.planIndexScan(ex)
+		assert.True(t, ok)
+		assert.NotNil(t, idx)
+		indexed, _, err := table.Select(ex)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, indexed)
+
+		// compare with a full scan
+		scanned, _, err := table.Select(exp.OrEx{Exps: []exp.Ex{ex}})
+		assert.NoError(t, err)
+		assert.Equal(t, names(scanned), names(indexed))
+	}
+
+	selected, _, err := table.Select(exp.AndEx{Exps: []exp.Ex{
+		exp.C("Count").In(5, 6),
+		exp.Not(exp.C("Name").NotIn("book-0105", "book-0306", "book-0307")),
+		exp.C("Missing").IsNull(),
+		exp.C("Price").Exists(),
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"book-0105", "book-0306"}, names(selected))
+
+	// deleted items are gone from the index
+	_, locations, err := table.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(locations))
+	assert.NoError(t, table.Delete(locations[0]))
+	books, _, err := table.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(books))
+
+	// indexes are found and still valid after reopening and vacuuming
+	assert.NoError(t, table.Close())
+	table, err = Table[indexedBook](db, "books")
+	assert.NoError(t, err)
+	defer table.Close()
+	assert.Equal(t, 2, len(table.indexes))
+	assert.NoError(t, table.VacuumFull())
+	books, _, err = table.Select(exp.C("Name").Eq("book-0995"))
+	assert.NoError(t, err)
+	assert.Equal(t, []indexedBook{{Name: "book-0995", Count: 95, Price: 248.75}}, books)
+	books, _, err = table.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(books))
+}
+
+func TestIndexedUpdate(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	table, err := Table[indexedBook](db, "books")
+	assert.NoError(t, err)
+	defer table.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, table.Insert(indexedBook{Name: fmt.Sprintf("book-%d", i), Count: i}))
+	}
+	assert.NoError(t, table.CreateIndex("Count"))
+	_, locations, err := table.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(locations))
+
+	// a transaction begun before the update still sees the old values
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	count, err := table.UpdateWhere(exp.C("Count").Gte(5), func(book *indexedBook) {
+		book.Count += 10
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	view, err := TxTable(tx, table)
+	assert.NoError(t, err)
+	old, _, err := view.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Equal(t, []indexedBook{{Name: "book-5", Count: 5}}, old)
+	assert.NoError(t, tx.Rollback())
+
+	// the updated items keep their locations and are found by their new keys only
+	books, updated, err := table.Select(exp.C("Count").Gte(5))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(books))
+	for _, book := range books {
+		assert.GreaterOrEqual(t, book.Count, 15)
+	}
+	books, _, err = table.Select(exp.C("Count").Eq(5))
+	assert.NoError(t, err)
+	assert.Empty(t, books)
+	book, err := table.Get(locations[0])
+	assert.NoError(t, err)
+	assert.Equal(t, indexedBook{Name: "book-5", Count: 15}, book)
+	assert.Contains(t, updated, locations[0])
+
+	// and updated again in place of them after vacuuming
+	assert.NoError(t, table.Vacuum())
+	assert.NoError(t, table.Update(locations[0], indexedBook{Name: "book-5", Count: 100}))
+	books, updated, err = table.Select(exp.C("Count").Gt(50))
+	assert.NoError(t, err)
+	assert.Equal(t, []indexedBook{{Name: "book-5", Count: 100}}, books)
+	assert.Equal(t, locations, updated)
+}
+
+func TestIndexNegativeZero(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	table, err := Table[indexedBook](db, "books")
+	assert.NoError(t, err)
+	defer table.Close()
+	assert.NoError(t, table.CreateIndex("Price"))
+	for _, price := range []float64{math.Copysign(0, -1), 0, 1} {
+		assert.NoError(t, table.Insert(indexedBook{Price: price}))
+	}
+	// found through the index like by scanning
+	for _, ex := range []exp.Ex{exp.C("Price").Eq(0.0), exp.C("Price").Eq(math.Copysign(0, -1)), exp.C("Price").Lte(0.0)} {
+		items, _, err := table.Select(ex)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(items), "%v", ex)
+	}
+	items, _, err := table.Select(exp.C("Price").Lt(0.0))
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
@@ -0,0 +1,448 @@
+package gled
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	// prefixes of the columns of the left and right items in join expressions
+	leftPrefix  = "left."
+	rightPrefix = "right."
+	// number of partitions the items of a hash join are split into when they exceed the memory budget
+	joinPartitions = 16
+)
+
+// Pair is an item of the left table of a join paired with an item of the right table
+type Pair[L any, R any] struct {
+	Left          L
+	Right         R
+	LeftLocation  storage.TupleLocation
+	RightLocation storage.TupleLocation
+}
+
+// Join pairs the items of two tables whose columns are equal, e.g.
+//
+//	gled.Join(orders, customers, exp.C("CustomerID"), exp.C("ID"))
+//
+// It's JoinOn with the equality of the columns
+func Join[L any, R any](left *GledTable[L], right *GledTable[R], leftColumn exp.Column, rightColumn exp.Column) (pairs []Pair[L, R], err error) {
+	return JoinOn(left, right, exp.C(leftPrefix+string(leftColumn)).Eq(exp.C(rightPrefix+string(rightColumn))))
+}
+
+// JoinOn pairs the items of two tables satisfying an expression,
+// in which the columns of the left items are prefixed by "left." and the right ones by "right.", e.g.
+//
+//	exp.AndEx{Exps: []exp.Ex{
+//		exp.C("left.CustomerID").Eq(exp.C("right.ID")),
+//		exp.C("left.Total").Gt(100),
+//	}}
+//
+// If the expression is or includes the equality of a left column and a right column, the tables are joined by hashing
+// the items of the smaller one by their columns, partitioned into temporary files if they don't fit in memory.
+// Otherwise, the tables are joined by nested loops, scanning the right table once for each block of left items.
+// Items are as of when the join starts. Both tables must belong to the same db
+func JoinOn[L any, R any](left *GledTable[L], right *GledTable[R], on exp.Ex) (pairs []Pair[L, R], err error) {
+	if left.db != right.db {
+		err = fmt.Errorf("tables %s and %s belong to different dbs", left.name, right.name)
+		return
+	}
+	_, txm, err := left.db.open()
+	if err != nil {
+		return
+	}
+	s := txm.Snapshot()
+	defer txm.Release(s)
+	j := newJoiner(left.baseTable, right.baseTable, s, on)
+	j.emit = func(l cursorRow, r cursorRow) (err error) {
+		pair := Pair[L, R]{LeftLocation: l.loc, RightLocation: r.loc}
+		err = msgpack.Unmarshal(l.tuple, &pair.Left)
+		if err == nil {
+			err = msgpack.Unmarshal(r.tuple, &pair.Right)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal joined item: %w", err)
+			return
+		}
+		pairs = append(pairs, pair)
+		return
+	}
+	if j.leftKey != "" {
+		err = j.hashJoin()
+	} else {
+		err = j.nestedLoop()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to join tables %s and %s: %w", left.name, right.name, err)
+		return nil, err
+	}
+	return
+}
+
+// joiner joins the items of two tables as of a snapshot
+type joiner struct {
+	left  *baseTable
+	right *baseTable
+	s     *storage.Snapshot
+	on    exp.Ex
+	// columns of the equality the items are hashed by, empty if joined by nested loops
+	leftKey  exp.Column
+	rightKey exp.Column
+	// whether |on| has conditions other than the equality of the keys
+	residual bool
+	// bytes of items held in memory
+	budget int64
+	emit   func(l cursorRow, r cursorRow) error
+}
+
+func newJoiner(left *baseTable, right *baseTable, s *storage.Snapshot, on exp.Ex) *joiner {
+	j := &joiner{left: left, right: right, s: s, on: on, budget: left.db.sortMemory, residual: true}
+	if j.budget <= 0 {
+		j.budget = defaultSortMemory
+	}
+	switch ex := on.(type) {
+	case exp.ComparisonEx:
+		j.leftKey, j.rightKey = splitJoinKeys(ex)
+		j.residual = j.leftKey == ""
+	case exp.AndEx:
+		for _, sub := range ex.Exps {
+			if c, ok := sub.(exp.ComparisonEx); ok {
+				if j.leftKey, j.rightKey = splitJoinKeys(c); j.leftKey != "" {
+					break
+				}
+			}
+		}
+	}
+	return j
+}
+
+// splitJoinKeys finds the columns of the left and right items compared for equality
+// returns empty columns if the expression is not such an equality
+func splitJoinKeys(ex exp.ComparisonEx) (leftKey exp.Column, rightKey exp.Column) {
+	a, aIsColumn := ex.Left().(exp.Column)
+	b, bIsColumn := ex.Right().(exp.Column)
+	if ex.Op() != exp.ExOpEq || !aIsColumn || !bIsColumn {
+		return
+	}
+	if strings.HasPrefix(string(b), leftPrefix) {
+		a, b = b, a
+	}
+	if !strings.HasPrefix(string(a), leftPrefix) || !strings.HasPrefix(string(b), rightPrefix) {
+		return
+	}
+	return exp.C(strings.TrimPrefix(string(a), leftPrefix)), exp.C(strings.TrimPrefix(string(b), rightPrefix))
+}
+
+// match emits a pair of items if they satisfy the expression
+func (j *joiner) match(l cursorRow, r cursorRow) (err error) {
+	if j.residual {
+		var leftItem, rightItem map[string]any
+		leftItem, err = l.decoded()
+		if err != nil {
+			return
+		}
+		rightItem, err = r.decoded()
+		if err != nil {
+			return
+		}
+		if !exp.Eval(map[string]any{"left": leftItem, "right": rightItem}, j.on) {
+			return
+		}
+	}
+	return j.emit(l, r)
+}
+
+// scan iterates over the items of a table
+func (j *joiner) scan(t *baseTable, iter func(row cursorRow) error) (err error) {
+	c := t.newCursor(j.s, nil, exp.AndEx{}, nil)
+	defer c.close()
+	for {
+		var row cursorRow
+		var ok bool
+		row, ok, err = c.next()
+		if err != nil || !ok {
+			return
+		}
+		err = iter(row)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hashSide is one side of a hash join
+type hashSide struct {
+	table *baseTable
+	key   exp.Column
+	left  bool
+}
+
+// hashKey of an item by a column, false if the item has no value to be equal to others
+func hashKey(row *cursorRow, column exp.Column) (key string, ok bool, err error) {
+	item, err := row.decoded()
+	if err != nil {
+		return
+	}
+	value, found := exp.ReadColumn(item, column)
+	if !found {
+		return
+	}
+	// NaN is equal to nothing, not even itself
+	switch v := value.(type) {
+	case exp.Float32:
+		if math.IsNaN(float64(v)) {
+			return
+		}
+	case exp.Float64:
+		if math.IsNaN(float64(v)) {
+			return
+		}
+	}
+	encoded := encodeIndexKey(value)
+	return string(encoded), encoded != nil, nil
+}
+
+// hashJoin hashes the items of the smaller table by their keys, and then looks up the keys of the items of the other
+func (j *joiner) hashJoin() (err error) {
+	build := hashSide{table: j.left, key: j.leftKey, left: true}
+	probe := hashSide{table: j.right, key: j.rightKey}
+	leftPages, err := j.left.table.PageCount()
+	if err != nil {
+		return
+	}
+	rightPages, err := j.right.table.PageCount()
+	if err != nil {
+		return
+	}
+	if rightPages < leftPages {
+		build, probe = probe, build
+	}
+
+	hashed := map[string][]cursorRow{}
+	var size int64
+	var partitions *joinPartitioner
+	defer func() {
+		if partitions != nil {
+			partitions.close()
+		}
+	}()
+	err = j.scan(build.table, func(row cursorRow) (err error) {
+		key, ok, err := hashKey(&row, build.key)
+		if err != nil || !ok {
+			return
+		}
+		if partitions != nil {
+			return partitions.write(partitions.build, key, row)
+		}
+		// decoded again if needed, so that the memory of the items is only their bytes
+		row.item = nil
+		hashed[key] = append(hashed[key], row)
+		size += int64(len(row.tuple)+len(key)) + sortRowOverhead
+		if size < j.budget {
+			return
+		}
+		partitions, err = newJoinPartitioner(j.left.db.dir)
+		if err != nil {
+			return
+		}
+		for key, rows := range hashed {
+			for _, row := range rows {
+				err = partitions.write(partitions.build, key, row)
+				if err != nil {
+					return
+				}
+			}
+		}
+		hashed = nil
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	probeRow := func(hashed map[string][]cursorRow, key string, row cursorRow) (err error) {
+		for _, built := range hashed[key] {
+			if build.left {
+				err = j.match(built, row)
+			} else {
+				err = j.match(row, built)
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	if partitions == nil {
+		return j.scan(probe.table, func(row cursorRow) (err error) {
+			key, ok, err := hashKey(&row, probe.key)
+			if err != nil || !ok {
+				return
+			}
+			return probeRow(hashed, key, row)
+		})
+	}
+	err = j.scan(probe.table, func(row cursorRow) (err error) {
+		key, ok, err := hashKey(&row, probe.key)
+		if err != nil || !ok {
+			return
+		}
+		return partitions.write(partitions.probe, key, row)
+	})
+	if err != nil {
+		return
+	}
+	// items of equal keys are in the partitions of the same number, which are joined one pair at a time.
+	// A build partition too large for the budget, as of a frequent key, is hashed a block at a time,
+	// and the probe partition is read again for each block
+	for i := 0; i < joinPartitions; i++ {
+		hashed, size = map[string][]cursorRow{}, 0
+		probeBlock := func() error {
+			return partitions.read(partitions.probe[i], probe.key, func(key string, row cursorRow) error {
+				return probeRow(hashed, key, row)
+			})
+		}
+		err = partitions.read(partitions.build[i], build.key, func(key string, row cursorRow) (err error) {
+			row.item = nil
+			hashed[key] = append(hashed[key], row)
+			size += int64(len(row.tuple)+len(key)) + sortRowOverhead
+			if size < j.budget {
+				return
+			}
+			err = probeBlock()
+			hashed, size = map[string][]cursorRow{}, 0
+			return
+		})
+		if err == nil && len(hashed) > 0 {
+			err = probeBlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// joinPartitioner splits the items of both sides of a hash join into temporary files by their keys
+type joinPartitioner struct {
+	build []*partitionFile
+	probe []*partitionFile
+}
+
+type partitionFile struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newJoinPartitioner(dir string) (p *joinPartitioner, err error) {
+	p = &joinPartitioner{}
+	for i := 0; i < joinPartitions; i++ {
+		for _, side := range []*[]*partitionFile{&p.build, &p.probe} {
+			var file *os.File
+			file, err = os.CreateTemp(dir, "join-*.tmp")
+			if err != nil {
+				p.close()
+				err = fmt.Errorf("failed to create join file: %w", err)
+				return nil, err
+			}
+			*side = append(*side, &partitionFile{file: file, w: bufio.NewWriter(file)})
+		}
+	}
+	return
+}
+
+// write an item into the partition of its key
+func (p *joinPartitioner) write(side []*partitionFile, key string, row cursorRow) (err error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return writeSpilled(side[h.Sum32()%joinPartitions].w, row.tuple, row.loc)
+}
+
+// read the items of a partition along with their keys by a column
+func (p *joinPartitioner) read(partition *partitionFile, column exp.Column, iter func(key string, row cursorRow) error) (err error) {
+	err = partition.w.Flush()
+	if err != nil {
+		err = fmt.Errorf("failed to write join file: %w", err)
+		return
+	}
+	_, err = partition.file.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to read join file: %w", err)
+		return
+	}
+	r := bufio.NewReader(partition.file)
+	for {
+		var row cursorRow
+		var ok bool
+		row.tuple, row.loc, ok, err = readSpilled(r)
+		if err != nil || !ok {
+			return
+		}
+		var key string
+		key, _, err = hashKey(&row, column)
+		if err != nil {
+			return
+		}
+		err = iter(key, row)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close removes the temporary files of the partitions
+func (p *joinPartitioner) close() {
+	for _, partition := range append(p.build, p.probe...) {
+		_ = partition.file.Close()
+		err := os.Remove(partition.file.Name())
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to remove join file %s", partition.file.Name())
+		}
+	}
+	p.build = nil
+	p.probe = nil
+}
+
+// nestedLoop pairs each block of left items fitting in memory with all right items
+func (j *joiner) nestedLoop() (err error) {
+	var block []cursorRow
+	var size int64
+	flush := func() (err error) {
+		if len(block) == 0 {
+			return
+		}
+		err = j.scan(j.right, func(r cursorRow) (err error) {
+			for _, l := range block {
+				err = j.match(l, r)
+				if err != nil {
+					return
+				}
+			}
+			return
+		})
+		block = nil
+		size = 0
+		return
+	}
+	err = j.scan(j.left, func(row cursorRow) (err error) {
+		block = append(block, row)
+		// the decoded item takes roughly as much memory again
+		size += 2*int64(len(row.tuple)) + sortRowOverhead
+		if size >= j.budget {
+			err = flush()
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	return flush()
+}
@@ -0,0 +1,139 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"sort"
+	"testing"
+)
+
+type customer struct {
+	ID   int
+	Name string
+}
+
+type order struct {
+	CustomerID int
+	Total      int
+}
+
+// names of the customers of the orders paired, with the totals, sorted
+func orderNames(pairs []Pair[order, customer]) (names []string) {
+	for _, pair := range pairs {
+		names = append(names, fmt.Sprintf("%s:%d", pair.Right.Name, pair.Left.Total))
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestJoin(t *testing.T) {
+	for _, memory := range []int64{0, 1} {
+		dir := t.TempDir()
+		// the items of every hash join are partitioned into files with the smaller budget
+		db := NewGleDB(dir, WithSortMemory(memory))
+		customers, err := Table[customer](db, "customers")
+		assert.NoError(t, err)
+		orders, err := Table[order](db, "orders")
+		assert.NoError(t, err)
+		for i, name := range []string{"a", "b", "c"} {
+			assert.NoError(t, customers.Insert(customer{ID: i + 1, Name: name}))
+		}
+		for _, o := range []order{{1, 10}, {2, 20}, {1, 30}, {4, 40}, {2, 50}} {
+			assert.NoError(t, orders.Insert(o))
+		}
+
+		pairs, err := Join(orders, customers, exp.C("CustomerID"), exp.C("ID"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a:10", "a:30", "b:20", "b:50"}, orderNames(pairs))
+		for _, pair := range pairs {
+			item, err := customers.Get(pair.RightLocation)
+			assert.NoError(t, err)
+			assert.Equal(t, pair.Right, item)
+		}
+
+		// other conditions are checked on the pairs with equal keys
+		pairs, err = JoinOn(orders, customers, exp.AndEx{Exps: []exp.Ex{
+			exp.C("left.Total").Gt(15),
+			exp.C("right.ID").Eq(exp.C("left.CustomerID")),
+		}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a:30", "b:20", "b:50"}, orderNames(pairs))
+
+		// and nested loops take any other expression
+		pairs, err = JoinOn(orders, customers, exp.C("left.CustomerID").Gt(exp.C("right.ID")))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a:20", "a:40", "a:50", "b:40", "c:40"}, orderNames(pairs))
+
+		assert.NoError(t, customers.Close())
+		assert.NoError(t, orders.Close())
+		assert.NoError(t, db.Close())
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		for _, entry := range entries {
+			assert.NotContains(t, entry.Name(), ".tmp")
+		}
+	}
+
+	// the orders of a frequent customer fill a partition beyond the budget, which is joined a block at a time
+	db := NewGleDB(t.TempDir(), WithSortMemory(4096))
+	customers, err := Table[customer](db, "customers")
+	assert.NoError(t, err)
+	orders, err := Table[order](db, "orders")
+	assert.NoError(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.NoError(t, customers.Insert(customer{ID: i + 1, Name: fmt.Sprintf("customer-%04d", i+1)}))
+	}
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, orders.Insert(order{CustomerID: 1, Total: i}))
+	}
+	pairs, err := Join(orders, customers, exp.C("CustomerID"), exp.C("ID"))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, len(pairs))
+	totals := map[int]bool{}
+	for _, pair := range pairs {
+		assert.Equal(t, pair.Left.CustomerID, pair.Right.ID)
+		totals[pair.Left.Total] = true
+	}
+	assert.Equal(t, 300, len(totals))
+	assert.NoError(t, customers.Close())
+	assert.NoError(t, orders.Close())
+	assert.NoError(t, db.Close())
+
+	db = NewGleDB(t.TempDir())
+	defer db.Close()
+	other := NewGleDB(t.TempDir())
+	defer other.Close()
+	customers, err = Table[customer](db, "customers")
+	assert.NoError(t, err)
+	defer customers.Close()
+	orders, err = Table[order](other, "orders")
+	assert.NoError(t, err)
+	defer orders.Close()
+	_, err = Join(orders, customers, exp.C("CustomerID"), exp.C("ID"))
+	assert.Error(t, err)
+}
+
+func TestJoinFloatKeys(t *testing.T) {
+	for _, memory := range []int64{0, 1} {
+		db := NewGleDB(t.TempDir(), WithSortMemory(memory))
+		left, err := Table[map[string]any](db, "left")
+		assert.NoError(t, err)
+		right, err := Table[map[string]any](db, "right")
+		assert.NoError(t, err)
+		for _, key := range []float64{math.Copysign(0, -1), math.NaN()} {
+			assert.NoError(t, left.Insert(map[string]any{"K": key}))
+			assert.NoError(t, right.Insert(map[string]any{"K": -key}))
+		}
+
+		// keys are equal as compared by expressions, with zeros of both signs equal and NaN equal to nothing
+		pairs, err := Join(left, right, exp.C("K"), exp.C("K"))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(pairs))
+		assert.True(t, math.Signbit(pairs[0].Left["K"].(float64)))
+		assert.False(t, math.Signbit(pairs[0].Right["K"].(float64)))
+		assert.NoError(t, db.Close())
+	}
+}
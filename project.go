@@ -0,0 +1,203 @@
+package gled
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"strings"
+)
+
+// projection decodes the values of some columns of encoded items, skipping the other fields without decoding them
+// a projection is not safe for concurrent use
+type projection struct {
+	root *projectionNode
+	d    *msgpack.Decoder
+	r    *bytes.Reader
+}
+
+// projectionNode is a field of the items to decode
+type projectionNode struct {
+	// column of the field if it's projected, empty if only its nested fields are
+	column string
+	// nested fields to decode, by name
+	fields map[string]*projectionNode
+}
+
+func newProjection(columns []string) (p *projection, err error) {
+	p = &projection{root: &projectionNode{}, r: bytes.NewReader(nil)}
+	p.d = msgpack.NewDecoder(p.r)
+	for _, column := range columns {
+		if !columnNameRegex.MatchString(column) {
+			err = fmt.Errorf("invalid column name: %s", column)
+			return
+		}
+		node := p.root
+		for _, name := range strings.Split(column, ".") {
+			if node.fields == nil {
+				node.fields = map[string]*projectionNode{}
+			}
+			if node.fields[name] == nil {
+				node.fields[name] = &projectionNode{}
+			}
+			node = node.fields[name]
+		}
+		node.column = column
+	}
+	return
+}
+
+// decode the projected columns of an encoded item, keyed by the columns
+// columns the item has no value for are left out
+func (p *projection) decode(tuple storage.Tuple) (row map[string]any, err error) {
+	p.r.Reset(tuple)
+	p.d.Reset(p.r)
+	row = map[string]any{}
+	err = p.decodeMap(p.root, row)
+	if err != nil {
+		err = fmt.Errorf("failed to decode columns: %w", err)
+		return
+	}
+	return
+}
+
+// decodeMap decodes the fields of a map projected by a node
+func (p *projection) decodeMap(node *projectionNode, row map[string]any) (err error) {
+	n, err := p.d.DecodeMapLen()
+	if err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		var name string
+		name, err = p.d.DecodeString()
+		if err != nil {
+			return
+		}
+		field := node.fields[name]
+		switch {
+		case field == nil:
+			err = p.d.Skip()
+		case field.column != "":
+			var value any
+			value, err = p.d.DecodeInterface()
+			if err == nil {
+				row[field.column] = value
+				field.project(value, row)
+			}
+		default:
+			var code byte
+			code, err = p.d.PeekCode()
+			if err != nil {
+				return
+			}
+			if msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32 {
+				err = p.decodeMap(field, row)
+			} else {
+				err = p.d.Skip()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// project the columns nested in the decoded value of a projected field
+func (node *projectionNode) project(value any, row map[string]any) {
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+	for name, field := range node.fields {
+		nested, found := fields[name]
+		if !found {
+			continue
+		}
+		if field.column != "" {
+			row[field.column] = nested
+		}
+		field.project(nested, row)
+	}
+}
+
+// SelectColumns selects some columns of the items matching an expression, keyed by the columns.
+// Only the fields of the columns are decoded, with dots separating the names of nested fields.
+// Columns the items have no values for are left out
+func (t *GledTable[T]) SelectColumns(ex exp.Ex, columns ...string) (rows []map[string]any, locations []storage.TupleLocation, err error) {
+	return t.SelectColumnsWith(ex, columns)
+}
+
+// SelectColumnsWith selects some columns of the items matching an expression like SelectColumns,
+// taking the same options as Select
+func (t *GledTable[T]) SelectColumnsWith(ex exp.Ex, columns []string, opts ...SelectOption) (rows []map[string]any, locations []storage.TupleLocation, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	s := txm.Snapshot()
+	defer txm.Release(s)
+	return t.selectColumns(s, ex, columns, opts)
+}
+
+// SelectColumns selects some columns of the items matching an expression as of when the transaction began
+func (v *GledTxTable[T]) SelectColumns(ex exp.Ex, columns ...string) (rows []map[string]any, locations []storage.TupleLocation, err error) {
+	return v.SelectColumnsWith(ex, columns)
+}
+
+// SelectColumnsWith selects some columns of the items matching an expression as of when the transaction began,
+// taking the same options as Select
+func (v *GledTxTable[T]) SelectColumnsWith(ex exp.Ex, columns []string, opts ...SelectOption) (rows []map[string]any, locations []storage.TupleLocation, err error) {
+	tx := v.tx
+	tx.mu.Lock()
+	done := tx.done
+	tx.mu.Unlock()
+	if done {
+		err = ErrTxDone
+		return
+	}
+	return v.table.selectColumns(tx.stx.Snapshot(), ex, columns, opts)
+}
+
+// select some columns of the items visible in a snapshot
+func (t *baseTable) selectColumns(s *storage.Snapshot, ex exp.Ex, columns []string, opts []SelectOption) (rows []map[string]any, locations []storage.TupleLocation, err error) {
+	p, err := newProjection(columns)
+	if err != nil {
+		return
+	}
+	c := t.newCursor(s, nil, ex, opts)
+	defer c.close()
+	for {
+		var row cursorRow
+		var ok bool
+		row, ok, err = c.next()
+		if err != nil || !ok {
+			return
+		}
+		var projected map[string]any
+		projected, err = p.decode(row.tuple)
+		if err != nil {
+			return
+		}
+		rows = append(rows, projected)
+		locations = append(locations, row.loc)
+	}
+}
+
+// SelectAs selects the items matching an expression from a table of items of type T, decoded as type U.
+// Fields of the items that U has no fields for are skipped without being decoded,
+// so U can be a struct of a few of the fields of T, e.g.
+//
+//	names, _, err := gled.SelectAs[Book, struct{ Name string }](books, ex)
+//
+// SelectAs takes the same options as Select
+func SelectAs[T any, U any](t *GledTable[T], ex exp.Ex, opts ...SelectOption) (items []U, locations []storage.TupleLocation, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	s := txm.Snapshot()
+	return collect(&Cursor[U]{c: t.newCursor(s, func() { txm.Release(s) }, ex, opts)})
+}
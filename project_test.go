@@ -0,0 +1,80 @@
+package gled
+
+import (
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type publisher struct {
+	Name string
+	City string
+}
+
+type wideBook struct {
+	Name      string
+	Count     int
+	Tags      []string
+	Publisher publisher
+}
+
+func TestSelectColumns(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[wideBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	assert.NoError(t, books.Insert(wideBook{Name: "a", Count: 1, Tags: []string{"x"}, Publisher: publisher{"p", "c"}}))
+	assert.NoError(t, books.Insert(wideBook{Name: "b", Count: 2, Publisher: publisher{"q", "d"}}))
+
+	rows, locations, err := books.SelectColumns(exp.C("Count").Gt(1), "Name", "Publisher.City")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "b", "Publisher.City": "d"}}, rows)
+	item, err := books.Get(locations[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "b", item.Name)
+
+	// nested columns are also taken from the values of projected fields
+	rows, _, err = books.SelectColumns(exp.C("Name").Eq("a"), "Publisher", "Publisher.Name", "Missing")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{
+		"Publisher":      map[string]any{"Name": "p", "City": "c"},
+		"Publisher.Name": "p",
+	}}, rows)
+	_, _, err = books.SelectColumns(exp.AndEx{}, "bad column")
+	assert.Error(t, err)
+
+	// projections are sorted, limited and resumed like selects
+	rows, _, err = books.SelectColumnsWith(exp.AndEx{}, []string{"Name"}, OrderBy("Count", Desc))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "b"}, {"Name": "a"}}, rows)
+	c := books.Iter(exp.AndEx{}, Limit(1))
+	for c.Next() {
+	}
+	rows, _, err = books.SelectColumnsWith(exp.AndEx{}, []string{"Name"}, After(c.Token()), Limit(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "b"}}, rows)
+	_, _, err = books.SelectColumnsWith(exp.AndEx{}, []string{"Name"}, After("not a token"))
+	assert.Error(t, err)
+
+	names, _, err := SelectAs[wideBook, struct{ Name string }](books, exp.AndEx{}, OrderBy("Count", Desc))
+	assert.NoError(t, err)
+	assert.Equal(t, []struct{ Name string }{{"b"}, {"a"}}, names)
+	maps, _, err := SelectAs[wideBook, map[string]any](books, exp.C("Name").Eq("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(maps))
+	assert.Equal(t, "q", maps[0]["Publisher"].(map[string]any)["Name"])
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	txBooks, err := TxTable(tx, books)
+	assert.NoError(t, err)
+	assert.NoError(t, txBooks.Insert(wideBook{Name: "c", Count: 3}))
+	rows, _, err = txBooks.SelectColumns(exp.C("Count").Gt(1), "Name")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "b"}}, rows)
+	rows, _, err = txBooks.SelectColumnsWith(exp.AndEx{}, []string{"Name"}, OrderBy("Name", Asc), Limit(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "a"}}, rows)
+	assert.NoError(t, tx.Commit())
+}
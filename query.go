@@ -0,0 +1,292 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/sql"
+	"github.com/vmihailenco/msgpack/v5"
+	"math"
+	"sort"
+)
+
+// row is an item of a table queried without a Go type
+type row = map[string]any
+
+// Result is the result of a SQL statement
+type Result struct {
+	// names of the columns of selected rows, in the order of the SELECT clause,
+	// or sorted if all columns are selected
+	Columns []string
+	// selected rows, with numbers as int64 or float64
+	Rows []map[string]any
+	// number of rows inserted or deleted
+	RowsAffected int
+}
+
+// Query runs a SQL statement against the tables of the db, with "?" placeholders bound to |args|.
+// SELECT returns the selected rows, with numbers as int64 or float64,
+// while INSERT and DELETE return no rows.
+// INSERT creates the table if it does not exist
+func (db *GledDB) Query(query string, args ...any) (rows []map[string]any, err error) {
+	result, err := db.exec(nil, query, args)
+	if err != nil {
+		return
+	}
+	return result.Rows, nil
+}
+
+// Exec runs a SQL statement like Query, returning the number of rows changed as well
+func (db *GledDB) Exec(query string, args ...any) (result *Result, err error) {
+	return db.exec(nil, query, args)
+}
+
+// Query runs a SQL statement within the transaction
+// selects see the rows as of when the transaction began, and changes take effect when it is committed
+func (tx *GledTx) Query(query string, args ...any) (rows []map[string]any, err error) {
+	result, err := tx.db.exec(tx, query, args)
+	if err != nil {
+		return
+	}
+	return result.Rows, nil
+}
+
+// Exec runs a SQL statement within the transaction like Query, returning the number of rows changed as well
+func (tx *GledTx) Exec(query string, args ...any) (result *Result, err error) {
+	return tx.db.exec(tx, query, args)
+}
+
+// exec runs a SQL statement, within a transaction if |tx| is not nil
+func (db *GledDB) exec(tx *GledTx, query string, args []any) (result *Result, err error) {
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		return
+	}
+	if params := sql.NumParams(stmt); params != len(args) {
+		err = fmt.Errorf("%d arguments given for %d placeholders", len(args), params)
+		return
+	}
+	result = &Result{}
+	switch s := stmt.(type) {
+	case *sql.Select:
+		err = db.execSelect(tx, s, args, result)
+	case *sql.Insert:
+		err = db.execInsert(tx, s, args, result)
+	case *sql.Delete:
+		err = db.execDelete(tx, s, args, result)
+	default:
+		err = fmt.Errorf("unsupported statement: %T", stmt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (db *GledDB) execSelect(tx *GledTx, s *sql.Select, args []any, result *Result) (err error) {
+	ex, err := sql.Ex(s.Where, args)
+	if err != nil {
+		return
+	}
+	table, err := db.queryTable(s.Table, false)
+	if err != nil {
+		return
+	}
+	defer table.Close()
+	var items []row
+	if tx != nil {
+		var view *GledTxTable[row]
+		view, err = TxTable(tx, table)
+		if err != nil {
+			return
+		}
+		items, _, err = view.Select(ex)
+	} else {
+		items, _, err = table.Select(ex)
+	}
+	if err != nil {
+		return
+	}
+	result.Rows = make([]map[string]any, 0, len(items))
+	if s.Columns == nil {
+		columns := map[string]bool{}
+		for _, item := range items {
+			for column := range item {
+				columns[column] = true
+			}
+			result.Rows = append(result.Rows, normalizeValue(item).(row))
+		}
+		for column := range columns {
+			result.Columns = append(result.Columns, column)
+		}
+		sort.Strings(result.Columns)
+		return
+	}
+	for _, column := range s.Columns {
+		result.Columns = append(result.Columns, column.Alias)
+	}
+	for _, item := range items {
+		projected := row{}
+		for _, column := range s.Columns {
+			projected[column.Alias] = normalizeValue(readPath(item, column.Name))
+		}
+		result.Rows = append(result.Rows, projected)
+	}
+	return
+}
+
+func (db *GledDB) execInsert(tx *GledTx, s *sql.Insert, args []any, result *Result) (err error) {
+	table, err := db.queryTable(s.Table, true)
+	if err != nil {
+		return
+	}
+	ops := make([]txOp, 0, len(s.Rows))
+	for _, values := range s.Rows {
+		item := row{}
+		for i, column := range s.Columns {
+			item[column], err = sql.Value(values[i], args)
+			if err != nil {
+				_ = table.Close()
+				return
+			}
+		}
+		var data []byte
+		data, err = msgpack.Marshal(item)
+		if err != nil {
+			_ = table.Close()
+			err = fmt.Errorf("failed to marshal row: %w", err)
+			return
+		}
+		ops = append(ops, txOp{table: table.baseTable, tuple: data})
+	}
+	if tx != nil {
+		// the table is changed when the transaction is committed
+		err = tx.hold(table.Close, ops...)
+		if err != nil {
+			_ = table.Close()
+			return
+		}
+		result.RowsAffected = len(ops)
+		return
+	}
+	defer table.Close()
+	err = db.autoCommit(ops)
+	if err != nil {
+		err = fmt.Errorf("failed to insert rows: %w", err)
+		return
+	}
+	result.RowsAffected = len(ops)
+	return
+}
+
+func (db *GledDB) execDelete(tx *GledTx, s *sql.Delete, args []any, result *Result) (err error) {
+	ex, err := sql.Ex(s.Where, args)
+	if err != nil {
+		return
+	}
+	table, err := db.queryTable(s.Table, false)
+	if err != nil {
+		return
+	}
+	if tx == nil {
+		defer table.Close()
+		result.RowsAffected, err = table.DeleteWhere(ex)
+		return
+	}
+	view, err := TxTable(tx, table)
+	if err != nil {
+		_ = table.Close()
+		return
+	}
+	_, locations, err := view.Select(ex)
+	if err != nil {
+		_ = table.Close()
+		return
+	}
+	ops := make([]txOp, 0, len(locations))
+	for _, loc := range locations {
+		ops = append(ops, txOp{table: table.baseTable, kind: opDelete, loc: loc})
+	}
+	err = tx.hold(table.Close, ops...)
+	if err != nil {
+		_ = table.Close()
+		return
+	}
+	result.RowsAffected = len(ops)
+	return
+}
+
+// queryTable opens a table for a query, creating it only if |create|
+func (db *GledDB) queryTable(name string, create bool) (table *GledTable[row], err error) {
+	if !create {
+		db.catalogMu.Lock()
+		_, _, err = db.lookupTable(name)
+		db.catalogMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return Table[row](db, name)
+}
+
+// readPath reads the value at a path of nested fields separated by dots
+// returns nil if there's none
+func readPath(item row, path string) any {
+	var value any = item
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] != '.' {
+			continue
+		}
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = fields[path[start:i]]
+		start = i + 1
+	}
+	return value
+}
+
+// normalizeValue converts numbers decoded from items into int64 and float64
+// so that rows hold the same types whatever the widths the numbers are stored in.
+// Unsigned integers too large for an int64 are kept as uint64, and never match comparisons
+func normalizeValue(value any) any {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return normalizeValue(uint64(v))
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return v
+		}
+		return int64(v)
+	case float32:
+		return float64(v)
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for key, field := range v {
+			normalized[key] = normalizeValue(field)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(v))
+		for i, element := range v {
+			normalized[i] = normalizeValue(element)
+		}
+		return normalized
+	default:
+		return value
+	}
+}
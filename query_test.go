@@ -0,0 +1,106 @@
+package gled
+
+import (
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+type queriedBook struct {
+	Name  string
+	Count int
+	Info  struct {
+		Pages int
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+
+	// rows inserted by SQL are read by typed tables, and the other way around
+	books, err := Table[queriedBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	book := queriedBook{Name: "typed", Count: 300}
+	book.Info.Pages = 120
+	assert.NoError(t, books.Insert(book))
+	_, err = db.Query("INSERT INTO books (Name, Count) VALUES ('a', 1), (?, ?)", "b", 1000)
+	assert.NoError(t, err)
+	items, _, err := books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(items))
+
+	rows, err := db.Query("SELECT * FROM books WHERE Count = 300")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{
+		"Name":  "typed",
+		"Count": int64(300),
+		"Info":  map[string]any{"Pages": int64(120)},
+	}}, rows)
+
+	rows, err = db.Query("SELECT Name, Info.Pages AS pages FROM books WHERE Count >= ? OR Name = 'a'", 300)
+	assert.NoError(t, err)
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i]["Name"].(string) < rows[j]["Name"].(string)
+	})
+	assert.Equal(t, []map[string]any{
+		{"Name": "a", "pages": nil},
+		{"Name": "b", "pages": nil},
+		{"Name": "typed", "pages": int64(120)},
+	}, rows)
+
+	result, err := db.Exec("DELETE FROM books WHERE Count < 1000")
+	assert.NoError(t, err)
+	assert.Nil(t, result.Rows)
+	assert.Equal(t, 2, result.RowsAffected)
+	rows, err = db.Query("SELECT Name FROM books")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Name": "b"}}, rows)
+
+	_, err = db.Query("SELECT * FROM missing")
+	assert.Error(t, err)
+	_, err = db.Query("SELECT * FROM books WHERE Count = ?")
+	assert.Error(t, err)
+	_, err = db.Query("SELECT * FROM books WHERE Count < ?", uint64(1<<63))
+	assert.Error(t, err)
+}
+
+func TestQueryTx(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	_, err := db.Query("INSERT INTO books (Name, Count) VALUES ('a', 1), ('b', 2)")
+	assert.NoError(t, err)
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	result, err := tx.Exec("INSERT INTO books (Name, Count) VALUES (?, ?)", "c", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.RowsAffected)
+	result, err = tx.Exec("DELETE FROM books WHERE Name = 'a'")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.RowsAffected)
+	// changes are invisible until committed
+	result, err = db.Exec("SELECT * FROM books")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Count", "Name"}, result.Columns)
+	assert.Len(t, result.Rows, 2)
+	assert.NoError(t, tx.Commit())
+
+	rows, err := db.Query("SELECT Name FROM books WHERE Count > 1")
+	assert.NoError(t, err)
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i]["Name"].(string) < rows[j]["Name"].(string)
+	})
+	assert.Equal(t, []map[string]any{{"Name": "b"}, {"Name": "c"}}, rows)
+
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec("DELETE FROM books")
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+	rows, err = db.Query("SELECT Name FROM books")
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+}
@@ -0,0 +1,252 @@
+package gled
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// items of tables migrated past version 1 are msgpack maps starting with this key,
+// followed by the version as a uint32, so that items of older versions can be told apart.
+// Items without it are of version 1
+var versionTag = []byte{0xa3, '_', '_', 'v', 0xce}
+
+// migrateFunc turns an item of a version, without its version tag, into one of the next version
+type migrateFunc func(data []byte) ([]byte, error)
+
+// migration is a registered migration between two item types of a table
+type migration struct {
+	// fingerprints of the types
+	from string
+	to   string
+	fn   migrateFunc
+}
+
+// schemaVersions is the schema version of the items of a table, and the migrations of older ones
+type schemaVersions struct {
+	current int
+	// migrations[v] turns an item of version v into one of version v+1
+	migrations map[int]migrateFunc
+}
+
+// RegisterMigration registers a function migrating the items of a table from type Old to type New.
+// When the table, holding items of type Old, is next opened with type New, its schema version is increased.
+// Items of the older version are then migrated when they are read, or all at once by GledTable.Migrate.
+// Migrations must be registered again whenever the db is created, as long as the table may hold items of Old.
+// Items are tagged with their versions by a field named "__v", which item types must not have
+func RegisterMigration[Old any, New any](db *GledDB, table string, fn func(item Old) (New, error)) {
+	m := &migration{
+		from: typeInfo[Old](table).Fingerprint,
+		to:   typeInfo[New](table).Fingerprint,
+		fn: func(data []byte) (migrated []byte, err error) {
+			var old Old
+			err = msgpack.Unmarshal(data, &old)
+			if err != nil {
+				err = fmt.Errorf("failed to unmarshal item to migrate: %w", err)
+				return
+			}
+			item, err := fn(old)
+			if err != nil {
+				err = fmt.Errorf("failed to migrate item: %w", err)
+				return
+			}
+			migrated, err = msgpack.Marshal(item)
+			if err != nil {
+				err = fmt.Errorf("failed to marshal migrated item: %w", err)
+				return
+			}
+			return
+		},
+	}
+	db.catalogMu.Lock()
+	defer db.catalogMu.Unlock()
+	if db.migrations == nil {
+		db.migrations = map[string][]*migration{}
+	}
+	db.migrations[table] = append(db.migrations[table], m)
+}
+
+// migrationPath finds the registered migrations leading from one type of a table to another
+// returns nil if there's none. Must be called with db.catalogMu held
+func (db *GledDB) migrationPath(table string, from string, to string) (steps []*migration) {
+	// breadth first, so that the shortest path is taken
+	prev := map[string]*migration{from: nil}
+	queue := []string{from}
+	for len(queue) > 0 && prev[to] == nil {
+		fingerprint := queue[0]
+		queue = queue[1:]
+		for _, m := range db.migrations[table] {
+			if _, visited := prev[m.to]; m.from != fingerprint || visited {
+				continue
+			}
+			prev[m.to] = m
+			queue = append(queue, m.to)
+		}
+	}
+	if prev[to] == nil {
+		return nil
+	}
+	for fingerprint := to; fingerprint != from; fingerprint = prev[fingerprint].from {
+		steps = append([]*migration{prev[fingerprint]}, steps...)
+	}
+	return
+}
+
+// schemaVersions finds the migrations of the items of older versions that a table may hold
+// Must be called with db.catalogMu held
+func (db *GledDB) schemaVersions(info TableInfo) (versions schemaVersions, err error) {
+	versions = schemaVersions{current: info.Version, migrations: map[int]migrateFunc{}}
+	for v := info.MinVersion; v < info.Version; v++ {
+		for _, m := range db.migrations[info.Name] {
+			if m.from == info.Versions[v-1] && m.to == info.Versions[v] {
+				versions.migrations[v] = m.fn
+				break
+			}
+		}
+		if versions.migrations[v] == nil {
+			err = fmt.Errorf("no migration registered from version %d of table %s, which may still hold items of it", v, info.Name)
+			return
+		}
+	}
+	return
+}
+
+// upgrade migrates an item of an older version to the current one
+// the returned item has no version tag
+func (t *baseTable) upgrade(tuple storage.Tuple) (upgraded storage.Tuple, err error) {
+	version, upgraded := untagVersion(tuple)
+	for ; version < t.versions.current; version++ {
+		migrate := t.versions.migrations[version]
+		if migrate == nil {
+			err = fmt.Errorf("no migration registered from version %d of table %s", version, t.name)
+			return
+		}
+		upgraded, err = migrate(upgraded)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tag an item of the current version with the version, if the table has been migrated
+func (t *baseTable) tag(tuple storage.Tuple) (tagged storage.Tuple, err error) {
+	if t.versions.current <= 1 {
+		return tuple, nil
+	}
+	return tagVersion(tuple, t.versions.current)
+}
+
+// Migrate rewrites the items of older versions into the current version all at once,
+// so that they no longer need migrating when read
+// returns the number of items migrated
+func (t *GledTable[T]) Migrate() (count int, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	stx, err := txm.Begin()
+	if err != nil {
+		return
+	}
+	defer stx.Finish()
+	var ops []txOp
+	t.mu.RLock()
+	err = t.table.ScanSnapshot(stx.Snapshot(), func(tuple storage.Tuple, loc storage.TupleLocation) (cont bool, err error) {
+		if version, _ := untagVersion(tuple); version >= t.versions.current {
+			return true, nil
+		}
+		upgraded, err := t.upgrade(tuple)
+		if err != nil {
+			return
+		}
+		ops = append(ops, txOp{table: t.baseTable, kind: opUpdate, tuple: upgraded, loc: loc})
+		return true, nil
+	})
+	t.mu.RUnlock()
+	if err != nil {
+		err = fmt.Errorf("failed to migrate items: %w", err)
+		return
+	}
+	err = t.db.apply(stx, ops)
+	if err != nil {
+		err = fmt.Errorf("failed to migrate items: %w", err)
+		return
+	}
+
+	t.db.catalogMu.Lock()
+	defer t.db.catalogMu.Unlock()
+	info, loc, err := t.db.lookupTable(t.name)
+	if err != nil {
+		return
+	}
+	if info.MinVersion < t.versions.current {
+		info.MinVersion = t.versions.current
+		err = t.db.catalog.Update(loc, info)
+		if err != nil {
+			err = fmt.Errorf("failed to record migration of table %s: %w", t.name, err)
+			return
+		}
+	}
+	return len(ops), nil
+}
+
+// tagVersion tags an encoded item with a version, by adding the version as the first field of the item
+func tagVersion(data []byte, version int) (tagged []byte, err error) {
+	n, headerSize, err := mapHeader(data)
+	if err != nil {
+		return
+	}
+	tagged = appendMapHeader(make([]byte, 0, len(data)+len(versionTag)+8), n+1)
+	tagged = append(tagged, versionTag...)
+	tagged = appendUint32(tagged, uint32(version))
+	tagged = append(tagged, data[headerSize:]...)
+	return
+}
+
+// untagVersion finds the version of an encoded item and removes its tag
+// items without tags are of version 1
+func untagVersion(data []byte) (version int, untagged []byte) {
+	n, headerSize, err := mapHeader(data)
+	tagSize := len(versionTag) + 4
+	if err != nil || n == 0 || len(data) < headerSize+tagSize || !bytes.HasPrefix(data[headerSize:], versionTag) {
+		return 1, data
+	}
+	version = int(binary.BigEndian.Uint32(data[headerSize+len(versionTag):]))
+	untagged = appendMapHeader(make([]byte, 0, len(data)), n-1)
+	untagged = append(untagged, data[headerSize+tagSize:]...)
+	return
+}
+
+// mapHeader decodes the header of an encoded msgpack map
+// returns the number of fields in the map and the size of the header
+func mapHeader(data []byte) (n int, size int, err error) {
+	switch {
+	case len(data) >= 1 && data[0]&0xf0 == 0x80:
+		return int(data[0] & 0x0f), 1, nil
+	case len(data) >= 3 && data[0] == 0xde:
+		return int(binary.BigEndian.Uint16(data[1:])), 3, nil
+	case len(data) >= 5 && data[0] == 0xdf:
+		return int(binary.BigEndian.Uint32(data[1:])), 5, nil
+	default:
+		return 0, 0, errors.New("item is not a map, so it cannot be versioned")
+	}
+}
+
+func appendMapHeader(data []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(data, 0x80|byte(n))
+	case n < 1<<16:
+		return append(data, 0xde, byte(n>>8), byte(n))
+	default:
+		return appendUint32(append(data, 0xdf), uint32(n))
+	}
+}
+
+func appendUint32(data []byte, n uint32) []byte {
+	return append(data, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
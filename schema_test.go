@@ -0,0 +1,148 @@
+package gled
+
+import (
+	"errors"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+)
+
+type bookV1 struct {
+	Name  string
+	Pages int
+}
+
+type bookV2 struct {
+	Title string
+	// in hundreds of pages
+	Pages float64
+}
+
+func migrateBook(old bookV1) (bookV2, error) {
+	return bookV2{Title: old.Name, Pages: float64(old.Pages) / 100}, nil
+}
+
+func TestMigration(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir)
+	v1, err := Table[bookV1](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, v1.CreateIndex("Pages"))
+	assert.NoError(t, v1.Insert(bookV1{Name: "a", Pages: 100}))
+	assert.NoError(t, v1.Insert(bookV1{Name: "b", Pages: 250}))
+	_, locations, err := v1.Select(exp.C("Name").Eq("a"))
+	assert.NoError(t, err)
+	// Pages changes from int to float
+	_, err = Table[bookV2](db, "books")
+	assert.True(t, errors.Is(err, ErrIncompatibleType))
+
+	RegisterMigration(db, "books", migrateBook)
+	_, err = Table[bookV2](db, "books")
+	assert.Error(t, err, "tables are migrated only when closed")
+	assert.NoError(t, v1.Close())
+
+	// items of version 1 are migrated when read
+	v2, err := Table[bookV2](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, v2.Insert(bookV2{Title: "c", Pages: 3}))
+	item, err := v2.Get(locations[0])
+	assert.NoError(t, err)
+	assert.Equal(t, bookV2{Title: "a", Pages: 1}, item)
+	items, _, err := v2.Select(exp.C("Pages").Gt(2.0))
+	assert.NoError(t, err)
+	assert.Equal(t, []bookV2{{Title: "b", Pages: 2.5}, {Title: "c", Pages: 3}}, items)
+	rows, err := db.Query("SELECT * FROM books WHERE Title = 'c'")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"Title": "c", "Pages": float64(3)}}, rows)
+	_, err = Table[bookV1](db, "books")
+	assert.True(t, errors.Is(err, ErrIncompatibleType))
+
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tables[0].Version)
+	assert.Equal(t, 1, tables[0].MinVersion)
+	assert.NoError(t, v2.Close())
+	assert.NoError(t, db.Close())
+
+	// items of version 1 can't be read without the migration
+	db = NewGleDB(dir)
+	_, err = Table[bookV2](db, "books")
+	assert.Error(t, err)
+	RegisterMigration(db, "books", migrateBook)
+	v2, err = Table[bookV2](db, "books")
+	assert.NoError(t, err)
+	count, err := v2.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = v2.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.NoError(t, v2.Close())
+	assert.NoError(t, db.Close())
+
+	// but they no longer need it once all are migrated
+	db = NewGleDB(dir)
+	defer db.Close()
+	v2, err = Table[bookV2](db, "books")
+	assert.NoError(t, err)
+	defer v2.Close()
+	items, _, err = v2.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(items))
+}
+
+type bookV3 struct {
+	Title string
+	Pages float64
+	Price int
+}
+
+func TestMigrationPath(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	v1, err := Table[bookV1](db, "books")
+	assert.NoError(t, err)
+	assert.NoError(t, v1.Insert(bookV1{Name: "a", Pages: 100}))
+	assert.NoError(t, v1.Close())
+
+	RegisterMigration(db, "books", func(old bookV2) (bookV3, error) {
+		return bookV3{Title: old.Title, Pages: old.Pages, Price: 10}, nil
+	})
+	RegisterMigration(db, "books", migrateBook)
+	v3, err := Table[bookV3](db, "books")
+	assert.NoError(t, err)
+	defer v3.Close()
+	items, _, err := v3.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []bookV3{{Title: "a", Pages: 1, Price: 10}}, items)
+	tables, err := db.ListTables()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tables[0].Version)
+}
+
+func TestVersionTag(t *testing.T) {
+	for _, fields := range []int{0, 1, 15, 16, 70000} {
+		item := map[string]any{}
+		for i := 0; i < fields; i++ {
+			item[string(rune('a'+i%26))+string(rune('a'+i/26%26))+string(rune('a'+i/676))] = i
+		}
+		data, err := msgpack.Marshal(item)
+		assert.NoError(t, err)
+		version, untagged := untagVersion(data)
+		assert.Equal(t, 1, version)
+		assert.Equal(t, data, untagged)
+
+		tagged, err := tagVersion(data, 7)
+		assert.NoError(t, err)
+		var decoded map[string]any
+		assert.NoError(t, msgpack.Unmarshal(tagged, &decoded))
+		assert.Equal(t, fields+1, len(decoded))
+		version, untagged = untagVersion(tagged)
+		assert.Equal(t, 7, version)
+		assert.Equal(t, data, untagged)
+	}
+	_, err := tagVersion(storage.Tuple{0x01}, 2)
+	assert.Error(t, err)
+}
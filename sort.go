@@ -0,0 +1,385 @@
+package gled
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// default bytes of items a sort holds in memory before spilling them into a temporary file
+	defaultSortMemory = 32 * 1024 * 1024
+	// bytes counted for each item held by a sort besides the item itself
+	sortRowOverhead = 64
+)
+
+// sortKey is a column to sort items by
+type sortKey struct {
+	column exp.Column
+	order  Order
+}
+
+// sortRow is an item being sorted, with the values of its sort keys
+type sortRow struct {
+	tuple storage.Tuple
+	loc   storage.TupleLocation
+	keys  []any
+	// the index an unsorted item is found through and its key in the index, for resume tokens
+	index exp.Column
+	key   []byte
+}
+
+// sorter sorts items by keys within a memory budget.
+// Once the items added exceed the budget, they are sorted and written into a temporary file as a run,
+// and the runs are merged when the sorted items are read.
+// With a limit, only the first items are kept, in a heap holding no more than the limit.
+// The heap is within the budget too, so if the limit is large it's spilled as a run of at most |limit| items
+type sorter struct {
+	// directory of the temporary files
+	dir    string
+	keys   []sortKey
+	budget int64
+	// max number of items to keep, negative if there's no limit
+	limit int
+	rows  []sortRow
+	// bytes of the rows
+	size int64
+	runs []*os.File
+}
+
+func (db *GledDB) newSorter(keys []sortKey, limit int) *sorter {
+	budget := db.sortMemory
+	if budget <= 0 {
+		budget = defaultSortMemory
+	}
+	return &sorter{dir: db.dir, keys: keys, budget: budget, limit: limit}
+}
+
+// keysOf reads the values of the sort keys of an item
+func (s *sorter) keysOf(item map[string]any) []any {
+	keys := make([]any, len(s.keys))
+	for i, key := range s.keys {
+		if value, found := exp.ReadColumn(item, key.column); found {
+			keys[i] = primValue(value)
+		}
+	}
+	return keys
+}
+
+// compare orders two rows by the sort keys, then by their locations so that the order is deterministic
+func (s *sorter) compare(a *sortRow, b *sortRow) int {
+	for i, key := range s.keys {
+		c := compareValues(a.keys[i], b.keys[i])
+		if key.order == Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareLocations(a.loc, b.loc)
+}
+
+// compareLocations orders locations as the tuples are stored in the table
+func compareLocations(a storage.TupleLocation, b storage.TupleLocation) int {
+	if a.Page != b.Page {
+		return compareOrdered(a.Page, b.Page)
+	}
+	return compareOrdered(int64(a.Offset), int64(b.Offset))
+}
+
+// row of an item to sort, decoded as |item|
+func (s *sorter) row(tuple storage.Tuple, loc storage.TupleLocation, item map[string]any) sortRow {
+	return sortRow{tuple: tuple, loc: loc, keys: s.keysOf(item)}
+}
+
+// add a row to sort
+func (s *sorter) add(row sortRow) (err error) {
+	row.tuple = append(storage.Tuple(nil), row.tuple...)
+	if s.limit >= 0 {
+		s.keep(row)
+	} else {
+		s.rows = append(s.rows, row)
+		s.size += rowSize(row)
+	}
+	if s.size >= s.budget {
+		err = s.spill()
+	}
+	return
+}
+
+// keep a row if it's among the first |limit| rows so far
+// the rows form a heap with the last of them on top
+func (s *sorter) keep(row sortRow) {
+	h := topHeap{sorter: s}
+	if len(s.rows) < s.limit {
+		heap.Push(h, row)
+		s.size += rowSize(row)
+		return
+	}
+	if s.limit == 0 || s.compare(&row, &s.rows[0]) >= 0 {
+		return
+	}
+	s.size += rowSize(row) - rowSize(s.rows[0])
+	s.rows[0] = row
+	heap.Fix(h, 0)
+}
+
+// bytes counted for a row held in memory
+func rowSize(row sortRow) int64 {
+	return int64(len(row.tuple)) + sortRowOverhead
+}
+
+// spill the rows in memory into a temporary file as a sorted run
+func (s *sorter) spill() (err error) {
+	s.sortRows()
+	file, err := os.CreateTemp(s.dir, "sort-*.tmp")
+	if err != nil {
+		err = fmt.Errorf("failed to create sort file: %w", err)
+		return
+	}
+	s.runs = append(s.runs, file)
+	w := bufio.NewWriter(file)
+	for _, row := range s.rows {
+		err = writeSpilled(w, row.tuple, row.loc)
+		if err != nil {
+			return
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		err = fmt.Errorf("failed to write sort file: %w", err)
+		return
+	}
+	s.rows = nil
+	s.size = 0
+	return
+}
+
+func (s *sorter) sortRows() {
+	sort.Slice(s.rows, func(i, j int) bool {
+		return s.compare(&s.rows[i], &s.rows[j]) < 0
+	})
+}
+
+// sorted reads the items added in order, merging the runs spilled with the rows in memory
+// the sorter must not be added to afterwards
+func (s *sorter) sorted() (merged *sortMerger, err error) {
+	s.sortRows()
+	merged = &sortMerger{sorter: s}
+	merged.sources = append(merged.sources, &memoryRun{rows: s.rows})
+	for _, file := range s.runs {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			err = fmt.Errorf("failed to read sort file: %w", err)
+			return
+		}
+		merged.sources = append(merged.sources, &fileRun{sorter: s, r: bufio.NewReader(file)})
+	}
+	for _, source := range merged.sources {
+		var row sortRow
+		var ok bool
+		row, ok, err = source.read()
+		if err != nil {
+			return
+		}
+		if ok {
+			heap.Push(merged, mergeHead{row: row, source: source})
+		}
+	}
+	return
+}
+
+// close removes the temporary files of the sorter
+func (s *sorter) close() {
+	for _, file := range s.runs {
+		_ = file.Close()
+		err := os.Remove(file.Name())
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to remove sort file %s", file.Name())
+		}
+	}
+	s.runs = nil
+	s.rows = nil
+}
+
+// topHeap is a heap of the rows kept by a sorter with a limit, with the last of them on top
+type topHeap struct {
+	sorter *sorter
+}
+
+func (h topHeap) Len() int {
+	return len(h.sorter.rows)
+}
+
+func (h topHeap) Less(i, j int) bool {
+	return h.sorter.compare(&h.sorter.rows[i], &h.sorter.rows[j]) > 0
+}
+
+func (h topHeap) Swap(i, j int) {
+	h.sorter.rows[i], h.sorter.rows[j] = h.sorter.rows[j], h.sorter.rows[i]
+}
+
+func (h topHeap) Push(x any) {
+	h.sorter.rows = append(h.sorter.rows, x.(sortRow))
+}
+
+func (h topHeap) Pop() any {
+	last := h.sorter.rows[len(h.sorter.rows)-1]
+	h.sorter.rows = h.sorter.rows[:len(h.sorter.rows)-1]
+	return last
+}
+
+// sortRun is a source of sorted rows
+type sortRun interface {
+	// read the next row, false if there's none left
+	read() (row sortRow, ok bool, err error)
+}
+
+// memoryRun is a run of rows sorted in memory
+type memoryRun struct {
+	rows []sortRow
+	pos  int
+}
+
+func (r *memoryRun) read() (row sortRow, ok bool, err error) {
+	if r.pos >= len(r.rows) {
+		return
+	}
+	row = r.rows[r.pos]
+	r.pos++
+	return row, true, nil
+}
+
+// fileRun is a run of rows spilled into a temporary file
+type fileRun struct {
+	sorter *sorter
+	r      *bufio.Reader
+}
+
+func (r *fileRun) read() (row sortRow, ok bool, err error) {
+	row.tuple, row.loc, ok, err = readSpilled(r.r)
+	if err != nil || !ok {
+		return
+	}
+	// keys are read again from the item instead of being written along with it
+	var item map[string]any
+	err = msgpack.Unmarshal(row.tuple, &item)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal item: %w", err)
+		return
+	}
+	row.keys = r.sorter.keysOf(item)
+	return row, true, nil
+}
+
+// sortMerger merges sorted runs k-way, taking the first of their next rows each time
+type sortMerger struct {
+	sorter  *sorter
+	sources []sortRun
+	// next row of each run with rows left, with the first of them on top
+	heads []mergeHead
+}
+
+// mergeHead is the next row of a run
+type mergeHead struct {
+	row    sortRow
+	source sortRun
+}
+
+func (m *sortMerger) Len() int {
+	return len(m.heads)
+}
+
+func (m *sortMerger) Less(i, j int) bool {
+	return m.sorter.compare(&m.heads[i].row, &m.heads[j].row) < 0
+}
+
+func (m *sortMerger) Swap(i, j int) {
+	m.heads[i], m.heads[j] = m.heads[j], m.heads[i]
+}
+
+func (m *sortMerger) Push(x any) {
+	m.heads = append(m.heads, x.(mergeHead))
+}
+
+func (m *sortMerger) Pop() any {
+	last := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return last
+}
+
+// next reads the next row in order, false if there's none left
+func (m *sortMerger) next() (row sortRow, ok bool, err error) {
+	if len(m.heads) == 0 {
+		return
+	}
+	row = m.heads[0].row
+	next, more, err := m.heads[0].source.read()
+	if err != nil {
+		return
+	}
+	if more {
+		m.heads[0].row = next
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return row, true, nil
+}
+
+// writeSpilled writes an item into a temporary file, as the uvarints of its location and size followed by the item
+func writeSpilled(w *bufio.Writer, tuple storage.Tuple, loc storage.TupleLocation) (err error) {
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(loc.Page))
+	n += binary.PutUvarint(buf[n:], uint64(loc.Offset))
+	n += binary.PutUvarint(buf[n:], uint64(len(tuple)))
+	_, err = w.Write(buf[:n])
+	if err == nil {
+		_, err = w.Write(tuple)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write temporary file: %w", err)
+		return
+	}
+	return
+}
+
+// readSpilled reads the next item written by writeSpilled, false if there's none left
+func readSpilled(r *bufio.Reader) (tuple storage.Tuple, loc storage.TupleLocation, ok bool, err error) {
+	page, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return nil, loc, false, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read temporary file: %w", err)
+		return
+	}
+	offset, err := binary.ReadUvarint(r)
+	if err != nil {
+		err = fmt.Errorf("failed to read temporary file: %w", err)
+		return
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		err = fmt.Errorf("failed to read temporary file: %w", err)
+		return
+	}
+	loc = storage.TupleLocation{Page: int64(page), Offset: uint32(offset)}
+	tuple = make(storage.Tuple, size)
+	_, err = io.ReadFull(r, tuple)
+	if err != nil {
+		err = fmt.Errorf("failed to read temporary file: %w", err)
+		return
+	}
+	return tuple, loc, true, nil
+}
@@ -0,0 +1,129 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type sortedBook struct {
+	Name     string
+	Category string
+	Count    int
+}
+
+func TestOrderBy(t *testing.T) {
+	dir := t.TempDir()
+	// small enough for every sort of the books to spill
+	db := NewGleDB(dir, WithSortMemory(1024))
+	defer db.Close()
+	books, err := Table[sortedBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	var all []sortedBook
+	for i := 0; i < 500; i++ {
+		book := sortedBook{
+			Name:     fmt.Sprintf("book-%03d", i),
+			Category: []string{"c", "a", "b"}[i%3],
+			Count:    (i * 7919) % 100,
+		}
+		all = append(all, book)
+		assert.NoError(t, books.Insert(book))
+	}
+	expected := append([]sortedBook(nil), all...)
+	sort.SliceStable(expected, func(i, j int) bool {
+		if expected[i].Category != expected[j].Category {
+			return expected[i].Category < expected[j].Category
+		}
+		return expected[i].Count > expected[j].Count
+	})
+
+	items, locations, err := books.Select(exp.AndEx{}, OrderBy("Category", Asc), OrderBy("Count", Desc))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, items)
+	item, err := books.Get(locations[10])
+	assert.NoError(t, err)
+	assert.Equal(t, expected[10], item)
+	matches, err := filepath.Glob(filepath.Join(dir, "sort-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches, "sort files are removed")
+
+	// the first ones are kept in a heap with a limit
+	items, _, err = books.Select(exp.AndEx{}, OrderBy("Category", Asc), OrderBy("Count", Desc), Limit(25))
+	assert.NoError(t, err)
+	assert.Equal(t, expected[:25], items)
+	items, _, err = books.Select(exp.C("Count").Lt(10), OrderBy("Name", Desc), Limit(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(items))
+	assert.True(t, items[0].Name > items[1].Name)
+
+	// a limit too large for the budget spills runs of at most the limit
+	c := books.Iter(exp.AndEx{}, OrderBy("Category", Asc), OrderBy("Count", Desc), Offset(400), Limit(20))
+	items = nil
+	for c.Next() {
+		if len(items) == 0 {
+			matches, err = filepath.Glob(filepath.Join(dir, "sort-*.tmp"))
+			assert.NoError(t, err)
+			assert.NotEmpty(t, matches, "sort files are written")
+		}
+		items = append(items, c.Item())
+	}
+	assert.NoError(t, c.Err())
+	assert.Equal(t, expected[400:420], items)
+	matches, err = filepath.Glob(filepath.Join(dir, "sort-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches, "sort files are removed")
+	items, _, err = books.Select(exp.AndEx{}, Limit(3))
+	assert.NoError(t, err)
+	assert.Equal(t, all[:3], items)
+	items, _, err = books.Select(exp.AndEx{}, OrderBy("Name", Asc), Limit(0))
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+
+	// missing values come first
+	notes, err := Table[map[string]any](db, "notes")
+	assert.NoError(t, err)
+	defer notes.Close()
+	for _, note := range []map[string]any{{"Rank": 2}, {"Rank": "x"}, {}, {"Rank": 1.5}} {
+		assert.NoError(t, notes.Insert(note))
+	}
+	rows, _, err := notes.Select(exp.AndEx{}, OrderBy("Rank", Asc))
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{}, {"Rank": 1.5}, {"Rank": int8(2)}, {"Rank": "x"}}, rows)
+}
+
+func TestSorterSpills(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir, WithSortMemory(1))
+	s := db.newSorter([]sortKey{{column: exp.C("N"), order: Desc}}, -1)
+	defer s.close()
+	for i, n := range []int{3, 1, 4, 2} {
+		item := map[string]any{"N": n}
+		tuple, err := msgpack.Marshal(item)
+		assert.NoError(t, err)
+		assert.NoError(t, s.add(s.row(tuple, storage.TupleLocation{Page: int64(i)}, item)))
+	}
+	assert.Equal(t, 4, len(s.runs))
+	merged, err := s.sorted()
+	assert.NoError(t, err)
+	var pages []int64
+	for {
+		row, ok, err := merged.next()
+		assert.NoError(t, err)
+		if !ok {
+			break
+		}
+		pages = append(pages, row.loc.Page)
+	}
+	assert.Equal(t, []int64{2, 0, 3, 1}, pages)
+	s.close()
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,101 @@
+package sql
+
+// Statement is a parsed SQL statement
+type Statement interface {
+	isStatement()
+}
+
+// NumParams returns the number of placeholders in a statement
+func NumParams(stmt Statement) int {
+	switch s := stmt.(type) {
+	case *Select:
+		return s.Params
+	case *Insert:
+		return s.Params
+	case *Delete:
+		return s.Params
+	default:
+		return 0
+	}
+}
+
+// Select is "SELECT columns FROM table [WHERE condition]"
+type Select struct {
+	// selected columns, nil for "*"
+	Columns []SelectColumn
+	Table   string
+	// nil if there's no WHERE clause
+	Where Expr
+	// number of placeholders in the statement
+	Params int
+}
+
+func (s *Select) isStatement() {}
+
+// SelectColumn is a selected column, optionally renamed with "AS"
+type SelectColumn struct {
+	// name of the column, with dots separating the names of nested fields
+	Name string
+	// name of the column in the result rows, the same as Name if not renamed
+	Alias string
+}
+
+// Insert is "INSERT INTO table (columns) VALUES (values), ..."
+type Insert struct {
+	Table   string
+	Columns []string
+	// values of each inserted row, in the order of the columns
+	Rows [][]Expr
+	// number of placeholders in the statement
+	Params int
+}
+
+func (s *Insert) isStatement() {}
+
+// Delete is "DELETE FROM table [WHERE condition]"
+type Delete struct {
+	Table string
+	// nil if there's no WHERE clause
+	Where Expr
+	// number of placeholders in the statement
+	Params int
+}
+
+func (s *Delete) isStatement() {}
+
+// Expr is an expression within a statement
+type Expr interface {
+	isExpr()
+}
+
+// ColumnRef refers to a column, with dots separating the names of nested fields
+type ColumnRef struct {
+	Name string
+}
+
+func (e ColumnRef) isExpr() {}
+
+// Literal is a constant of type string, int64, float64, bool, or nil for NULL
+type Literal struct {
+	Value any
+}
+
+func (e Literal) isExpr() {}
+
+// Placeholder is a "?" standing for an argument of the statement
+type Placeholder struct {
+	// index of the argument, starting from 0
+	Index int
+}
+
+func (e Placeholder) isExpr() {}
+
+// BinaryExpr is a comparison or a logical operation on two expressions
+type BinaryExpr struct {
+	// one of "=", "!=", "<", "<=", ">", ">=", "AND" and "OR"
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+func (e BinaryExpr) isExpr() {}
@@ -0,0 +1,140 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"math"
+)
+
+// flipped comparison operators, for rewriting "value op column" as "column op value"
+var flippedOps = map[string]string{
+	"=":  "=",
+	"!=": "!=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// Ex translates a WHERE condition into an expression, binding placeholders to |args|
+// a nil condition matches everything
+func Ex(cond Expr, args []any) (ex exp.Ex, err error) {
+	if cond == nil {
+		return exp.AndEx{}, nil
+	}
+	e, ok := cond.(BinaryExpr)
+	if !ok {
+		err = fmt.Errorf("not a condition: %v", cond)
+		return
+	}
+	switch e.Op {
+	case "AND", "OR":
+		var left, right exp.Ex
+		left, err = Ex(e.Left, args)
+		if err != nil {
+			return
+		}
+		right, err = Ex(e.Right, args)
+		if err != nil {
+			return
+		}
+		if e.Op == "AND" {
+			return exp.AndEx{Exps: append(andOperands(left), andOperands(right)...)}, nil
+		}
+		return exp.OrEx{Exps: append(orOperands(left), orOperands(right)...)}, nil
+	}
+	return comparison(e, args)
+}
+
+// the operands of an expression if it's an AND, so that chained ANDs are flattened
+func andOperands(ex exp.Ex) []exp.Ex {
+	if and, ok := ex.(exp.AndEx); ok {
+		return and.Exps
+	}
+	return []exp.Ex{ex}
+}
+
+func orOperands(ex exp.Ex) []exp.Ex {
+	if or, ok := ex.(exp.OrEx); ok {
+		return or.Exps
+	}
+	return []exp.Ex{ex}
+}
+
+func comparison(e BinaryExpr, args []any) (ex exp.Ex, err error) {
+	op := e.Op
+	column, isColumn := e.Left.(ColumnRef)
+	other := e.Right
+	if !isColumn {
+		column, isColumn = e.Right.(ColumnRef)
+		other = e.Left
+		op = flippedOps[op]
+	}
+	if !isColumn {
+		err = fmt.Errorf("comparison without a column: %v %s %v", e.Left, e.Op, e.Right)
+		return
+	}
+	var operand any
+	if c, ok := other.(ColumnRef); ok {
+		operand = exp.C(c.Name)
+	} else {
+		operand, err = Value(other, args)
+		if err != nil {
+			return
+		}
+		if !comparableValue(operand) {
+			err = fmt.Errorf("cannot compare column %s with %v of type %T", column.Name, operand, operand)
+			return
+		}
+	}
+	c := exp.C(column.Name)
+	switch op {
+	case "=":
+		return c.Eq(operand), nil
+	case "!=":
+		return c.Neq(operand), nil
+	case "<":
+		return c.Lt(operand), nil
+	case "<=":
+		return c.Lte(operand), nil
+	case ">":
+		return c.Gt(operand), nil
+	case ">=":
+		return c.Gte(operand), nil
+	default:
+		err = fmt.Errorf("unknown comparison operator %s", e.Op)
+		return
+	}
+}
+
+// Value evaluates a value of a statement, binding placeholders to |args|
+func Value(value Expr, args []any) (v any, err error) {
+	switch e := value.(type) {
+	case Literal:
+		return e.Value, nil
+	case Placeholder:
+		if e.Index >= len(args) {
+			err = fmt.Errorf("no argument for placeholder %d", e.Index+1)
+			return
+		}
+		return args[e.Index], nil
+	default:
+		err = fmt.Errorf("not a value: %v", value)
+		return
+	}
+}
+
+// whether a value can be compared with columns
+// unsigned integers too large for an int64 can't be compared, like in the exp package
+func comparableValue(value any) bool {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v) <= math.MaxInt64
+	case uint64:
+		return v <= math.MaxInt64
+	case string, int, int8, int16, int32, int64, uint8, uint16, uint32, float32, float64:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,145 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a lexical token
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	// bare or quoted name of a table or a column
+	tokenIdent
+	// reserved word, upper-cased
+	tokenKeyword
+	tokenString
+	tokenNumber
+	// operators and punctuation
+	tokenSymbol
+	// "?" standing for an argument
+	tokenPlaceholder
+)
+
+var keywords = map[string]bool{
+	"SELECT": true,
+	"FROM":   true,
+	"WHERE":  true,
+	"INSERT": true,
+	"INTO":   true,
+	"VALUES": true,
+	"DELETE": true,
+	"AND":    true,
+	"OR":     true,
+	"AS":     true,
+	"TRUE":   true,
+	"FALSE":  true,
+	"NULL":   true,
+}
+
+// token is a lexical token of a statement
+type token struct {
+	kind tokenKind
+	// text of the token, with quotes of strings and names removed
+	text string
+	// offset of the token in the statement
+	pos int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of statement"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// tokenize splits a statement into tokens, ending with a tokenEOF
+func tokenize(input string) (tokens []token, err error) {
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			// comment till the end of the line
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			word := string(runes[start:i])
+			if upper := strings.ToUpper(word); keywords[upper] {
+				tokens = append(tokens, token{kind: tokenKeyword, text: upper, pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdent, text: word, pos: start})
+			}
+		case unicode.IsDigit(r) || r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				(runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case r == '\'' || r == '"' || r == '`':
+			// strings are single-quoted, names are double-quoted or back-quoted
+			// a quote is escaped by doubling it
+			var text []rune
+			i++
+			for {
+				if i >= len(runes) {
+					err = fmt.Errorf("unterminated quote at %d", start)
+					return
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						text = append(text, r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text = append(text, runes[i])
+				i++
+			}
+			kind := tokenIdent
+			if r == '\'' {
+				kind = tokenString
+			}
+			tokens = append(tokens, token{kind: kind, text: string(text), pos: start})
+		case r == '?':
+			i++
+			tokens = append(tokens, token{kind: tokenPlaceholder, text: "?", pos: start})
+		default:
+			symbol := ""
+			for _, candidate := range []string{"<=", ">=", "<>", "!=", "=", "<", ">", "(", ")", ",", ".", "*", "-", ";"} {
+				if strings.HasPrefix(string(runes[i:minInt(i+2, len(runes))]), candidate) {
+					symbol = candidate
+					break
+				}
+			}
+			if symbol == "" {
+				err = fmt.Errorf("unexpected character %q at %d", r, start)
+				return
+			}
+			i += len(symbol)
+			tokens = append(tokens, token{kind: tokenSymbol, text: symbol, pos: start})
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(runes)})
+	return
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
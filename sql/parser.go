@@ -0,0 +1,376 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse parses a SQL statement
+// supported statements are SELECT, INSERT and DELETE on a single table,
+// with WHERE conditions made of comparisons combined by AND and OR
+func Parse(query string) (stmt Statement, err error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		err = fmt.Errorf("failed to parse statement: %w", err)
+		return
+	}
+	p := &parser{tokens: tokens}
+	stmt, err = p.statement()
+	if err != nil {
+		err = fmt.Errorf("failed to parse statement: %w", err)
+		return
+	}
+	return
+}
+
+// parser is a recursive descent parser over the tokens of a statement
+type parser struct {
+	tokens []token
+	pos    int
+	// number of placeholders met so far
+	params int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or symbol |text|
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenKeyword || t.kind == tokenSymbol) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the next token, which must be the keyword or symbol |text|
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(text)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(expected string) error {
+	t := p.peek()
+	return fmt.Errorf("expected %s but got %s at %d", expected, t, t.pos)
+}
+
+func (p *parser) statement() (stmt Statement, err error) {
+	switch {
+	case p.accept("SELECT"):
+		stmt, err = p.selectStatement()
+	case p.accept("INSERT"):
+		stmt, err = p.insertStatement()
+	case p.accept("DELETE"):
+		stmt, err = p.deleteStatement()
+	default:
+		err = p.unexpected("SELECT, INSERT or DELETE")
+	}
+	if err != nil {
+		return
+	}
+	p.accept(";")
+	if p.peek().kind != tokenEOF {
+		err = p.unexpected("end of statement")
+		return
+	}
+	return
+}
+
+func (p *parser) selectStatement() (stmt *Select, err error) {
+	stmt = &Select{}
+	if !p.accept("*") {
+		for {
+			var column SelectColumn
+			column.Name, err = p.columnName()
+			if err != nil {
+				return
+			}
+			column.Alias = column.Name
+			if p.accept("AS") {
+				column.Alias, err = p.name()
+				if err != nil {
+					return
+				}
+			}
+			stmt.Columns = append(stmt.Columns, column)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	err = p.expect("FROM")
+	if err != nil {
+		return
+	}
+	stmt.Table, err = p.name()
+	if err != nil {
+		return
+	}
+	stmt.Where, err = p.where()
+	if err != nil {
+		return
+	}
+	stmt.Params = p.params
+	return
+}
+
+func (p *parser) insertStatement() (stmt *Insert, err error) {
+	stmt = &Insert{}
+	err = p.expect("INTO")
+	if err != nil {
+		return
+	}
+	stmt.Table, err = p.name()
+	if err != nil {
+		return
+	}
+	err = p.expect("(")
+	if err != nil {
+		return
+	}
+	for {
+		var column string
+		column, err = p.name()
+		if err != nil {
+			return
+		}
+		stmt.Columns = append(stmt.Columns, column)
+		if !p.accept(",") {
+			break
+		}
+	}
+	err = p.expect(")")
+	if err != nil {
+		return
+	}
+	err = p.expect("VALUES")
+	if err != nil {
+		return
+	}
+	for {
+		err = p.expect("(")
+		if err != nil {
+			return
+		}
+		var row []Expr
+		for {
+			var value Expr
+			value, err = p.operand()
+			if err != nil {
+				return
+			}
+			row = append(row, value)
+			if !p.accept(",") {
+				break
+			}
+		}
+		err = p.expect(")")
+		if err != nil {
+			return
+		}
+		if len(row) != len(stmt.Columns) {
+			err = fmt.Errorf("%d values for %d columns", len(row), len(stmt.Columns))
+			return
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.accept(",") {
+			break
+		}
+	}
+	stmt.Params = p.params
+	return
+}
+
+func (p *parser) deleteStatement() (stmt *Delete, err error) {
+	stmt = &Delete{}
+	err = p.expect("FROM")
+	if err != nil {
+		return
+	}
+	stmt.Table, err = p.name()
+	if err != nil {
+		return
+	}
+	stmt.Where, err = p.where()
+	if err != nil {
+		return
+	}
+	stmt.Params = p.params
+	return
+}
+
+// where parses an optional WHERE clause
+func (p *parser) where() (cond Expr, err error) {
+	if !p.accept("WHERE") {
+		return
+	}
+	return p.or()
+}
+
+// name parses the name of a table or a column
+func (p *parser) name() (name string, err error) {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		err = p.unexpected("a name")
+		return
+	}
+	p.next()
+	return t.text, nil
+}
+
+// columnName parses a column name, with dots separating the names of nested fields
+func (p *parser) columnName() (name string, err error) {
+	var segments []string
+	for {
+		var segment string
+		segment, err = p.name()
+		if err != nil {
+			return
+		}
+		segments = append(segments, segment)
+		if !p.accept(".") {
+			break
+		}
+	}
+	return strings.Join(segments, "."), nil
+}
+
+// or parses conditions combined by OR, which binds looser than AND
+func (p *parser) or() (cond Expr, err error) {
+	cond, err = p.and()
+	if err != nil {
+		return
+	}
+	for p.accept("OR") {
+		var right Expr
+		right, err = p.and()
+		if err != nil {
+			return
+		}
+		cond = BinaryExpr{Op: "OR", Left: cond, Right: right}
+	}
+	return
+}
+
+func (p *parser) and() (cond Expr, err error) {
+	cond, err = p.comparison()
+	if err != nil {
+		return
+	}
+	for p.accept("AND") {
+		var right Expr
+		right, err = p.comparison()
+		if err != nil {
+			return
+		}
+		cond = BinaryExpr{Op: "AND", Left: cond, Right: right}
+	}
+	return
+}
+
+func (p *parser) comparison() (cond Expr, err error) {
+	if p.accept("(") {
+		cond, err = p.or()
+		if err != nil {
+			return
+		}
+		err = p.expect(")")
+		return
+	}
+	left, err := p.operand()
+	if err != nil {
+		return
+	}
+	t := p.peek()
+	op := ""
+	if t.kind == tokenSymbol {
+		switch t.text {
+		case "=", "!=", "<", "<=", ">", ">=":
+			op = t.text
+		case "<>":
+			op = "!="
+		}
+	}
+	if op == "" {
+		err = p.unexpected("a comparison operator")
+		return
+	}
+	p.next()
+	right, err := p.operand()
+	if err != nil {
+		return
+	}
+	return BinaryExpr{Op: op, Left: left, Right: right}, nil
+}
+
+// operand parses a column, a constant or a placeholder
+func (p *parser) operand() (operand Expr, err error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenIdent:
+		var name string
+		name, err = p.columnName()
+		if err != nil {
+			return
+		}
+		return ColumnRef{Name: name}, nil
+	case t.kind == tokenString:
+		p.next()
+		return Literal{Value: t.text}, nil
+	case t.kind == tokenNumber:
+		p.next()
+		return number(t.text, false)
+	case t.kind == tokenSymbol && t.text == "-":
+		p.next()
+		t = p.peek()
+		if t.kind != tokenNumber {
+			err = p.unexpected("a number")
+			return
+		}
+		p.next()
+		return number(t.text, true)
+	case t.kind == tokenPlaceholder:
+		p.next()
+		operand = Placeholder{Index: p.params}
+		p.params++
+		return
+	case t.kind == tokenKeyword && (t.text == "TRUE" || t.text == "FALSE"):
+		p.next()
+		return Literal{Value: t.text == "TRUE"}, nil
+	case t.kind == tokenKeyword && t.text == "NULL":
+		p.next()
+		return Literal{Value: nil}, nil
+	default:
+		err = p.unexpected("a column or a value")
+		return
+	}
+}
+
+// number parses a number literal as an int64 if it's an integer, otherwise as a float64
+func number(text string, negative bool) (literal Literal, err error) {
+	if negative {
+		text = "-" + text
+	}
+	if i, intErr := strconv.ParseInt(text, 10, 64); intErr == nil {
+		return Literal{Value: i}, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid number %s", text)
+		return
+	}
+	return Literal{Value: f}, nil
+}
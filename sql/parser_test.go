@@ -0,0 +1,85 @@
+package sql
+
+import (
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSelect(t *testing.T) {
+	stmt, err := Parse(`select Name, info.pages AS pages FROM "books" WHERE Count >= 5 AND (Name = 'it''s' OR ? < Price);`)
+	assert.NoError(t, err)
+	assert.Equal(t, &Select{
+		Columns: []SelectColumn{{Name: "Name", Alias: "Name"}, {Name: "info.pages", Alias: "pages"}},
+		Table:   "books",
+		Where: BinaryExpr{
+			Op:   "AND",
+			Left: BinaryExpr{Op: ">=", Left: ColumnRef{Name: "Count"}, Right: Literal{Value: int64(5)}},
+			Right: BinaryExpr{
+				Op:    "OR",
+				Left:  BinaryExpr{Op: "=", Left: ColumnRef{Name: "Name"}, Right: Literal{Value: "it's"}},
+				Right: BinaryExpr{Op: "<", Left: Placeholder{Index: 0}, Right: ColumnRef{Name: "Price"}},
+			},
+		},
+		Params: 1,
+	}, stmt)
+
+	ex, err := Ex(stmt.(*Select).Where, []any{2.5})
+	assert.NoError(t, err)
+	assert.Equal(t, exp.AndEx{Exps: []exp.Ex{
+		exp.C("Count").Gte(5),
+		exp.OrEx{Exps: []exp.Ex{
+			exp.C("Name").Eq("it's"),
+			exp.C("Price").Gt(2.5),
+		}},
+	}}, ex)
+	_, err = Ex(stmt.(*Select).Where, nil)
+	assert.Error(t, err)
+}
+
+func TestParseInsertAndDelete(t *testing.T) {
+	stmt, err := Parse("INSERT INTO books (Name, Count, Price, Sold) VALUES ('a', -3, 1.5e2, TRUE), (?, ?, NULL, FALSE)")
+	assert.NoError(t, err)
+	assert.Equal(t, &Insert{
+		Table:   "books",
+		Columns: []string{"Name", "Count", "Price", "Sold"},
+		Rows: [][]Expr{
+			{Literal{Value: "a"}, Literal{Value: int64(-3)}, Literal{Value: 150.0}, Literal{Value: true}},
+			{Placeholder{Index: 0}, Placeholder{Index: 1}, Literal{Value: nil}, Literal{Value: false}},
+		},
+		Params: 2,
+	}, stmt)
+
+	stmt, err = Parse("DELETE FROM books")
+	assert.NoError(t, err)
+	assert.Equal(t, &Delete{Table: "books"}, stmt)
+	ex, err := Ex(stmt.(*Delete).Where, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, exp.AndEx{}, ex)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"UPDATE books SET Count = 1",
+		"SELECT FROM books",
+		"SELECT * FROM books WHERE",
+		"SELECT * FROM books WHERE Count",
+		"SELECT * FROM books WHERE Name = 'open",
+		"INSERT INTO books (Name) VALUES ('a', 'b')",
+		"DELETE FROM books extra",
+	} {
+		_, err := Parse(query)
+		assert.Error(t, err, query)
+	}
+	// comparisons need a column and a comparable value
+	for _, query := range []string{
+		"SELECT * FROM books WHERE 1 = 1",
+		"SELECT * FROM books WHERE Sold = TRUE",
+	} {
+		stmt, err := Parse(query)
+		assert.NoError(t, err)
+		_, err = Ex(stmt.(*Select).Where, nil)
+		assert.Error(t, err, query)
+	}
+}
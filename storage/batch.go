@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// pageFile is the storage a page is read from and written to
+type pageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+// fileWrite is a pending write into a file
+type fileWrite struct {
+	offset int64
+	data   []byte
+	// whether the file is truncated to offset instead of written
+	truncate bool
+}
+
+// shadowFile records writes into a file without touching the file itself.
+// Reads through a shadow file see the recorded writes on top of the file content
+type shadowFile struct {
+	file dataFile
+	// size of the file after the recorded writes, -1 if unknown yet
+	size   int64
+	writes []fileWrite
+}
+
+func newShadowFile(file dataFile) *shadowFile {
+	return &shadowFile{
+		file: file,
+		size: -1,
+	}
+}
+
+func (f *shadowFile) ReadAt(data []byte, offset int64) (n int, err error) {
+	size, err := f.Size()
+	if err != nil {
+		return
+	}
+	n, err = f.file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return
+	}
+	// bytes that are not in the file yet read as zeros
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	// apply the recorded writes in order
+	end := offset + int64(len(data))
+	for _, w := range f.writes {
+		if w.truncate {
+			// truncated bytes read as zeros if the file grows again
+			for i := maxInt64(w.offset, offset); i < end; i++ {
+				data[i-offset] = 0
+			}
+			continue
+		}
+		wEnd := w.offset + int64(len(w.data))
+		if wEnd <= offset || w.offset >= end {
+			continue
+		}
+		from := maxInt64(w.offset, offset)
+		to := minInt64(wEnd, end)
+		copy(data[from-offset:to-offset], w.data[from-w.offset:to-w.offset])
+	}
+	if end <= size {
+		return len(data), nil
+	}
+	if offset >= size {
+		return 0, io.EOF
+	}
+	return int(size - offset), io.EOF
+}
+
+func (f *shadowFile) WriteAt(data []byte, offset int64) (n int, err error) {
+	size, err := f.Size()
+	if err != nil {
+		return
+	}
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	f.writes = append(f.writes, fileWrite{offset: offset, data: copied})
+	f.size = maxInt64(size, offset+int64(len(data)))
+	return len(data), nil
+}
+
+// Truncate records a change of the file size
+func (f *shadowFile) Truncate(size int64) (err error) {
+	_, err = f.Size()
+	if err != nil {
+		return
+	}
+	f.writes = append(f.writes, fileWrite{offset: size, truncate: true})
+	f.size = size
+	return
+}
+
+// Size returns the size of the file as if the recorded writes had been applied
+func (f *shadowFile) Size() (size int64, err error) {
+	if f.size >= 0 {
+		return f.size, nil
+	}
+	f.size, err = f.file.Size()
+	if err != nil {
+		return
+	}
+	return f.size, nil
+}
+
+// Sync does nothing since the recorded writes are made durable by the batch commit
+func (f *shadowFile) Sync() error {
+	return nil
+}
+
+// pages returns the indexes of the pages touched by the recorded writes
+func (f *shadowFile) pages() (pages []int64, err error) {
+	touched := map[int64]struct{}{}
+	for _, w := range f.writes {
+		end := w.offset + int64(len(w.data))
+		if w.truncate {
+			// every page after the offset is gone
+			end, err = f.file.Size()
+			if err != nil {
+				return
+			}
+		}
+		for i := w.offset / pageSize; i*pageSize < end; i++ {
+			touched[i] = struct{}{}
+		}
+	}
+	for i := range touched {
+		pages = append(pages, i)
+	}
+	return
+}
+
+// apply writes the recorded writes into the file
+func (f *shadowFile) apply() (err error) {
+	for _, w := range f.writes {
+		if w.truncate {
+			err = f.file.Truncate(w.offset)
+			if err != nil {
+				err = fmt.Errorf("failed to truncate file %s: %w", f.file.Name(), err)
+				return
+			}
+			continue
+		}
+		_, err = f.file.WriteAt(w.data, w.offset)
+		if err != nil {
+			err = fmt.Errorf("failed to write into file %s: %w", f.file.Name(), err)
+			return
+		}
+	}
+	return
+}
+
+// Batch collects the writes of one operation, which can span multiple files and tables,
+// so that they can be logged before any of them is applied.
+// Reads within a batch see its own pending writes
+type Batch struct {
+	files []*shadowFile
+	// tables written, whose pages are latched when the batch is applied
+	tables []*Table
+	// transaction making the writes, nil if they are not versioned
+	tx *Tx
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// NewTxBatch creates a batch whose tuple insertions and deletions are made by a transaction,
+// so that they are only visible to snapshots that see the transaction
+func NewTxBatch(tx *Tx) *Batch {
+	return &Batch{tx: tx}
+}
+
+// file returns the shadow of a file within the batch
+func (b *Batch) file(file dataFile) *shadowFile {
+	for _, f := range b.files {
+		if f.file == file {
+			return f
+		}
+	}
+	f := newShadowFile(file)
+	b.files = append(b.files, f)
+	return f
+}
+
+// touch records that a table is written in the batch
+func (b *Batch) touch(t *Table) {
+	for _, table := range b.tables {
+		if table == t {
+			return
+		}
+	}
+	b.tables = append(b.tables, t)
+}
+
+func (b *Batch) empty() bool {
+	for _, f := range b.files {
+		if len(f.writes) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// apply writes all recorded writes into their files
+// the pages written are latched meanwhile, so that readers never see a partial write
+func (b *Batch) apply() (err error) {
+	unlock, err := b.latch()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	for _, f := range b.files {
+		err = f.apply()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// latch locks the latches of all table pages written in the batch
+// returns a function unlocking them
+func (b *Batch) latch() (unlock func(), err error) {
+	var unlocks []func()
+	unlock = func() {
+		for _, u := range unlocks {
+			u()
+		}
+	}
+	for _, t := range b.tables {
+		var pages []int64
+		pages, err = b.file(t.data).pages()
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, t.latches.lockAll(pages))
+	}
+	return
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
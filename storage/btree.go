@@ -0,0 +1,570 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	// keys longer than this are truncated to their prefix before stored in a b+tree,
+	// so that every node can hold at least a handful of entries
+	MaxBTreeKeySize = 512
+	// the first page of a b+tree file holds the meta data of the tree
+	btreeMetaPage = 0
+	// size of the kind + count + next/first child prefix of a node
+	btreeNodeHeaderSize = 7
+	// size of the location part of a node entry
+	btreeLocationSize = 12
+)
+
+const (
+	btreeLeaf     byte = 1
+	btreeInternal byte = 2
+)
+
+var (
+	btreeMagic = []byte("GLBT")
+)
+
+// BTreeIterator is a callback for each entry found in a b+tree
+type BTreeIterator func(key []byte, loc TupleLocation) (cont bool, err error)
+
+// BTree is a B+tree stored in pages of a file, mapping keys to tuple locations.
+// Entries are ordered by key and then by location, so one key can map to multiple tuples.
+//
+// Trees are not covered by the write-ahead log. Instead, a tree is marked dirty on disk
+// when opened and clean when closed, so that a tree left dirty by a crash can be detected
+// and rebuilt from its table.
+//
+// A tree is safe for concurrent use, with writers excluding each other and readers.
+type BTree struct {
+	file      *os.File
+	root      uint32
+	pageCount uint32
+	// whether the tree was closed properly last time
+	clean bool
+	mu    sync.RWMutex
+}
+
+// btreeEntry is an entry in a b+tree node
+// in internal nodes, entries are the separators between children
+type btreeEntry struct {
+	key []byte
+	loc TupleLocation
+}
+
+type btreeNode struct {
+	id   uint32
+	leaf bool
+	// entries of a leaf, or separators of an internal node
+	entries []btreeEntry
+	// children of an internal node, one more than separators
+	// children[i] holds entries in [entries[i-1], entries[i])
+	children []uint32
+	// the next leaf, 0 for the last one
+	next uint32
+}
+
+// OpenBTree opens a b+tree stored in a file, initializing an empty one for an empty file
+func OpenBTree(file *os.File) (tree *BTree, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		err = fmt.Errorf("failed to stat b+tree file: %w", err)
+		return
+	}
+	tree = &BTree{file: file}
+	if info.Size() == 0 {
+		err = tree.init()
+		if err != nil {
+			return
+		}
+		tree.clean = true
+	} else {
+		err = tree.readMeta()
+		if err != nil {
+			return
+		}
+	}
+	// stay dirty on disk until closed
+	err = tree.writeMeta(true)
+	if err != nil {
+		return
+	}
+	err = file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync b+tree file: %w", err)
+		return
+	}
+	return
+}
+
+// Clean tells whether the tree was closed properly last time it was used
+// a tree that is not clean might not reflect its table and needs to be rebuilt
+func (t *BTree) Clean() bool {
+	return t.clean
+}
+
+// Close flushes the tree and marks it clean on disk
+func (t *BTree) Close() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync b+tree file: %w", err)
+		return
+	}
+	err = t.writeMeta(false)
+	if err != nil {
+		return
+	}
+	err = t.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync b+tree file: %w", err)
+		return
+	}
+	return
+}
+
+// Clear removes all entries in the tree
+func (t *BTree) Clear() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.file.Truncate(0)
+	if err != nil {
+		err = fmt.Errorf("failed to truncate b+tree file: %w", err)
+		return
+	}
+	err = t.init()
+	if err != nil {
+		return
+	}
+	return t.writeMeta(true)
+}
+
+// Insert adds an entry to the tree, doing nothing if the entry exists
+func (t *BTree) Insert(key []byte, loc TupleLocation) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry := btreeEntry{key: truncateBTreeKey(key), loc: loc}
+	separator, right, err := t.insert(t.root, entry)
+	if err != nil {
+		return
+	}
+	if separator == nil {
+		return
+	}
+	// the root is split, grow the tree by one level
+	root := &btreeNode{
+		id:       t.allocate(),
+		leaf:     false,
+		entries:  []btreeEntry{*separator},
+		children: []uint32{t.root, right},
+	}
+	err = t.writeNode(root)
+	if err != nil {
+		return
+	}
+	t.root = root.id
+	return t.writeMeta(true)
+}
+
+// Delete removes an entry from the tree
+// returns whether the entry is found
+// Nodes are never merged, an emptied leaf stays in the tree until it is cleared.
+func (t *BTree) Delete(key []byte, loc TupleLocation) (found bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry := btreeEntry{key: truncateBTreeKey(key), loc: loc}
+	node, err := t.findLeaf(entry)
+	if err != nil {
+		return
+	}
+	i := node.search(entry)
+	if i == len(node.entries) || compareBTreeEntries(node.entries[i], entry) != 0 {
+		return false, nil
+	}
+	node.entries = append(node.entries[:i], node.entries[i+1:]...)
+	err = t.writeNode(node)
+	if err != nil {
+		return
+	}
+	return true, nil
+}
+
+// Range iterates over entries with keys in [lo, hi] in order
+// a nil lo or hi stands for no bound on that side
+// since long keys are truncated, the iterated keys can be prefixes of the inserted ones.
+// The tree is not locked while calling |iter|, so entries changed meanwhile may or may not be seen
+func (t *BTree) Range(lo []byte, hi []byte, iter BTreeIterator) (err error) {
+	if lo != nil {
+		lo = truncateBTreeKey(lo)
+	}
+	// the lowest entry with key lo
+	return t.rangeFrom(btreeEntry{key: lo, loc: TupleLocation{Page: -1}}, true, hi, iter)
+}
+
+// RangeAfter iterates over entries after the one of |key| and |loc|, with keys up to hi, in order
+// so that a range can be walked in parts, each resuming from the last entry of the previous one
+func (t *BTree) RangeAfter(key []byte, loc TupleLocation, hi []byte, iter BTreeIterator) (err error) {
+	return t.rangeFrom(btreeEntry{key: truncateBTreeKey(key), loc: loc}, false, hi, iter)
+}
+
+// rangeFrom iterates over entries from an entry, with keys up to hi, in order
+func (t *BTree) rangeFrom(from btreeEntry, inclusive bool, hi []byte, iter BTreeIterator) (err error) {
+	if hi != nil {
+		hi = truncateBTreeKey(hi)
+	}
+	for {
+		var entries []btreeEntry
+		var done bool
+		entries, done, err = t.collectLeaf(from, inclusive, hi)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			var cont bool
+			cont, err = iter(entry.key, entry.loc)
+			if err != nil || !cont {
+				return
+			}
+		}
+		if done {
+			return nil
+		}
+		// leaves can be split meanwhile, so the next leaf is searched from the last entry seen
+		from = entries[len(entries)-1]
+		inclusive = false
+	}
+}
+
+// collectLeaf collects the entries up to |hi| of the first leaf holding entries after |from|
+// returns whether there are no more entries to collect after them
+func (t *BTree) collectLeaf(from btreeEntry, inclusive bool, hi []byte) (entries []btreeEntry, done bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	node, err := t.findLeaf(from)
+	if err != nil {
+		return
+	}
+	i := node.search(from)
+	if !inclusive && i < len(node.entries) && compareBTreeEntries(node.entries[i], from) == 0 {
+		i++
+	}
+	for {
+		for ; i < len(node.entries); i++ {
+			entry := node.entries[i]
+			if hi != nil && bytes.Compare(entry.key, hi) > 0 {
+				return entries, true, nil
+			}
+			entries = append(entries, entry)
+		}
+		if node.next == 0 {
+			return entries, true, nil
+		}
+		if len(entries) > 0 {
+			return entries, false, nil
+		}
+		// skip leaves emptied by deletions
+		node, err = t.readNode(node.next)
+		if err != nil {
+			return
+		}
+		i = 0
+	}
+}
+
+// insert an entry into the subtree rooted at a node
+// returns the separator and the new right node if the node is split
+func (t *BTree) insert(id uint32, entry btreeEntry) (separator *btreeEntry, right uint32, err error) {
+	node, err := t.readNode(id)
+	if err != nil {
+		return
+	}
+	if node.leaf {
+		i := node.search(entry)
+		if i < len(node.entries) && compareBTreeEntries(node.entries[i], entry) == 0 {
+			return
+		}
+		node.entries = insertAt(node.entries, i, entry)
+	} else {
+		i := node.childIndex(entry)
+		var childSeparator *btreeEntry
+		var childRight uint32
+		childSeparator, childRight, err = t.insert(node.children[i], entry)
+		if err != nil || childSeparator == nil {
+			return
+		}
+		node.entries = insertAt(node.entries, i, *childSeparator)
+		node.children = insertAt(node.children, i+1, childRight)
+	}
+
+	if node.size() <= pageSize {
+		err = t.writeNode(node)
+		return
+	}
+
+	// too large for one page, split into two halves
+	rightNode := &btreeNode{
+		id:   t.allocate(),
+		leaf: node.leaf,
+	}
+	mid := len(node.entries) / 2
+	if node.leaf {
+		rightNode.entries = append([]btreeEntry{}, node.entries[mid:]...)
+		rightNode.next = node.next
+		node.entries = node.entries[:mid]
+		node.next = rightNode.id
+		separator = &rightNode.entries[0]
+	} else {
+		// the middle separator moves up
+		separator = &btreeEntry{key: node.entries[mid].key, loc: node.entries[mid].loc}
+		rightNode.entries = append([]btreeEntry{}, node.entries[mid+1:]...)
+		rightNode.children = append([]uint32{}, node.children[mid+1:]...)
+		node.entries = node.entries[:mid]
+		node.children = node.children[:mid+1]
+	}
+	err = t.writeNode(rightNode)
+	if err != nil {
+		return
+	}
+	err = t.writeNode(node)
+	if err != nil {
+		return
+	}
+	err = t.writeMeta(true)
+	if err != nil {
+		return
+	}
+	right = rightNode.id
+	return
+}
+
+// find the leaf where an entry is or should be
+func (t *BTree) findLeaf(entry btreeEntry) (node *btreeNode, err error) {
+	node, err = t.readNode(t.root)
+	if err != nil {
+		return
+	}
+	for !node.leaf {
+		node, err = t.readNode(node.children[node.childIndex(entry)])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// allocate a new page at the end of the file
+func (t *BTree) allocate() (id uint32) {
+	id = t.pageCount
+	t.pageCount++
+	return
+}
+
+// init sets up an empty tree with one empty leaf as the root
+func (t *BTree) init() (err error) {
+	t.pageCount = btreeMetaPage + 1
+	root := &btreeNode{
+		id:   t.allocate(),
+		leaf: true,
+	}
+	t.root = root.id
+	err = t.writeNode(root)
+	if err != nil {
+		return
+	}
+	return t.writeMeta(false)
+}
+
+// meta page layout:
+// | magic (4) | root (4) | page count (4) | dirty (1) |
+func (t *BTree) writeMeta(dirty bool) (err error) {
+	buffer := make([]byte, 0, 13)
+	buffer = append(buffer, btreeMagic...)
+	buffer = append(buffer, uint32ToBytes(t.root)...)
+	buffer = append(buffer, uint32ToBytes(t.pageCount)...)
+	if dirty {
+		buffer = append(buffer, 1)
+	} else {
+		buffer = append(buffer, 0)
+	}
+	_, err = t.file.WriteAt(buffer, btreeMetaPage*pageSize)
+	if err != nil {
+		err = fmt.Errorf("failed to write b+tree meta: %w", err)
+		return
+	}
+	return
+}
+
+func (t *BTree) readMeta() (err error) {
+	buffer := make([]byte, 13)
+	_, err = t.file.ReadAt(buffer, btreeMetaPage*pageSize)
+	if err != nil {
+		err = fmt.Errorf("failed to read b+tree meta: %w", err)
+		return
+	}
+	if !bytes.Equal(buffer[0:4], btreeMagic) {
+		err = errors.New("not a b+tree file")
+		return
+	}
+	t.root = bytesToUint32(buffer[4:8])
+	t.pageCount = bytesToUint32(buffer[8:12])
+	t.clean = buffer[12] == 0
+	return
+}
+
+func (t *BTree) readNode(id uint32) (node *btreeNode, err error) {
+	buffer := make([]byte, pageSize)
+	_, err = t.file.ReadAt(buffer, int64(id)*pageSize)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to read b+tree node %d: %w", id, err)
+		return
+	}
+	node, err = decodeBTreeNode(id, buffer)
+	if err != nil {
+		err = fmt.Errorf("failed to decode b+tree node %d: %w", id, err)
+		return
+	}
+	return
+}
+
+func (t *BTree) writeNode(node *btreeNode) (err error) {
+	_, err = t.file.WriteAt(node.encode(), int64(node.id)*pageSize)
+	if err != nil {
+		err = fmt.Errorf("failed to write b+tree node %d: %w", node.id, err)
+		return
+	}
+	return
+}
+
+// search finds the index of the first entry not less than the given one
+func (n *btreeNode) search(entry btreeEntry) int {
+	return sort.Search(len(n.entries), func(i int) bool {
+		return compareBTreeEntries(n.entries[i], entry) >= 0
+	})
+}
+
+// childIndex finds the child of an internal node whose subtree covers an entry
+func (n *btreeNode) childIndex(entry btreeEntry) int {
+	return sort.Search(len(n.entries), func(i int) bool {
+		return compareBTreeEntries(entry, n.entries[i]) < 0
+	})
+}
+
+// size of the node when encoded
+func (n *btreeNode) size() int {
+	size := btreeNodeHeaderSize
+	for _, entry := range n.entries {
+		size += 2 + len(entry.key) + btreeLocationSize
+		if !n.leaf {
+			size += 4
+		}
+	}
+	return size
+}
+
+// node page layout:
+// | kind (1) | entry count (2) | next leaf or first child (4) | entries... |
+// where each entry is
+// | key length (2) | key | page (8) | offset (4) | child (4, internal nodes only) |
+func (n *btreeNode) encode() []byte {
+	buffer := make([]byte, 0, pageSize)
+	if n.leaf {
+		buffer = append(buffer, btreeLeaf)
+	} else {
+		buffer = append(buffer, btreeInternal)
+	}
+	buffer = append(buffer, uint16ToBytes(uint16(len(n.entries)))...)
+	if n.leaf {
+		buffer = append(buffer, uint32ToBytes(n.next)...)
+	} else {
+		buffer = append(buffer, uint32ToBytes(n.children[0])...)
+	}
+	for i, entry := range n.entries {
+		buffer = append(buffer, uint16ToBytes(uint16(len(entry.key)))...)
+		buffer = append(buffer, entry.key...)
+		buffer = append(buffer, uint64ToBytes(uint64(entry.loc.Page))...)
+		buffer = append(buffer, uint32ToBytes(entry.loc.Offset)...)
+		if !n.leaf {
+			buffer = append(buffer, uint32ToBytes(n.children[i+1])...)
+		}
+	}
+	return buffer
+}
+
+func decodeBTreeNode(id uint32, data []byte) (node *btreeNode, err error) {
+	node = &btreeNode{id: id}
+	r := byteReader{data: data}
+	kind := r.bytes(1)
+	count := int(r.uint16())
+	first := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	switch kind[0] {
+	case btreeLeaf:
+		node.leaf = true
+		node.next = first
+	case btreeInternal:
+		node.children = []uint32{first}
+	default:
+		return nil, fmt.Errorf("invalid b+tree node kind %d", kind[0])
+	}
+	node.entries = make([]btreeEntry, 0, count)
+	for i := 0; i < count; i++ {
+		key := r.bytes(int(r.uint16()))
+		page := int64(r.uint64())
+		offset := r.uint32()
+		node.entries = append(node.entries, btreeEntry{
+			key: key,
+			loc: TupleLocation{Page: page, Offset: offset},
+		})
+		if !node.leaf {
+			node.children = append(node.children, r.uint32())
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return
+}
+
+// compare entries by key and then by location
+func compareBTreeEntries(a btreeEntry, b btreeEntry) int {
+	if c := bytes.Compare(a.key, b.key); c != 0 {
+		return c
+	}
+	if a.loc.Page != b.loc.Page {
+		if a.loc.Page < b.loc.Page {
+			return -1
+		}
+		return 1
+	}
+	if a.loc.Offset != b.loc.Offset {
+		if a.loc.Offset < b.loc.Offset {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func truncateBTreeKey(key []byte) []byte {
+	if len(key) > MaxBTreeKeySize {
+		return key[:MaxBTreeKeySize]
+	}
+	return key
+}
+
+func insertAt[T any](items []T, i int, item T) []T {
+	var zero T
+	items = append(items, zero)
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func rangeBTree(t *testing.T, tree *BTree, lo []byte, hi []byte) (keys []string, locations []TupleLocation) {
+	err := tree.Range(lo, hi, func(key []byte, loc TupleLocation) (bool, error) {
+		keys = append(keys, string(key))
+		locations = append(locations, loc)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return
+}
+
+func TestBTreeInsertAndRange(t *testing.T) {
+	file, err := ioutil.TempFile("", "gled_ut_btree_*")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tree, err := OpenBTree(file)
+	assert.NoError(t, err)
+	assert.True(t, tree.Clean())
+
+	// enough entries to split nodes over multiple levels
+	count := 20000
+	for i := count - 1; i >= 0; i-- {
+		key := []byte(fmt.Sprintf("key-%06d", i))
+		assert.NoError(t, tree.Insert(key, TupleLocation{Page: int64(i / 100), Offset: uint32(i % 100)}))
+	}
+	// duplicated keys are ordered by locations
+	assert.NoError(t, tree.Insert([]byte("key-000010"), TupleLocation{Page: 1000}))
+	assert.NoError(t, tree.Insert([]byte("key-000010"), TupleLocation{Page: 0, Offset: 0}))
+
+	keys, _ := rangeBTree(t, tree, nil, nil)
+	assert.Equal(t, count+2, len(keys))
+	for i := 1; i < len(keys); i++ {
+		assert.LessOrEqual(t, keys[i-1], keys[i])
+	}
+
+	keys, locations := rangeBTree(t, tree, []byte("key-000009"), []byte("key-000011"))
+	assert.Equal(t, []string{"key-000009", "key-000010", "key-000010", "key-000010", "key-000011"}, keys)
+	assert.Equal(t, []TupleLocation{
+		{Page: 0, Offset: 9},
+		{Page: 0, Offset: 0},
+		{Page: 0, Offset: 10},
+		{Page: 1000, Offset: 0},
+		{Page: 0, Offset: 11},
+	}, locations)
+	// or resumed after an entry
+	locations = nil
+	err = tree.RangeAfter([]byte("key-000010"), TupleLocation{Page: 0, Offset: 0}, []byte("key-000011"), func(key []byte, loc TupleLocation) (bool, error) {
+		locations = append(locations, loc)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []TupleLocation{{Page: 0, Offset: 10}, {Page: 1000, Offset: 0}, {Page: 0, Offset: 11}}, locations)
+
+	found, err := tree.Delete([]byte("key-000010"), TupleLocation{Page: 0, Offset: 10})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = tree.Delete([]byte("key-000010"), TupleLocation{Page: 0, Offset: 10})
+	assert.NoError(t, err)
+	assert.False(t, found)
+	keys, _ = rangeBTree(t, tree, []byte("key-000010"), []byte("key-000010"))
+	assert.Equal(t, []string{"key-000010", "key-000010"}, keys)
+
+	// not closed, thus not clean when reopened
+	tree, err = OpenBTree(file)
+	assert.NoError(t, err)
+	assert.False(t, tree.Clean())
+	keys, _ = rangeBTree(t, tree, []byte("key-019990"), nil)
+	assert.Equal(t, 10, len(keys))
+
+	assert.NoError(t, tree.Close())
+	tree, err = OpenBTree(file)
+	assert.NoError(t, err)
+	assert.True(t, tree.Clean())
+
+	assert.NoError(t, tree.Clear())
+	keys, _ = rangeBTree(t, tree, nil, nil)
+	assert.Empty(t, keys)
+}
+
+func TestBTreeLongKeys(t *testing.T) {
+	file, err := ioutil.TempFile("", "gled_ut_btree_*")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tree, err := OpenBTree(file)
+	assert.NoError(t, err)
+
+	prefix := make([]byte, MaxBTreeKeySize)
+	for i := range prefix {
+		prefix[i] = 'a'
+	}
+	for i := 0; i < 100; i++ {
+		key := append(append([]byte{}, prefix...), []byte(fmt.Sprintf("%d", i))...)
+		assert.NoError(t, tree.Insert(key, TupleLocation{Offset: uint32(i)}))
+	}
+	// long keys are stored by their prefixes
+	keys, locations := rangeBTree(t, tree, append(prefix, 'x'), nil)
+	assert.Equal(t, 100, len(keys))
+	assert.Equal(t, string(prefix), keys[0])
+	assert.Equal(t, TupleLocation{Offset: 0}, locations[0])
+}
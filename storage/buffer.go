@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// dataFile is a file holding table data, read and written with positional I/O
+type dataFile interface {
+	pageFile
+	Truncate(size int64) error
+	Size() (int64, error)
+	Name() string
+}
+
+// osFile reads and writes a file directly
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (size int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		err = fmt.Errorf("failed to stat file %s: %w", f.Name(), err)
+		return
+	}
+	return info.Size(), nil
+}
+
+// BufferPoolStats are counters of buffer pool accesses
+type BufferPoolStats struct {
+	// page accesses served from memory
+	Hits uint64
+	// page accesses that had to read the file
+	Misses uint64
+	// pages evicted to make room for others
+	Evictions uint64
+}
+
+// BufferPool caches pages of files in memory, shared by all tables using it.
+// Pages are pinned while in use and evicted by the clock algorithm when the pool is full,
+// and modified pages are written back when evicted or when their file is flushed.
+// This is a simplified version of the postgres buffer manager
+// https://github.com/postgres/postgres/blob/27b77ecf9f4d5be211900eda54d8155ada50d696/src/backend/storage/buffer/README
+type BufferPool struct {
+	// max number of frames
+	capacity int
+	frames   []*frame
+	pages    map[frameKey]*frame
+	// position of the clock hand within frames
+	hand  int
+	stats BufferPoolStats
+	mu    sync.Mutex
+	// signaled when a frame is unpinned
+	unpinned *sync.Cond
+}
+
+// frameKey identifies a page of a file
+type frameKey struct {
+	file *pooledFile
+	page int64
+}
+
+// frame holds one page in memory
+type frame struct {
+	key  frameKey
+	data []byte
+	// number of users of the frame, a pinned frame is never evicted
+	pins int
+	// whether the page has been used since the clock hand passed
+	referenced bool
+	// whether the page is modified since loaded, guarded by the pool
+	dirty bool
+	// guards data while it is loaded, read or written
+	mu sync.RWMutex
+	// error loading the page from the file, if any
+	err error
+}
+
+// NewBufferPool creates a buffer pool holding at most |budget| bytes of pages
+// the pool holds at least one page whatever the budget is
+func NewBufferPool(budget int64) *BufferPool {
+	capacity := int(budget / pageSize)
+	if capacity < 1 {
+		capacity = 1
+	}
+	pool := &BufferPool{
+		capacity: capacity,
+		pages:    map[frameKey]*frame{},
+	}
+	pool.unpinned = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// Stats returns the access counters of the pool
+func (p *BufferPool) Stats() BufferPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Flush writes all modified pages back into their files and syncs them
+func (p *BufferPool) Flush() (err error) {
+	p.mu.Lock()
+	files := map[*pooledFile]struct{}{}
+	for key := range p.pages {
+		files[key.file] = struct{}{}
+	}
+	p.mu.Unlock()
+	for f := range files {
+		err = f.Sync()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pin finds the frame of a page, loading the page if it's not cached
+// the frame must be unpinned after use
+func (p *BufferPool) pin(key frameKey) (f *frame, err error) {
+	p.mu.Lock()
+	if f = p.pages[key]; f != nil {
+		p.stats.Hits++
+		f.pins++
+		f.referenced = true
+		p.mu.Unlock()
+		f.mu.RLock()
+		err = f.err
+		f.mu.RUnlock()
+		if err != nil {
+			p.unpin(f, false)
+			return nil, err
+		}
+		return
+	}
+	p.stats.Misses++
+	f, err = p.victim()
+	if err != nil {
+		p.mu.Unlock()
+		return
+	}
+	f.key = key
+	f.pins = 1
+	f.referenced = true
+	f.dirty = false
+	f.err = nil
+	p.pages[key] = f
+	// load the page without blocking the whole pool, users of the same page wait on the frame
+	f.mu.Lock()
+	p.mu.Unlock()
+	f.err = key.file.load(key.page, f.data)
+	err = f.err
+	f.mu.Unlock()
+	if err != nil {
+		p.mu.Lock()
+		if p.pages[key] == f {
+			delete(p.pages, key)
+		}
+		p.mu.Unlock()
+		p.unpin(f, false)
+		return nil, err
+	}
+	return
+}
+
+// unpin releases a frame, marking it dirty if its page is modified
+func (p *BufferPool) unpin(f *frame, dirty bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dirty {
+		f.dirty = true
+	}
+	f.pins--
+	if f.pins == 0 {
+		p.unpinned.Signal()
+	}
+}
+
+// victim finds a frame to hold a new page, evicting a cached page if the pool is full
+// must be called with the pool locked
+func (p *BufferPool) victim() (f *frame, err error) {
+	if len(p.frames) < p.capacity {
+		f = &frame{data: make([]byte, pageSize)}
+		p.frames = append(p.frames, f)
+		return
+	}
+	for {
+		// two rounds of the clock hand clear all reference bits,
+		// so an unpinned frame is found by then if there's any
+		for i := 0; i < 2*len(p.frames); i++ {
+			candidate := p.frames[p.hand]
+			p.hand = (p.hand + 1) % len(p.frames)
+			if candidate.pins > 0 {
+				continue
+			}
+			if candidate.referenced {
+				candidate.referenced = false
+				continue
+			}
+			if p.pages[candidate.key] == candidate {
+				if candidate.dirty {
+					err = candidate.key.file.writeBack(candidate.key.page, candidate.data)
+					if err != nil {
+						err = fmt.Errorf("failed to write back evicted page: %w", err)
+						return
+					}
+				}
+				delete(p.pages, candidate.key)
+				p.stats.Evictions++
+			}
+			return candidate, nil
+		}
+		// all frames are in use, wait for one to be released
+		p.unpinned.Wait()
+	}
+}
+
+// pooledFile reads and writes a file through a buffer pool
+// the size of the file includes the pages not written back yet
+type pooledFile struct {
+	file *os.File
+	pool *BufferPool
+	// accessed atomically, since pages are written back on eviction by other files
+	size int64
+	// held for reading by reads, and for writing by writes, truncation and syncing
+	mu sync.RWMutex
+}
+
+func newPooledFile(file *os.File, pool *BufferPool) (f *pooledFile, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		err = fmt.Errorf("failed to stat file %s: %w", file.Name(), err)
+		return
+	}
+	f = &pooledFile{
+		file: file,
+		pool: pool,
+		size: info.Size(),
+	}
+	return
+}
+
+func (f *pooledFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *pooledFile) Size() (int64, error) {
+	return atomic.LoadInt64(&f.size), nil
+}
+
+func (f *pooledFile) ReadAt(data []byte, offset int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	size := atomic.LoadInt64(&f.size)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	end := minInt64(offset+int64(len(data)), size)
+	for pos := offset; pos < end; {
+		page := pos / pageSize
+		to := minInt64((page+1)*pageSize, end)
+		var fr *frame
+		fr, err = f.pool.pin(frameKey{file: f, page: page})
+		if err != nil {
+			return
+		}
+		fr.mu.RLock()
+		copy(data[pos-offset:to-offset], fr.data[pos-page*pageSize:to-page*pageSize])
+		fr.mu.RUnlock()
+		f.pool.unpin(fr, false)
+		pos = to
+	}
+	n = int(end - offset)
+	if n < len(data) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *pooledFile) WriteAt(data []byte, offset int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := offset + int64(len(data))
+	for pos := offset; pos < end; {
+		page := pos / pageSize
+		to := minInt64((page+1)*pageSize, end)
+		var fr *frame
+		fr, err = f.pool.pin(frameKey{file: f, page: page})
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		copy(fr.data[pos-page*pageSize:to-page*pageSize], data[pos-offset:to-offset])
+		fr.mu.Unlock()
+		f.pool.unpin(fr, true)
+		pos = to
+	}
+	atomic.StoreInt64(&f.size, maxInt64(atomic.LoadInt64(&f.size), end))
+	return len(data), nil
+}
+
+// Truncate changes the size of the file, dropping the cached pages beyond it
+func (f *pooledFile) Truncate(size int64) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pool := f.pool
+	pool.mu.Lock()
+	for key, fr := range pool.pages {
+		if key.file != f || key.page*pageSize < size {
+			continue
+		}
+		delete(pool.pages, key)
+		fr.dirty = false
+	}
+	// bytes cut off from the last page read as zeros if the file grows again
+	partial := pool.pages[frameKey{file: f, page: size / pageSize}]
+	if partial != nil {
+		partial.mu.Lock()
+		for i := size % pageSize; i < pageSize; i++ {
+			partial.data[i] = 0
+		}
+		partial.mu.Unlock()
+	}
+	// changed along with the pages, so that pages evicted later are written back up to the new size
+	atomic.StoreInt64(&f.size, size)
+	pool.mu.Unlock()
+	err = f.file.Truncate(size)
+	if err != nil {
+		err = fmt.Errorf("failed to truncate file %s: %w", f.file.Name(), err)
+		return
+	}
+	return
+}
+
+// Sync writes the modified pages of the file back and syncs the file
+func (f *pooledFile) Sync() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pool := f.pool
+	pool.mu.Lock()
+	for key, fr := range pool.pages {
+		if key.file != f || !fr.dirty {
+			continue
+		}
+		err = f.writeBack(key.page, fr.data)
+		if err != nil {
+			pool.mu.Unlock()
+			return
+		}
+		fr.dirty = false
+	}
+	pool.mu.Unlock()
+	err = f.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync file %s: %w", f.file.Name(), err)
+		return
+	}
+	return
+}
+
+// release syncs the file and drops all its pages from the pool
+// the file must not be used through the pool afterwards
+func (f *pooledFile) release() (err error) {
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	pool := f.pool
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for key := range pool.pages {
+		if key.file == f {
+			delete(pool.pages, key)
+		}
+	}
+	return
+}
+
+// load reads a page from the file, bytes beyond the end of the file read as zeros
+func (f *pooledFile) load(page int64, data []byte) (err error) {
+	read, err := f.file.ReadAt(data, page*pageSize)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to read page %d of %s: %w", page, f.file.Name(), err)
+		return
+	}
+	for i := read; i < len(data); i++ {
+		data[i] = 0
+	}
+	return nil
+}
+
+// writeBack writes a page into the file, up to the size of the file
+func (f *pooledFile) writeBack(page int64, data []byte) (err error) {
+	end := minInt64((page+1)*pageSize, atomic.LoadInt64(&f.size))
+	if end <= page*pageSize {
+		return
+	}
+	_, err = f.file.WriteAt(data[:end-page*pageSize], page*pageSize)
+	if err != nil {
+		err = fmt.Errorf("failed to write page %d of %s: %w", page, f.file.Name(), err)
+		return
+	}
+	return
+}
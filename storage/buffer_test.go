@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openPooledTable(t *testing.T, dir string, pool *BufferPool) (*Table, *Wal) {
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	data, err := os.OpenFile(filepath.Join(dir, "tbl.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	fsm, err := os.OpenFile(filepath.Join(dir, "tbl.fsm.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	table, err := OpenTable(data, fsm, TableOptions{Wal: wal, Pool: pool})
+	assert.NoError(t, err)
+	return table, wal
+}
+
+func TestBufferPoolHitsAndEviction(t *testing.T) {
+	dir := t.TempDir()
+	// room for 2 pages only
+	pool := NewBufferPool(2 * pageSize)
+	table, wal := openPooledTable(t, dir, pool)
+
+	tuple := Tuple(fmt.Sprintf("%0100d", 0))
+	for i := 0; i < 300; i++ {
+		_, err := table.Add(tuple)
+		assert.NoError(t, err)
+	}
+	pageCount, err := table.countPages()
+	assert.NoError(t, err)
+	assert.Greater(t, pageCount, int64(2))
+	assert.Greater(t, pool.Stats().Evictions, uint64(0))
+
+	// repeated reads of a cached page hit the pool
+	before := pool.Stats()
+	for i := 0; i < 10; i++ {
+		_, err = table.Get(TupleLocation{Page: pageCount - 1, Offset: 0})
+		assert.NoError(t, err)
+	}
+	after := pool.Stats()
+	assert.Equal(t, before.Misses, after.Misses)
+	assert.Greater(t, after.Hits, before.Hits)
+
+	// all pages are written back by closing
+	assert.Equal(t, 300, len(scanTable(t, table)))
+	assert.NoError(t, table.Close())
+	assert.NoError(t, wal.Close())
+	info, err := table.Data.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, pageCount*pageSize, info.Size())
+	assert.NoError(t, table.Data.Close())
+	assert.NoError(t, table.Fsm.Close())
+
+	wal, err = OpenWal(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+	table = openWalTable(t, dir, wal)
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+	tuples := scanTable(t, table)
+	assert.Equal(t, 300, len(tuples))
+	for _, tp := range tuples {
+		assert.Equal(t, tuple, tp)
+	}
+}
+
+func TestBufferPoolTruncate(t *testing.T) {
+	dir := t.TempDir()
+	table, wal := openPooledTable(t, dir, NewBufferPool(4*pageSize))
+	defer wal.Close()
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+
+	var locations []TupleLocation
+	tuple := Tuple(fmt.Sprintf("%0100d", 0))
+	for i := 0; i < 300; i++ {
+		loc, err := table.Add(tuple)
+		assert.NoError(t, err)
+		locations = append(locations, loc)
+	}
+	for _, loc := range locations[:250] {
+		assert.NoError(t, table.Delete(loc))
+	}
+	assert.NoError(t, table.VacuumFull())
+	assert.NoError(t, table.Flush())
+	info, err := table.Data.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, pageSize, info.Size())
+	info, err = table.Fsm.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, info.Size())
+	assert.Equal(t, 50, len(scanTable(t, table)))
+}
+
+func TestBufferPoolConcurrentAccess(t *testing.T) {
+	// a pool much smaller than the table keeps evicting pages
+	table, wal := openPooledTable(t, t.TempDir(), NewBufferPool(2*pageSize))
+	defer wal.Close()
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := table.Add(Tuple(fmt.Sprintf("tuple-%d-%0100d", w, i)))
+				assert.NoError(t, err)
+			}
+		}(w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, table.Scan(func(tuple Tuple, loc TupleLocation) (bool, error) {
+					return true, nil
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 400, len(scanTable(t, table)))
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// number of latches shared by the pages of a table, bounding the memory taken however many pages there are
+	pageLatchStripes = 128
+)
+
+// pageLatches are the read/write latches of the pages in a table.
+// Readers hold the latch of a page while reading it, and batches hold the latches
+// of the pages they write while being applied, so that a page is never seen half written.
+// This is a simplified version of the buffer content locks of postgres
+// https://github.com/postgres/postgres/blob/27b77ecf9f4d5be211900eda54d8155ada50d696/src/backend/storage/buffer/README
+// Pages share latches by the remainders of their indexes, so a latch may cover pages other than the one latched
+type pageLatches struct {
+	latches [pageLatchStripes]sync.RWMutex
+}
+
+func newPageLatches() *pageLatches {
+	return &pageLatches{}
+}
+
+// stripe of the latch of a page
+func stripe(idx int64) int {
+	return int(uint64(idx) % pageLatchStripes)
+}
+
+// get the latch of a page
+func (l *pageLatches) get(idx int64) *sync.RWMutex {
+	return &l.latches[stripe(idx)]
+}
+
+// lockAll locks the latches of pages in ascending order of their stripes, each one once
+// returns a function unlocking them
+func (l *pageLatches) lockAll(pages []int64) (unlock func()) {
+	var stripes []int
+	seen := map[int]bool{}
+	for _, idx := range pages {
+		s := stripe(idx)
+		if !seen[s] {
+			seen[s] = true
+			stripes = append(stripes, s)
+		}
+	}
+	sort.Ints(stripes)
+	for _, s := range stripes {
+		l.latches[s].Lock()
+	}
+	return func() {
+		for _, s := range stripes {
+			l.latches[s].Unlock()
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPageLatches(t *testing.T) {
+	l := newPageLatches()
+	// pages sharing a latch are locked once
+	unlock := l.lockAll([]int64{pageLatchStripes + 1, 1, 0, 2 * pageLatchStripes})
+	assert.Same(t, l.get(1), l.get(pageLatchStripes+1))
+	assert.False(t, l.get(1).TryRLock())
+	assert.False(t, l.get(0).TryRLock())
+	assert.True(t, l.get(2).TryRLock())
+	l.get(2).RUnlock()
+	unlock()
+	assert.True(t, l.get(1).TryLock())
+	l.get(1).Unlock()
+	assert.True(t, l.get(0).TryLock())
+	l.get(0).Unlock()
+}
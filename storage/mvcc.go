@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// name of the file persisting transaction ids within a db directory
+	xidFileName = "gled.xid"
+	// transaction ids are reserved on disk in chunks of this size,
+	// so that the id file is not synced for every transaction
+	xidReserveSize = 1024
+	// size of the header at the beginning of every tuple
+	tupleHeaderSize = 25
+)
+
+// flags in tuple headers
+const (
+	// the tuple data is a stub pointing to the chunks in the overflow file
+	tupleExternal byte = 1 << iota
+	// the tuple data is compressed
+	tupleCompressed
+	// the tuple is updated, with its next version at the location in the header
+	tupleUpdated
+	// the tuple is a newer version of another one, reached only through the update chain
+	// from the location of the first version
+	tupleHeapOnly
+	// the tuple data is removed, leaving the header only to redirect to the next version
+	tupleRedirect
+)
+
+var (
+	// ErrWriteConflict is returned when deleting or updating a tuple that is deleted or updated
+	// by a transaction committed after the snapshot of the writing transaction is taken
+	ErrWriteConflict = errors.New("tuple concurrently changed by another transaction")
+)
+
+// Xid identifies a transaction
+// ids are assigned in ascending order, 0 is never assigned to a transaction
+type Xid uint64
+
+// tupleHeader is stored at the beginning of every tuple, recording the transactions
+// that created and deleted the tuple, so that every transaction sees the tuples that
+// were there when its snapshot was taken. This is a much simplified version of
+// https://github.com/postgres/postgres/blob/27b77ecf9f4d5be211900eda54d8155ada50d696/src/include/access/htup_details.h#L152
+type tupleHeader struct {
+	// the transaction creating the tuple, 0 for tuples visible to everyone
+	xmin Xid
+	// the transaction deleting the tuple, 0 if not deleted
+	xmax Xid
+	// how the tuple data is stored
+	flags byte
+	// location of the next version if the tuple is updated
+	next TupleLocation
+}
+
+func (h *tupleHeader) toBytes() []byte {
+	data := make([]byte, 0, tupleHeaderSize)
+	data = append(data, uint64ToBytes(uint64(h.xmin))...)
+	data = append(data, uint64ToBytes(uint64(h.xmax))...)
+	data = append(data, h.flags)
+	data = append(data, uint32ToBytes(uint32(h.next.Page))...)
+	data = append(data, uint32ToBytes(h.next.Offset)...)
+	return data
+}
+
+// split a stored tuple into its header and the data
+func decodeTuple(stored Tuple) (header tupleHeader, data Tuple, err error) {
+	if len(stored) < tupleHeaderSize {
+		err = fmt.Errorf("tuple too short for a header: %d", len(stored))
+		return
+	}
+	header.xmin = Xid(endian.Uint64(stored[0:8]))
+	header.xmax = Xid(endian.Uint64(stored[8:16]))
+	header.flags = stored[16]
+	header.next = TupleLocation{
+		Page:   int64(endian.Uint32(stored[17:21])),
+		Offset: endian.Uint32(stored[21:25]),
+	}
+	data = stored[tupleHeaderSize:]
+	return
+}
+
+// Snapshot is the set of transactions whose changes are visible
+type Snapshot struct {
+	// all transactions before it are finished when the snapshot is taken
+	xmin Xid
+	// the first transaction not started yet when the snapshot is taken
+	xmax Xid
+	// transactions not finished yet when the snapshot is taken
+	active map[Xid]struct{}
+}
+
+// sees tells whether changes made by a transaction are visible in the snapshot
+func (s *Snapshot) sees(xid Xid) bool {
+	if xid >= s.xmax {
+		return false
+	}
+	_, active := s.active[xid]
+	return !active
+}
+
+// visible tells whether a tuple is visible in the snapshot
+// a nil snapshot sees every tuple stored
+func (s *Snapshot) visible(header tupleHeader) bool {
+	if s == nil {
+		return true
+	}
+	if header.xmin != 0 && !s.sees(header.xmin) {
+		return false
+	}
+	return header.xmax == 0 || !s.sees(header.xmax)
+}
+
+// Tx is a transaction making versioned changes to tables
+type Tx struct {
+	xid      Xid
+	snapshot *Snapshot
+	manager  *TxManager
+}
+
+// Xid returns the id of the transaction
+func (tx *Tx) Xid() Xid {
+	return tx.xid
+}
+
+// Snapshot returns the snapshot taken when the transaction began
+func (tx *Tx) Snapshot() *Snapshot {
+	return tx.snapshot
+}
+
+// Finish ends the transaction, after which its changes are visible to new snapshots
+// changes must be committed before the transaction is finished
+func (tx *Tx) Finish() {
+	tx.manager.finish(tx)
+}
+
+// TxManager assigns ids to transactions and keeps track of running ones
+// so that snapshots can be taken
+type TxManager struct {
+	file *os.File
+	// the id to assign to the next transaction
+	next Xid
+	// ids below this are reserved on disk
+	reserved Xid
+	active   map[Xid]struct{}
+	// snapshots in use, either by transactions or scans
+	snapshots map[*Snapshot]struct{}
+	mu        sync.Mutex
+}
+
+// OpenTxManager opens the transaction manager of a directory
+// ids assigned before are never assigned again
+func OpenTxManager(dir string) (manager *TxManager, err error) {
+	xidPath := filepath.Join(dir, xidFileName)
+	file, err := os.OpenFile(xidPath, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		err = fmt.Errorf("failed to open xid file %s: %w", xidPath, err)
+		return
+	}
+	buffer := make([]byte, 8)
+	read, err := file.ReadAt(buffer, 0)
+	if err != nil && !(err == io.EOF && read == 0) {
+		_ = file.Close()
+		err = fmt.Errorf("failed to read xid file %s: %w", xidPath, err)
+		return
+	}
+	next := Xid(1)
+	if read == len(buffer) {
+		next = Xid(endian.Uint64(buffer))
+	}
+	manager = &TxManager{
+		file:      file,
+		next:      next,
+		reserved:  next,
+		active:    map[Xid]struct{}{},
+		snapshots: map[*Snapshot]struct{}{},
+	}
+	return manager, nil
+}
+
+// Close closes the transaction manager
+func (m *TxManager) Close() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = m.file.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to close xid file: %w", err)
+		return
+	}
+	return
+}
+
+// Begin starts a new transaction with a snapshot of the transactions finished so far
+func (m *TxManager) Begin() (tx *Tx, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.next >= m.reserved {
+		err = m.reserve()
+		if err != nil {
+			return
+		}
+	}
+	tx = &Tx{
+		xid:      m.next,
+		snapshot: m.takeSnapshot(),
+		manager:  m,
+	}
+	m.active[tx.xid] = struct{}{}
+	m.next++
+	return
+}
+
+// Snapshot takes a snapshot of the transactions finished so far
+// the snapshot must be released after use
+func (m *TxManager) Snapshot() *Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.takeSnapshot()
+}
+
+// Release releases a snapshot, so that tuples only visible to it can be vacuumed
+func (m *TxManager) Release(s *Snapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.snapshots, s)
+}
+
+// Horizon returns the transaction id below which all deletions are visible to everyone,
+// thus tuples deleted by these transactions can be removed
+func (m *TxManager) Horizon() Xid {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	horizon := m.next
+	for xid := range m.active {
+		if xid < horizon {
+			horizon = xid
+		}
+	}
+	for s := range m.snapshots {
+		if s.xmin < horizon {
+			horizon = s.xmin
+		}
+	}
+	return horizon
+}
+
+func (m *TxManager) takeSnapshot() *Snapshot {
+	s := &Snapshot{
+		xmin:   m.next,
+		xmax:   m.next,
+		active: make(map[Xid]struct{}, len(m.active)),
+	}
+	for xid := range m.active {
+		s.active[xid] = struct{}{}
+		if xid < s.xmin {
+			s.xmin = xid
+		}
+	}
+	m.snapshots[s] = struct{}{}
+	return s
+}
+
+func (m *TxManager) finish(tx *Tx) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.active, tx.xid)
+	delete(m.snapshots, tx.snapshot)
+}
+
+// reserve more ids on disk
+func (m *TxManager) reserve() (err error) {
+	reserved := m.next + xidReserveSize
+	_, err = m.file.WriteAt(uint64ToBytes(uint64(reserved)), 0)
+	if err != nil {
+		err = fmt.Errorf("failed to write xid file: %w", err)
+		return
+	}
+	err = m.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync xid file: %w", err)
+		return
+	}
+	m.reserved = reserved
+	return
+}
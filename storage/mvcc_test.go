@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openVersionedTable(t *testing.T, dir string) (*Table, *Wal, *TxManager) {
+	txm, err := OpenTxManager(dir)
+	assert.NoError(t, err)
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	data, err := os.OpenFile(filepath.Join(dir, "tbl.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	fsm, err := os.OpenFile(filepath.Join(dir, "tbl.fsm.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	table, err := OpenTable(data, fsm, TableOptions{Wal: wal, TxManager: txm})
+	assert.NoError(t, err)
+	return table, wal, txm
+}
+
+func TestSnapshotScan(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+
+	var locations []TupleLocation
+	for _, tuple := range []string{"a", "b", "c"} {
+		loc, err := table.Add(Tuple(tuple))
+		assert.NoError(t, err)
+		locations = append(locations, loc)
+	}
+
+	// changes made during a scan are not seen by it
+	var scanned []string
+	err := table.Scan(func(tuple Tuple, loc TupleLocation) (bool, error) {
+		if len(scanned) == 0 {
+			_, err := table.Add(Tuple("d"))
+			assert.NoError(t, err)
+			assert.NoError(t, table.Delete(locations[2]))
+		}
+		scanned = append(scanned, string(tuple))
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, scanned)
+
+	// but seen by later ones
+	var tuples []string
+	for _, tuple := range scanTable(t, table) {
+		tuples = append(tuples, string(tuple))
+	}
+	assert.Equal(t, []string{"a", "b", "d"}, tuples)
+	_, err = table.Get(locations[2])
+	assert.ErrorIs(t, err, ErrTupleNotFound)
+}
+
+func TestWriteConflict(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+	loc, err := table.Add(Tuple("a"))
+	assert.NoError(t, err)
+
+	tx1, err := txm.Begin()
+	assert.NoError(t, err)
+	tx2, err := txm.Begin()
+	assert.NoError(t, err)
+
+	// the first committer wins
+	b := NewTxBatch(tx1)
+	assert.NoError(t, table.BatchDelete(b, loc))
+	assert.NoError(t, table.commit(b))
+	tx1.Finish()
+	b = NewTxBatch(tx2)
+	assert.ErrorIs(t, table.BatchDelete(b, loc), ErrWriteConflict)
+	tx2.Finish()
+
+	// deleting what is already deleted in the snapshot finds nothing
+	assert.ErrorIs(t, table.Delete(loc), ErrTupleNotFound)
+}
+
+func TestVacuumKeepsVisibleTuples(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+	loc, err := table.Add(Tuple("a"))
+	assert.NoError(t, err)
+
+	// an old snapshot still sees the deleted tuple after vacuuming
+	s := txm.Snapshot()
+	assert.NoError(t, table.Delete(loc))
+	assert.NoError(t, table.Vacuum())
+	tuple, err := table.GetSnapshot(s, loc)
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple("a"), tuple)
+
+	// which is removed once nobody sees it
+	txm.Release(s)
+	assert.NoError(t, table.Vacuum())
+	tuples, err := NewPage(table.Data, 0).ReadAll()
+	assert.NoError(t, err)
+	assert.Empty(t, tuples)
+}
+
+func TestXidNotReused(t *testing.T) {
+	dir := t.TempDir()
+	txm, err := OpenTxManager(dir)
+	assert.NoError(t, err)
+	tx, err := txm.Begin()
+	assert.NoError(t, err)
+	tx.Finish()
+	assert.NoError(t, txm.Close())
+
+	txm, err = OpenTxManager(dir)
+	assert.NoError(t, err)
+	defer txm.Close()
+	next, err := txm.Begin()
+	assert.NoError(t, err)
+	assert.Greater(t, next.Xid(), tx.Xid())
+}
+
+func TestUpdateChain(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+	loc, err := table.Add(Tuple("a"))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = table.Add(Tuple(fmt.Sprintf("%050d", i)))
+		assert.NoError(t, err)
+	}
+
+	// the tuple keeps its location, while older snapshots still see the older versions
+	s := txm.Snapshot()
+	assert.NoError(t, table.Update(loc, Tuple("b")))
+	// too large for the first page, moved into another one
+	large := Tuple(fmt.Sprintf("%01500d", 0))
+	assert.NoError(t, table.Update(loc, large))
+	tuple, err := table.Get(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, large, tuple)
+	tuple, err = table.GetSnapshot(s, loc)
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple("a"), tuple)
+	tuple, err = table.GetLatest(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, large, tuple)
+	tuples := scanTable(t, table)
+	assert.Equal(t, 101, len(tuples))
+	assert.Equal(t, large, tuples[0])
+
+	// every version is iterated without a snapshot
+	var versions []Tuple
+	assert.NoError(t, table.ScanSnapshot(nil, func(tuple Tuple, l TupleLocation) (bool, error) {
+		if l == loc {
+			versions = append(versions, tuple)
+		}
+		return true, nil
+	}))
+	assert.Equal(t, []Tuple{Tuple("a"), Tuple("b"), large}, versions)
+
+	// old versions are pruned once nobody sees them
+	txm.Release(s)
+	assert.NoError(t, table.Vacuum())
+	versions = nil
+	assert.NoError(t, table.ScanSnapshot(nil, func(tuple Tuple, l TupleLocation) (bool, error) {
+		if l == loc {
+			versions = append(versions, tuple)
+		}
+		return true, nil
+	}))
+	assert.Equal(t, []Tuple{large}, versions)
+	assert.NoError(t, table.Update(loc, Tuple("c")))
+	tuple, err = table.Get(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple("c"), tuple)
+
+	// and all are packed by a full vacuum
+	assert.NoError(t, table.VacuumFull())
+	tuples = scanTable(t, table)
+	assert.Equal(t, 101, len(tuples))
+	assert.Equal(t, Tuple("c"), tuples[0])
+	assert.NoError(t, table.Delete(TupleLocation{Page: 0, Offset: 0}))
+	assert.Equal(t, 100, len(scanTable(t, table)))
+	_, err = table.GetLatest(TupleLocation{Page: 0, Offset: 0})
+	assert.ErrorIs(t, err, ErrTupleNotFound)
+}
+
+func TestUpdateConflict(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+	loc, err := table.Add(Tuple("a"))
+	assert.NoError(t, err)
+
+	tx1, err := txm.Begin()
+	assert.NoError(t, err)
+	tx2, err := txm.Begin()
+	assert.NoError(t, err)
+
+	// the first committer wins, and a tuple can be updated again in the same transaction
+	b := NewTxBatch(tx1)
+	assert.NoError(t, table.BatchUpdate(b, loc, Tuple("b")))
+	assert.NoError(t, table.BatchUpdate(b, loc, Tuple("c")))
+	assert.NoError(t, table.commit(b))
+	tx1.Finish()
+	b = NewTxBatch(tx2)
+	assert.ErrorIs(t, table.BatchUpdate(b, loc, Tuple("d")), ErrWriteConflict)
+	assert.ErrorIs(t, table.BatchDelete(b, loc), ErrWriteConflict)
+	tx2.Finish()
+
+	tuple, err := table.Get(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple("c"), tuple)
+	assert.NoError(t, table.Delete(loc))
+	assert.ErrorIs(t, table.Update(loc, Tuple("e")), ErrTupleNotFound)
+}
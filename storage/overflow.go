@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Tuples too large to be stored in line are compressed or moved into an overflow file,
+// much like TOAST in postgres https://www.postgresql.org/docs/current/storage-toast.html
+//
+// The overflow file is made of pages, with the first one holding its meta data:
+// | magic (4) | head of the free page list (4) |
+// and the others holding chunks of tuples, chained by the index of the next page:
+// | next page (4) | chunk length (4) | chunk |
+
+const (
+	// stored tuples larger than this are compressed or moved into the overflow file,
+	// so that a page always holds a few tuples
+	overflowThreshold = pageSize / 4
+	// size of the header of an overflow page
+	overflowPageHeaderSize = 8
+	// size of the stub left in a page for a tuple moved into the overflow file
+	overflowStubSize = 8
+)
+
+var (
+	overflowMagic = []byte("GLOV")
+)
+
+// compress a tuple if it becomes smaller
+func compressTuple(tuple Tuple) (compressed Tuple, ok bool, err error) {
+	buffer := bytes.Buffer{}
+	w, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(tuple)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	if buffer.Len() >= len(tuple) {
+		return nil, false, nil
+	}
+	return buffer.Bytes(), true, nil
+}
+
+func decompressTuple(compressed Tuple) (tuple Tuple, err error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	tuple, err = io.ReadAll(r)
+	if err != nil {
+		err = fmt.Errorf("failed to decompress tuple: %w", err)
+		return
+	}
+	return
+}
+
+// writeOverflow writes data into a chain of overflow pages
+// returns the stub pointing to the chain
+func writeOverflow(ovf *shadowFile, data []byte) (stub []byte, err error) {
+	freeHead, err := readOverflowMeta(ovf)
+	if err != nil {
+		return
+	}
+	chunkSize := pageSize - overflowPageHeaderSize
+	count := (len(data) + chunkSize - 1) / chunkSize
+	// allocate all pages first, so that each page knows the next one
+	pages := make([]uint32, count)
+	size, err := ovf.Size()
+	if err != nil {
+		return
+	}
+	end := uint32(size / pageSize)
+	if end == 0 {
+		// the meta page
+		end = 1
+	}
+	for i := range pages {
+		if freeHead != 0 {
+			pages[i] = freeHead
+			freeHead, _, err = readOverflowPageHeader(ovf, freeHead)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		pages[i] = end
+		end++
+	}
+	for i, page := range pages {
+		next := uint32(0)
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		chunk := data[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		image := make([]byte, pageSize)
+		endian.PutUint32(image[0:4], next)
+		endian.PutUint32(image[4:8], uint32(len(chunk)))
+		copy(image[overflowPageHeaderSize:], chunk)
+		_, err = ovf.WriteAt(image, int64(page)*pageSize)
+		if err != nil {
+			err = fmt.Errorf("failed to write overflow page %d: %w", page, err)
+			return
+		}
+	}
+	err = writeOverflowMeta(ovf, freeHead)
+	if err != nil {
+		return
+	}
+	stub = make([]byte, overflowStubSize)
+	endian.PutUint32(stub[0:4], pages[0])
+	endian.PutUint32(stub[4:8], uint32(len(data)))
+	return
+}
+
+// readOverflow reads the data in the chain of overflow pages a stub points to
+func readOverflow(ovf pageFile, stub []byte) (data []byte, err error) {
+	if len(stub) != overflowStubSize {
+		err = fmt.Errorf("invalid overflow stub size: %d", len(stub))
+		return
+	}
+	page := endian.Uint32(stub[0:4])
+	size := endian.Uint32(stub[4:8])
+	data = make([]byte, 0, size)
+	for page != 0 {
+		image := make([]byte, pageSize)
+		_, err = ovf.ReadAt(image, int64(page)*pageSize)
+		if err != nil {
+			err = fmt.Errorf("failed to read overflow page %d: %w", page, err)
+			return
+		}
+		page = endian.Uint32(image[0:4])
+		length := endian.Uint32(image[4:8])
+		if length > pageSize-overflowPageHeaderSize {
+			err = fmt.Errorf("invalid overflow chunk length: %d", length)
+			return
+		}
+		data = append(data, image[overflowPageHeaderSize:overflowPageHeaderSize+length]...)
+	}
+	if uint32(len(data)) != size {
+		err = fmt.Errorf("overflow data size mismatched: %d != %d", len(data), size)
+		return
+	}
+	return
+}
+
+// freeOverflow puts the chain of overflow pages a stub points to into the free page list
+func freeOverflow(ovf *shadowFile, stub []byte) (err error) {
+	if len(stub) != overflowStubSize {
+		err = fmt.Errorf("invalid overflow stub size: %d", len(stub))
+		return
+	}
+	first := endian.Uint32(stub[0:4])
+	freeHead, err := readOverflowMeta(ovf)
+	if err != nil {
+		return
+	}
+	// link the tail of the chain to the current free pages
+	tail := first
+	for {
+		var next, length uint32
+		next, length, err = readOverflowPageHeader(ovf, tail)
+		if err != nil {
+			return
+		}
+		if next == 0 {
+			header := make([]byte, overflowPageHeaderSize)
+			endian.PutUint32(header[0:4], freeHead)
+			endian.PutUint32(header[4:8], length)
+			_, err = ovf.WriteAt(header, int64(tail)*pageSize)
+			if err != nil {
+				return
+			}
+			break
+		}
+		tail = next
+	}
+	return writeOverflowMeta(ovf, first)
+}
+
+// read the head of the free page list
+func readOverflowMeta(ovf *shadowFile) (freeHead uint32, err error) {
+	meta := make([]byte, 8)
+	_, err = ovf.ReadAt(meta, 0)
+	if errors.Is(err, io.EOF) {
+		// no overflow page yet
+		return 0, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to read overflow meta: %w", err)
+		return
+	}
+	if !bytes.Equal(meta[0:4], overflowMagic) {
+		err = errors.New("invalid overflow file")
+		return
+	}
+	return endian.Uint32(meta[4:8]), nil
+}
+
+func writeOverflowMeta(ovf *shadowFile, freeHead uint32) (err error) {
+	meta := make([]byte, 8)
+	copy(meta, overflowMagic)
+	endian.PutUint32(meta[4:8], freeHead)
+	_, err = ovf.WriteAt(meta, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to write overflow meta: %w", err)
+		return
+	}
+	return
+}
+
+func readOverflowPageHeader(ovf *shadowFile, page uint32) (next uint32, length uint32, err error) {
+	header := make([]byte, overflowPageHeaderSize)
+	_, err = ovf.ReadAt(header, int64(page)*pageSize)
+	if err != nil {
+		err = fmt.Errorf("failed to read overflow page %d: %w", page, err)
+		return
+	}
+	return endian.Uint32(header[0:4]), endian.Uint32(header[4:8]), nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openOverflowTable(t *testing.T, dir string, compress bool) (*Table, *Wal, *TxManager) {
+	txm, err := OpenTxManager(dir)
+	assert.NoError(t, err)
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	open := func(name string) *os.File {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, filePerm)
+		assert.NoError(t, err)
+		return file
+	}
+	table, err := OpenTable(open("tbl.gled"), open("tbl.fsm.gled"), TableOptions{
+		Wal:       wal,
+		TxManager: txm,
+		Pool:      NewBufferPool(16 * pageSize),
+		Overflow:  open("tbl.ovf.gled"),
+		Compress:  compress,
+	})
+	assert.NoError(t, err)
+	return table, wal, txm
+}
+
+func randomTuple(size int) Tuple {
+	tuple := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(tuple)
+	return tuple
+}
+
+func TestOverflowTuples(t *testing.T) {
+	table, wal, txm := openOverflowTable(t, t.TempDir(), false)
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+
+	tuples := []Tuple{Tuple("small"), randomTuple(3 * pageSize), randomTuple(pageSize / 2)}
+	var locations []TupleLocation
+	for _, tuple := range tuples {
+		loc, err := table.Add(tuple)
+		assert.NoError(t, err)
+		locations = append(locations, loc)
+	}
+	// all tuples fit in one page with the large ones moved out of line
+	pageCount, err := table.countPages()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, pageCount)
+	assert.Equal(t, tuples, scanTable(t, table))
+	tuple, err := table.Get(locations[1])
+	assert.NoError(t, err)
+	assert.Equal(t, tuples[1], tuple)
+
+	// overflow pages of vacuumed tuples are reused
+	assert.NoError(t, table.Delete(locations[1]))
+	assert.NoError(t, table.Vacuum())
+	size, err := table.ovf.Size()
+	assert.NoError(t, err)
+	_, err = table.Add(randomTuple(2 * pageSize))
+	assert.NoError(t, err)
+	grown, err := table.ovf.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, size, grown)
+	assert.Equal(t, []Tuple{tuples[0], tuples[2], randomTuple(2 * pageSize)}, scanTable(t, table))
+
+	// and released by a full vacuum as well
+	err = table.Scan(func(tuple Tuple, loc TupleLocation) (bool, error) {
+		if bytes.Equal(tuple, tuples[2]) {
+			assert.NoError(t, table.Delete(loc))
+		}
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, table.VacuumFull())
+	assert.Equal(t, []Tuple{tuples[0], randomTuple(2 * pageSize)}, scanTable(t, table))
+}
+
+func TestCompressedTuples(t *testing.T) {
+	table, wal, txm := openOverflowTable(t, t.TempDir(), true)
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+
+	// compressible tuples stay in line
+	text := Tuple(bytes.Repeat([]byte("a long text field "), 1000))
+	_, err := table.Add(text)
+	assert.NoError(t, err)
+	size, err := table.ovf.Size()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, size)
+
+	// incompressible ones are still moved out of line
+	random := randomTuple(2 * pageSize)
+	_, err = table.Add(random)
+	assert.NoError(t, err)
+	size, err = table.ovf.Size()
+	assert.NoError(t, err)
+	assert.Greater(t, size, int64(0))
+	assert.Equal(t, []Tuple{text, random}, scanTable(t, table))
+}
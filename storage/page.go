@@ -7,7 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"sort"
 	"unsafe"
 )
 
@@ -18,6 +18,13 @@ const (
 	pageSize = 1024 * 8
 )
 
+var (
+	// ErrTupleNotFound is returned when reading a tuple that does not exist or is removed
+	ErrTupleNotFound = errors.New("tuple not found")
+	// returned when adding a tuple to a page without enough free space
+	errNoRoom = errors.New("no room for more tuples")
+)
+
 var (
 	// endian for all Data bytes in a page
 	endian = binary.BigEndian
@@ -60,6 +67,11 @@ func (p *PageHeader) toBytes() (data []byte) {
 	return buffer.Bytes()
 }
 
+// the remaining hole size - one pointer
+func (p *PageHeader) freeSpace() uint32 {
+	return uint32(p.upper) - uint32(p.lower) - pagePointerSize
+}
+
 // postgres equivalent:
 // https://github.com/postgres/postgres/blob/27b77ecf9f4d5be211900eda54d8155ada50d696/src/include/storage/itemid.h#L38
 type tupleAttributes struct {
@@ -123,16 +135,19 @@ func (t *Tuple) Size() uint32 {
 }
 
 // Page is a fixed-length area on a Data to store tuples and related Data structures
+// Data is read and written with positional I/O, so pages over the same file can be used
+// by different goroutines. A Page value itself is used by one goroutine,
+// while accesses to the same page are coordinated by the latches of its table
 type Page struct {
 	header      PageHeader
-	data        *os.File
+	data        pageFile
 	offset      uint64
 	initialized bool
 }
 
 // NewPage creates and initializes a new page
 // from a specific offset of a Data
-func NewPage(data *os.File, offset uint64) *Page {
+func NewPage(data pageFile, offset uint64) *Page {
 	return &Page{
 		header:      PageHeader{},
 		data:        data,
@@ -160,7 +175,7 @@ func (p *Page) Add(tuple Tuple) (free uint32, err error) {
 		}
 	}
 	if uint32(p.header.lower)+tuplePointerSize+tuple.Size() >= uint32(p.header.upper) {
-		err = errors.New("no room for more tuples")
+		err = errNoRoom
 		return
 	}
 
@@ -194,14 +209,19 @@ func (p *Page) Add(tuple Tuple) (free uint32, err error) {
 		return
 	}
 
-	// the remaining hole size - one pointer
-	free = uint32(p.header.upper) - uint32(p.header.lower) - pagePointerSize
+	free = p.header.freeSpace()
 	return
 }
 
 // Remove removes a tuple by providing the pointer index (starting from 0) pointing to the tuple
 // Note that FSM is not updated until we do vacuuming
 func (p *Page) Remove(tpIdx uint32) (err error) {
+	if !p.initialized {
+		err = p.Init()
+		if err != nil {
+			return
+		}
+	}
 	pointerCount, err := p.countTuplePointers()
 	if err != nil {
 		err = fmt.Errorf("failed to count tuple pointers: %w", err)
@@ -212,20 +232,14 @@ func (p *Page) Remove(tpIdx uint32) (err error) {
 		return
 	}
 	// read the pointer from the Data
-	tpStart := pageHeaderSize + tuplePointerSize*tpIdx
-	buffer := make([]byte, tuplePointerSize)
-	err = p.readAt(buffer, tpStart)
-	if err != nil {
-		return
-	}
-	pointer, err := NewTuplePointerFromBytes(buffer)
+	pointer, err := p.readPointer(tpIdx)
 	if err != nil {
 		return
 	}
 	// reset the pointer so that the pointed tuple will be considered "deleted"
 	pointer.attrs.used = false
 	// write back
-	err = p.writeAt(pointer.toBytes(), tpStart)
+	err = p.writeAt(pointer.toBytes(), pageHeaderSize+tuplePointerSize*tpIdx)
 	if err != nil {
 		err = fmt.Errorf("failed to write tuple pointer back to the Data: %w", err)
 		return
@@ -233,6 +247,76 @@ func (p *Page) Remove(tpIdx uint32) (err error) {
 	return
 }
 
+// Vacuum compacts the page in place, reclaiming the space of removed tuples.
+// Remaining tuples keep their pointer indexes, so that their locations stay valid:
+// pointers of removed tuples are left unused in between, and only the unused pointers
+// at the end are reclaimed, like line pointers in postgres
+// returns the remaining free spaces for more tuples
+func (p *Page) Vacuum() (free uint32, err error) {
+	tuples, indexes, err := p.readTuples()
+	if err != nil {
+		return
+	}
+	pointerCount, err := p.countTuplePointers()
+	if err != nil {
+		err = fmt.Errorf("failed to count tuple pointers: %w", err)
+		return
+	}
+	if uint32(len(tuples)) == pointerCount {
+		// nothing removed, nothing to reclaim
+		free = p.header.freeSpace()
+		return
+	}
+	image, header := newPageImage(tuples, indexes)
+	err = p.writeAt(image, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to write compacted page: %w", err)
+		return
+	}
+	p.header = header
+	free = p.header.freeSpace()
+	return
+}
+
+// Replace replaces the tuple pointed by the pointer at index |tpIdx| with another one of any size.
+// The page is compacted as by Vacuum, so that the tuple keeps its pointer
+// returns the remaining free spaces for more tuples
+func (p *Page) Replace(tpIdx uint32, tuple Tuple) (free uint32, err error) {
+	tuples, indexes, err := p.readTuples()
+	if err != nil {
+		return
+	}
+	i := sort.Search(len(indexes), func(i int) bool {
+		return indexes[i] >= tpIdx
+	})
+	if i == len(indexes) || indexes[i] != tpIdx {
+		err = ErrTupleNotFound
+		return
+	}
+	size := tuple.Size()
+	for j, t := range tuples {
+		if j != i {
+			size += t.Size()
+		}
+	}
+	if !tuplesFit(indexes[len(indexes)-1]+1, size) {
+		err = errNoRoom
+		return
+	}
+	replaced := make([]Tuple, len(tuples))
+	copy(replaced, tuples)
+	replaced[i] = tuple
+	image, header := newPageImage(replaced, indexes)
+	err = p.writeAt(image, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to write page with the replaced tuple: %w", err)
+		return
+	}
+	p.header = header
+	free = p.header.freeSpace()
+	return
+}
+
 func (p *Page) Flush() (err error) {
 	err = p.data.Sync()
 	if err != nil {
@@ -257,65 +341,193 @@ func (p *Page) Close() (err error) {
 
 // ReadAll reads all tuples from a page
 func (p *Page) ReadAll() (tuples []Tuple, err error) {
+	tuples, _, err = p.readTuples()
+	return
+}
+
+// Get reads the tuple pointed by the pointer at index |tpIdx|
+func (p *Page) Get(tpIdx uint32) (tuple Tuple, err error) {
+	start, end, err := p.locateTuple(tpIdx)
+	if err != nil {
+		return
+	}
+	tuple = make([]byte, end-start)
+	err = p.readAt(tuple, uint32(start))
+	if err != nil {
+		err = fmt.Errorf("failed to read tuple Data: %w", err)
+		return
+	}
+	return
+}
+
+// Overwrite writes |data| over the tuple pointed by the pointer at index |tpIdx|,
+// starting from |at| bytes into the tuple. The tuple size never changes
+func (p *Page) Overwrite(tpIdx uint32, at uint32, data []byte) (err error) {
+	start, end, err := p.locateTuple(tpIdx)
+	if err != nil {
+		return
+	}
+	if uint32(start)+at+uint32(len(data)) > uint32(end) {
+		err = fmt.Errorf("overwriting beyond the end of tuple %d", tpIdx)
+		return
+	}
+	err = p.writeAt(data, uint32(start)+at)
+	if err != nil {
+		err = fmt.Errorf("failed to overwrite tuple Data: %w", err)
+		return
+	}
+	return
+}
+
+// locateTuple finds where the tuple pointed by the pointer at index |tpIdx| starts and ends
+func (p *Page) locateTuple(tpIdx uint32) (start PagePointer, end PagePointer, err error) {
 	if !p.initialized {
 		err = p.Init()
 		if err != nil {
 			return
 		}
 	}
-	err = p.readHeader()
+	pointerCount, err := p.countTuplePointers()
 	if err != nil {
+		err = fmt.Errorf("failed to count tuple pointers: %w", err)
 		return
 	}
-
-	// read tuple pointers
-	pointerCount, err := p.countTuplePointers()
+	if tpIdx >= pointerCount {
+		err = ErrTupleNotFound
+		return
+	}
+	pointer, err := p.readPointer(tpIdx)
 	if err != nil {
-		err = fmt.Errorf("failed to count tuple pointers: %w", err)
 		return
 	}
-	buffer := make([]byte, tuplePointerSize*pointerCount)
-	err = p.readAt(buffer, pageHeaderSize)
+	if !pointer.attrs.used {
+		err = ErrTupleNotFound
+		return
+	}
+	// the tuple ends where the tuple of the previous pointer starts
+	end = PagePointer(pageSize)
+	if tpIdx > 0 {
+		var previous TuplePointer
+		previous, err = p.readPointer(tpIdx - 1)
+		if err != nil {
+			return
+		}
+		end = previous.dataPtr
+	}
+	start = pointer.dataPtr
+	return
+}
+
+// readTuples reads all tuples from a page along with the indexes of their pointers
+// the page is read as a whole, with the tuples sharing one buffer
+func (p *Page) readTuples() (tuples []Tuple, indexes []uint32, err error) {
+	image := make([]byte, pageSize)
+	err = p.readAt(image, 0)
+	if err == io.EOF {
+		// the page is not written yet, thus empty
+		p.header = PageHeader{
+			lower: PagePointer(pageHeaderSize),
+			upper: pageSize,
+		}
+		p.initialized = true
+		return nil, nil, nil
+	}
 	if err != nil {
-		err = fmt.Errorf("faild to read tuple pointers: %w", err)
+		err = fmt.Errorf("failed to read page: %w", err)
 		return
 	}
+	p.header.lower = PagePointer(endian.Uint32(image[pagePointerSize*0 : pagePointerSize*1]))
+	p.header.upper = PagePointer(endian.Uint32(image[pagePointerSize*1 : pagePointerSize*2]))
+	p.initialized = true
 
-	// we got the pointers
+	// read tuple pointers
+	pointerCount, err := p.countTuplePointers()
+	if err != nil {
+		err = fmt.Errorf("failed to count tuple pointers: %w", err)
+		return
+	}
 	pointers := make([]TuplePointer, pointerCount)
 	var i uint32
 	for i = 0; i < pointerCount; i++ {
-		pointers[i], err = NewTuplePointerFromBytes(buffer[i*tuplePointerSize : (i+1)*tuplePointerSize])
+		start := pageHeaderSize + i*tuplePointerSize
+		pointers[i], err = NewTuplePointerFromBytes(image[start : start+tuplePointerSize])
 		if err != nil {
 			return
 		}
 	}
 
-	// read tuples
+	// slice tuples out of the page
 	for idx, pointer := range pointers {
 		// not used, skip
 		if !pointer.attrs.used {
 			continue
 		}
-		var tupleSize uint32
-		// decide the tuple size
-		if idx == 0 {
-			// the first tuple (at the end of the Data)
-			tupleSize = uint32(pageSize - pointers[idx].dataPtr)
-		} else {
-			tupleSize = uint32(pointers[idx-1].dataPtr - pointers[idx].dataPtr)
+		// the tuple ends where the tuple of the previous pointer starts
+		end := PagePointer(pageSize)
+		if idx > 0 {
+			end = pointers[idx-1].dataPtr
 		}
-		buffer = make([]byte, tupleSize)
-		err = p.readAt(buffer, uint32(pointer.dataPtr))
-		if err != nil {
-			err = fmt.Errorf("failed tp read tuple Data: %w", err)
+		if pointer.dataPtr > end {
+			err = fmt.Errorf("invalid tuple pointer %d: %d", idx, pointer.dataPtr)
 			return
 		}
-		tuples = append(tuples, buffer)
+		tuples = append(tuples, image[pointer.dataPtr:end:end])
+		indexes = append(indexes, uint32(idx))
 	}
 	return
 }
 
+// read the tuple pointer at index |tpIdx|
+func (p *Page) readPointer(tpIdx uint32) (pointer TuplePointer, err error) {
+	buffer := make([]byte, tuplePointerSize)
+	err = p.readAt(buffer, pageHeaderSize+tuplePointerSize*tpIdx)
+	if err != nil {
+		err = fmt.Errorf("failed to read tuple pointer: %w", err)
+		return
+	}
+	return NewTuplePointerFromBytes(buffer)
+}
+
+// newPageImage lays out tuples in a blank page, with tuple i pointed by the pointer at indexes[i]
+// and the pointers in between left unused. Tuples get consecutive pointers if |indexes| is nil
+// returns the bytes of the whole page along with its header
+func newPageImage(tuples []Tuple, indexes []uint32) (image []byte, header PageHeader) {
+	image = make([]byte, pageSize)
+	header = PageHeader{
+		lower: PagePointer(pageHeaderSize),
+		upper: pageSize,
+	}
+	idx := uint32(0)
+	for i, tuple := range tuples {
+		if indexes != nil {
+			// an unused pointer takes no space, starting where the previous tuple starts
+			for ; idx < indexes[i]; idx++ {
+				pointer := TuplePointer{dataPtr: header.upper}
+				copy(image[header.lower:], pointer.toBytes())
+				header.lower = PagePointer(uint32(header.lower) + tuplePointerSize)
+			}
+		}
+		header.upper = PagePointer(uint32(header.upper) - tuple.Size())
+		copy(image[header.upper:], tuple)
+		pointer := TuplePointer{
+			attrs: tupleAttributes{
+				used: true,
+			},
+			dataPtr: header.upper,
+		}
+		copy(image[header.lower:], pointer.toBytes())
+		header.lower = PagePointer(uint32(header.lower) + tuplePointerSize)
+		idx++
+	}
+	copy(image, header.toBytes())
+	return
+}
+
+// tuplesFit tells whether tuples with a total size of |size| can be laid out in one page
+func tuplesFit(count uint32, size uint32) bool {
+	return pageHeaderSize+tuplePointerSize*count+size < pageSize
+}
+
 func (p *Page) countTuplePointers() (count uint32, err error) {
 	pointerSectionSize := uint32(p.header.lower) - pageHeaderSize
 	if pointerSectionSize%tuplePointerSize != 0 {
@@ -359,24 +571,26 @@ func (p *Page) writeAt(data []byte, position uint32) (err error) {
 
 func (p *Page) readAt(data []byte, position uint32) (err error) {
 	// read the content
-	_, err = p.data.Seek(int64(p.offset+uint64(position)), io.SeekStart)
-	if err != nil {
-		err = fmt.Errorf("failed to seek the page Data: %w", err)
-		return
-	}
-	read, err := p.data.Read(data)
-	if err != nil {
+	read, err := p.data.ReadAt(data, int64(p.offset+uint64(position)))
+	if err == io.EOF && read == 0 {
 		// for EOF, return as is since it might be normal sometimes
-		if err == io.EOF {
-			return err
-		}
+		return err
+	}
+	if err != nil && err != io.EOF {
 		err = fmt.Errorf("failed to read Data from Data: %w", err)
 		return
-	} else if read != len(data) {
+	}
+	if read != len(data) {
 		err = fmt.Errorf("mismatched number of bytes read")
 		return
 	}
-	return
+	return nil
+}
+
+func uint16ToBytes(value uint16) []byte {
+	buffer := make([]byte, unsafe.Sizeof(value))
+	endian.PutUint16(buffer, value)
+	return buffer
 }
 
 func uint32ToBytes(value uint32) []byte {
@@ -385,6 +599,12 @@ func uint32ToBytes(value uint32) []byte {
 	return buffer
 }
 
+func uint64ToBytes(value uint64) []byte {
+	buffer := make([]byte, unsafe.Sizeof(value))
+	endian.PutUint64(buffer, value)
+	return buffer
+}
+
 func bytesToUint32(data []byte) uint32 {
 	return endian.Uint32(data)
 }
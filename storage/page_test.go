@@ -36,3 +36,55 @@ func TestPageWriteAndRead(t *testing.T) {
 
 	assert.EqualValues(t, []Tuple{inputTuples[0], inputTuples[2]}, outputTuples)
 }
+
+func TestPageVacuum(t *testing.T) {
+	inputTuples := []Tuple{
+		Tuple("here's some Data"),
+		Tuple("have a nice day"),
+		Tuple("good bye"),
+	}
+
+	file, err := ioutil.TempFile("", "gled_ut_*")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	page := NewPage(file, 0)
+	defer page.Close()
+	var free uint32
+	for _, item := range inputTuples {
+		free, err = page.Add(item)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, page.Remove(0))
+	assert.NoError(t, page.Remove(2))
+
+	vacuumedFree, err := page.Vacuum()
+	assert.NoError(t, err)
+	// space of the two removed tuples and the trailing pointer is reclaimed
+	assert.EqualValues(t, free+inputTuples[0].Size()+inputTuples[2].Size()+tuplePointerSize, vacuumedFree)
+
+	outputTuples, err := NewPage(file, 0).ReadAll()
+	assert.NoError(t, err)
+	assert.EqualValues(t, []Tuple{inputTuples[1]}, outputTuples)
+
+	// the remaining tuple keeps its pointer
+	tuple, err := page.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, inputTuples[1], tuple)
+	_, err = page.Get(0)
+	assert.ErrorIs(t, err, ErrTupleNotFound)
+
+	// new tuples are added after it
+	_, err = page.Add(inputTuples[2])
+	assert.NoError(t, err)
+	tuple, err = page.Get(2)
+	assert.NoError(t, err)
+	assert.Equal(t, inputTuples[2], tuple)
+
+	assert.NoError(t, page.Remove(1))
+	assert.NoError(t, page.Remove(2))
+	outputTuples, err = NewPage(file, 0).ReadAll()
+	assert.NoError(t, err)
+	assert.Empty(t, outputTuples)
+}
@@ -1,19 +1,28 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"io"
 	"os"
+	"sync"
 )
 
 const (
 	// how many bytes 1 unit in the Fsm capacity value (as a byte) stands for
 	fsmDensity = pageSize / 256
+	// permission used to create new files
+	filePerm = 0600
 )
 
+// TupleLocation locates a tuple in a table by its page and the index of its tuple pointer,
+// like ctid in postgres. A tuple keeps its location until it is deleted or the table is fully vacuumed
 type TupleLocation struct {
-	Page   int64
+	// index of the page holding the tuple
+	Page int64
+	// index of the tuple pointer within the page
 	Offset uint32
 }
 
@@ -21,143 +30,1004 @@ type TupleLocation struct {
 type TableIterator func(tuple Tuple, loc TupleLocation) (cont bool, err error)
 
 // Table is a Data structure to store Data with the same schema
-// which contains multiple pages
+// which contains multiple pages.
+// A table is safe for concurrent use: reads latch the pages they read,
+// and writers are serialized by the write lock of the table
 type Table struct {
 	// Data file
 	Data *os.File
 	// free space map file
 	Fsm *os.File
+	// overflow file holding tuples too large to be stored in pages, nil if not used
+	Ovf *os.File
+	// the files read and written, either directly or through a buffer pool
+	data dataFile
+	fsm  dataFile
+	ovf  dataFile
+	// whether large tuples are compressed
+	compress bool
+	// write-ahead log for all modifications, nil if not logged
+	wal *Wal
+	// manager of the transactions versioning tuples, nil if not versioned
+	txm *TxManager
+	// latches of the pages in the Data file
+	latches *pageLatches
+	// held by the writer planning and committing a batch on the table
+	writeMu sync.Mutex
+}
+
+// TableOptions are the optional services a table uses
+type TableOptions struct {
+	// write-ahead log recording modifications before they are written into the table files
+	Wal *Wal
+	// manager of the transactions versioning tuples, so that reads only see the tuples
+	// visible in their snapshots
+	TxManager *TxManager
+	// buffer pool caching pages of the table files
+	// modified pages are only written into the files when evicted or flushed,
+	// which requires a write-ahead log for durability
+	Pool *BufferPool
+	// file holding large tuples out of line, chunked into chained pages
+	// without it, tuples not fitting in a page cannot be added
+	Overflow *os.File
+	// whether large tuples are compressed before stored
+	Compress bool
 }
 
 func NewTable(data *os.File, fsm *os.File) *Table {
 	return &Table{
-		Data: data,
-		Fsm:  fsm,
+		Data:    data,
+		Fsm:     fsm,
+		data:    osFile{data},
+		fsm:     osFile{fsm},
+		latches: newPageLatches(),
 	}
 }
 
+// OpenTable creates a table with optional services
+func OpenTable(data *os.File, fsm *os.File, opts TableOptions) (table *Table, err error) {
+	table = NewTable(data, fsm)
+	if opts.Overflow != nil {
+		table.Ovf = opts.Overflow
+		table.ovf = osFile{opts.Overflow}
+	}
+	table.compress = opts.Compress
+	if opts.Pool != nil {
+		if opts.Wal == nil {
+			err = fmt.Errorf("a buffer pool requires a write-ahead log")
+			return nil, err
+		}
+		table.data, err = newPooledFile(data, opts.Pool)
+		if err != nil {
+			return nil, err
+		}
+		table.fsm, err = newPooledFile(fsm, opts.Pool)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Overflow != nil {
+			table.ovf, err = newPooledFile(opts.Overflow, opts.Pool)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	table.txm = opts.TxManager
+	if opts.Wal != nil {
+		table.wal = opts.Wal
+		table.wal.register(table)
+	}
+	return
+}
+
+// LockWrites acquires the write lock of the table.
+// Changes in a batch are planned against the table content, e.g. a free page is picked
+// from the Fsm file, so the lock must be held from the first change in the batch
+// until it is committed. Add, Delete and vacuuming acquire the lock by themselves
+func (t *Table) LockWrites() {
+	t.writeMu.Lock()
+}
+
+// UnlockWrites releases the write lock of the table
+func (t *Table) UnlockWrites() {
+	t.writeMu.Unlock()
+}
+
 // Add adds a tuple to a table
-func (t *Table) Add(tuple Tuple) (err error) {
-	idx, err := t.getFreePageIndex(uint32(len(tuple)))
+// returns the location of the added tuple
+func (t *Table) Add(tuple Tuple) (loc TupleLocation, err error) {
+	err = t.autoCommit(func(b *Batch) (err error) {
+		loc, err = t.BatchAdd(b, tuple)
+		return
+	})
+	return
+}
+
+// BatchAdd adds a tuple to a table within a batch
+// the tuple only takes effect after the batch is committed.
+// The write lock of the table must be held until then
+func (t *Table) BatchAdd(b *Batch, tuple Tuple) (loc TupleLocation, err error) {
+	b.touch(t)
+	header := tupleHeader{}
+	if b.tx != nil {
+		header.xmin = b.tx.xid
+	}
+	stored, err := t.storeTuple(b, header, tuple)
 	if err != nil {
 		return
 	}
+	return t.place(b, stored, -1)
+}
+
+// place adds a stored tuple to a page with enough free space,
+// trying the page at index |prefer| first unless it's -1
+func (t *Table) place(b *Batch, stored Tuple, prefer int64) (loc TupleLocation, err error) {
+	fsm := b.file(t.fsm)
+	idx := prefer
+	if idx == -1 {
+		idx, err = getFreePageIndex(fsm, uint32(len(stored)))
+		if err != nil {
+			return
+		}
+	}
 	if idx == -1 {
 		// no free page found, create a new one
-		idx, err = t.allocateNewPage()
+		idx, err = allocateNewPage(fsm)
 		if err != nil {
 			return
 		}
 	}
 
 	// open the underlying page and add
-	page := NewPage(t.Data, uint64(idx*pageSize))
+	page := NewPage(b.file(t.data), uint64(idx*pageSize))
+	free, err := page.Add(stored)
+	if errors.Is(err, errNoRoom) && prefer != -1 {
+		return t.place(b, stored, -1)
+	}
 	if err != nil {
 		return
 	}
-	free, err := page.Add(tuple)
+	pointerCount, err := page.countTuplePointers()
 	if err != nil {
 		return
 	}
 
-	err = t.updateFsm(idx, free)
+	err = updateFsm(fsm, idx, free)
 	if err != nil {
 		return
 	}
+	loc = TupleLocation{
+		Page:   idx,
+		Offset: pointerCount - 1,
+	}
 	return
 }
 
-func (t *Table) Scan(iter TableIterator) (err error) {
-	info, err := t.Data.Stat()
+// Get reads the tuple at a location
+// returns ErrTupleNotFound if there's no tuple at the location
+func (t *Table) Get(loc TupleLocation) (tuple Tuple, err error) {
+	s := t.snapshot()
+	defer t.release(s)
+	return t.GetSnapshot(s, loc)
+}
+
+// GetSnapshot reads the version of the tuple at a location visible in a snapshot
+// returns ErrTupleNotFound if there's no visible tuple at the location
+func (t *Table) GetSnapshot(s *Snapshot, loc TupleLocation) (tuple Tuple, err error) {
+	stored, err := t.readStored(loc)
 	if err != nil {
 		return
 	}
-	size := info.Size()
-	if size%pageSize != 0 {
-		log.Warn().Msgf("size of file %s %d is not a multiple of the page size %d", t.Data.Name(), size, pageSize)
+	chain, err := readChain(loc, stored, t.readStored)
+	if err != nil {
+		return
+	}
+	v, ok := visibleVersion(s, chain)
+	if !ok {
+		return nil, ErrTupleNotFound
+	}
+	return t.loadTuple(v.header, v.data)
+}
+
+// GetLatest reads the latest version of the tuple at a location, whether or not it is visible to others yet
+// returns ErrTupleNotFound if there's no tuple at the location or its latest version is deleted
+func (t *Table) GetLatest(loc TupleLocation) (tuple Tuple, err error) {
+	stored, err := t.readStored(loc)
+	if err != nil {
+		return
+	}
+	chain, err := readChain(loc, stored, t.readStored)
+	if err != nil {
+		return
+	}
+	latest := chain[len(chain)-1]
+	if latest.header.flags&tupleRedirect != 0 || latest.header.xmax != 0 {
+		return nil, ErrTupleNotFound
+	}
+	return t.loadTuple(latest.header, latest.data)
+}
+
+// Scan iterates over the tuples of the table
+// for a versioned table, only the tuples visible when the scan starts are iterated
+func (t *Table) Scan(iter TableIterator) (err error) {
+	s := t.snapshot()
+	defer t.release(s)
+	return t.ScanSnapshot(s, iter)
+}
+
+// ScanSnapshot iterates over the tuples visible in a snapshot, each at the location of its first version.
+// A nil snapshot iterates over every version stored, including the deleted and updated ones not vacuumed yet.
+// Pages are read one at a time and no latch is held when calling |iter|
+func (t *Table) ScanSnapshot(s *Snapshot, iter TableIterator) (err error) {
+	pageCount, err := t.PageCount()
+	if err != nil {
+		return
 	}
-	pageCount := size / pageSize
 	for i := int64(0); i < pageCount; i++ {
-		page := NewPage(t.Data, uint64(i*pageSize))
-		var tps []Tuple
-		tps, err = page.ReadAll()
-		if err != nil {
+		cont, err := t.ScanPage(s, i, 0, iter)
+		if err != nil || !cont {
 			return err
 		}
-		for j, tp := range tps {
-			var cont bool
-			cont, err = iter(tp, TupleLocation{
-				Page:   i,
-				Offset: uint32(j),
-			})
+	}
+	return
+}
+
+// PageCount returns the number of pages of the table
+func (t *Table) PageCount() (count int64, err error) {
+	return t.countPages()
+}
+
+// ScanPage iterates over the tuples of a page like ScanSnapshot, starting from the tuple pointer at offset |from|
+// returns false if |iter| stops the scan
+func (t *Table) ScanPage(s *Snapshot, page int64, from uint32, iter TableIterator) (cont bool, err error) {
+	p := NewPage(t.data, uint64(page*pageSize))
+	latch := t.latches.get(page)
+	latch.RLock()
+	tps, indexes, err := p.readTuples()
+	latch.RUnlock()
+	if err != nil {
+		return
+	}
+	for j, stored := range tps {
+		if indexes[j] < from {
+			continue
+		}
+		loc := TupleLocation{
+			Page:   page,
+			Offset: indexes[j],
+		}
+		header, data, err := decodeTuple(stored)
+		if err != nil {
+			return false, err
+		}
+		if header.flags&tupleHeapOnly != 0 {
+			// iterated along with the first version
+			continue
+		}
+		chain := []version{{loc: loc, header: header, data: data}}
+		if header.flags&tupleUpdated != 0 {
+			chain, err = readChain(loc, stored, t.readStored)
+			if err != nil {
+				return false, err
+			}
+		}
+		var versions []version
+		if s == nil {
+			for _, v := range chain {
+				if v.header.flags&tupleRedirect == 0 {
+					versions = append(versions, v)
+				}
+			}
+		} else if v, ok := visibleVersion(s, chain); ok {
+			versions = append(versions, v)
+		}
+		for _, v := range versions {
+			tp, err := t.loadTuple(v.header, v.data)
 			if err != nil {
-				return err
+				return false, err
 			}
-			if !cont {
-				return nil
+			cont, err = iter(tp, loc)
+			if err != nil || !cont {
+				return false, err
 			}
 		}
 	}
-	return
+	return true, nil
 }
 
 func (t *Table) Delete(loc TupleLocation) (err error) {
-	page := NewPage(t.Data, uint64(loc.Page*pageSize))
+	return t.autoCommit(func(b *Batch) error {
+		return t.BatchDelete(b, loc)
+	})
+}
+
+// BatchDelete deletes the tuple at a location within a batch
+// the deletion only takes effect after the batch is committed.
+// In a batch of a transaction, the tuple is kept and marked as deleted by the transaction,
+// returning ErrWriteConflict if it is deleted or updated by a transaction not seen by the snapshot.
+// The write lock of the table must be held until the batch is committed
+func (t *Table) BatchDelete(b *Batch, loc TupleLocation) (err error) {
+	b.touch(t)
+	chain, err := t.batchChain(b, loc)
+	if err != nil {
+		return
+	}
+	if b.tx == nil {
+		for _, v := range chain {
+			err = t.discard(b, v.header, v.data)
+			if err != nil {
+				return
+			}
+			err = NewPage(b.file(t.data), uint64(v.loc.Page*pageSize)).Remove(v.loc.Offset)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	latest := chain[len(chain)-1]
+	if latest.header.xmax == b.tx.xid {
+		// deleted earlier in the same transaction
+		return
+	}
+	err = checkWritable(b.tx, latest.header)
 	if err != nil {
 		return
 	}
-	err = page.Remove(loc.Offset)
+	latest.header.xmax = b.tx.xid
+	return NewPage(b.file(t.data), uint64(latest.loc.Page*pageSize)).Overwrite(latest.loc.Offset, 0, latest.header.toBytes())
+}
+
+// Update replaces the tuple at a location with another one
+// the tuple keeps its location
+func (t *Table) Update(loc TupleLocation, tuple Tuple) (err error) {
+	return t.autoCommit(func(b *Batch) error {
+		return t.BatchUpdate(b, loc, tuple)
+	})
+}
+
+// BatchUpdate replaces the tuple at a location with another one within a batch
+// the update only takes effect after the batch is committed, and the tuple keeps its location.
+// In a batch of a transaction, the new version is added to the same page if it fits, otherwise
+// to another page, and chained to the current version, which is kept and marked as updated
+// by the transaction, like heap-only tuples in postgres
+// https://github.com/postgres/postgres/blob/27b77ecf9f4d5be211900eda54d8155ada50d696/src/backend/access/heap/README.HOT
+// Without a transaction, the tuple is rewritten in its page if it fits, otherwise moved into
+// another page with the header of the current version left to redirect to it.
+// Returns ErrWriteConflict if the tuple is deleted or updated by a transaction not seen by the snapshot.
+// The write lock of the table must be held until the batch is committed
+func (t *Table) BatchUpdate(b *Batch, loc TupleLocation, tuple Tuple) (err error) {
+	b.touch(t)
+	chain, err := t.batchChain(b, loc)
+	if err != nil {
+		return
+	}
+	latest := chain[len(chain)-1]
+	if b.tx == nil {
+		return t.rewrite(b, chain, tuple)
+	}
+	if latest.header.xmax == b.tx.xid {
+		// deleted earlier in the same transaction
+		return ErrTupleNotFound
+	}
+	err = checkWritable(b.tx, latest.header)
+	if err != nil {
+		return
+	}
+	stored, err := t.storeTuple(b, tupleHeader{xmin: b.tx.xid, flags: tupleHeapOnly}, tuple)
+	if err != nil {
+		return
+	}
+	next, err := t.place(b, stored, latest.loc.Page)
+	if err != nil {
+		return
+	}
+	latest.header.xmax = b.tx.xid
+	latest.header.flags |= tupleUpdated
+	latest.header.next = next
+	return NewPage(b.file(t.data), uint64(latest.loc.Page*pageSize)).Overwrite(latest.loc.Offset, 0, latest.header.toBytes())
+}
+
+// rewrite replaces the latest version in an update chain without keeping it
+func (t *Table) rewrite(b *Batch, chain []version, tuple Tuple) (err error) {
+	root, latest := chain[0], chain[len(chain)-1]
+	err = t.discard(b, latest.header, latest.data)
+	if err != nil {
+		return
+	}
+	header := tupleHeader{flags: latest.header.flags & tupleHeapOnly}
+	stored, err := t.storeTuple(b, header, tuple)
+	if err != nil {
+		return
+	}
+	fsm := b.file(t.fsm)
+	page := NewPage(b.file(t.data), uint64(latest.loc.Page*pageSize))
+	free, err := page.Replace(latest.loc.Offset, stored)
+	if err == nil {
+		return updateFsm(fsm, latest.loc.Page, free)
+	}
+	if !errors.Is(err, errNoRoom) {
+		return
+	}
+
+	// no room in the page, move the tuple into another one
+	moved, _, err := decodeTuple(stored)
+	if err != nil {
+		return
+	}
+	moved.flags |= tupleHeapOnly
+	copy(stored, moved.toBytes())
+	next, err := t.place(b, stored, -1)
+	if err != nil {
+		return
+	}
+	redirect := tupleHeader{flags: tupleUpdated | tupleRedirect, next: next}
+	page = NewPage(b.file(t.data), uint64(root.loc.Page*pageSize))
+	if len(chain) > 1 {
+		// the first version is already a redirect
+		err = NewPage(b.file(t.data), uint64(latest.loc.Page*pageSize)).Remove(latest.loc.Offset)
+		if err != nil {
+			return
+		}
+		return page.Overwrite(root.loc.Offset, 0, redirect.toBytes())
+	}
+	free, err = page.Replace(root.loc.Offset, redirect.toBytes())
 	if err != nil {
 		return
 	}
+	return updateFsm(fsm, root.loc.Page, free)
+}
+
+// checkWritable checks whether the latest version of a tuple can be deleted or updated by a transaction
+func checkWritable(tx *Tx, header tupleHeader) error {
+	switch {
+	case header.xmin == tx.xid:
+		// created by the same transaction
+		return nil
+	case header.xmin != 0 && !tx.snapshot.sees(header.xmin) && header.flags&tupleHeapOnly != 0:
+		// updated by a transaction not seen
+		return ErrWriteConflict
+	case header.xmin != 0 && !tx.snapshot.sees(header.xmin):
+		return ErrTupleNotFound
+	case header.xmax != 0 && tx.snapshot.sees(header.xmax):
+		return ErrTupleNotFound
+	case header.xmax != 0:
+		return ErrWriteConflict
+	}
+	return nil
+}
+
+// version is a version of a tuple in its update chain
+type version struct {
+	loc    TupleLocation
+	header tupleHeader
+	data   Tuple
+}
+
+// readChain reads the update chain of a tuple from its first version, the stored tuple at |loc|,
+// with |read| reading the stored tuple at a location.
+// A chain changed by vacuuming while being read is read again
+func readChain(loc TupleLocation, stored Tuple, read func(loc TupleLocation) (Tuple, error)) (chain []version, err error) {
+	for {
+		chain = nil
+		var header tupleHeader
+		var data Tuple
+		header, data, err = decodeTuple(stored)
+		if err != nil {
+			return
+		}
+		if header.flags&tupleHeapOnly != 0 {
+			// not the first version
+			return nil, ErrTupleNotFound
+		}
+		chain = append(chain, version{loc: loc, header: header, data: data})
+		broken := false
+		for header.flags&tupleUpdated != 0 {
+			previous := header
+			var next Tuple
+			next, err = read(header.next)
+			if errors.Is(err, ErrTupleNotFound) {
+				broken = true
+				break
+			}
+			if err != nil {
+				return
+			}
+			header, data, err = decodeTuple(next)
+			if err != nil {
+				return
+			}
+			// the next version must be created by the transaction updating the previous one
+			if header.flags&tupleHeapOnly == 0 || header.xmin != previous.xmax {
+				broken = true
+				break
+			}
+			chain = append(chain, version{loc: previous.next, header: header, data: data})
+		}
+		if !broken {
+			return
+		}
+		var again Tuple
+		again, err = read(loc)
+		if err != nil {
+			return
+		}
+		if bytes.Equal(again, stored) {
+			err = fmt.Errorf("broken update chain of tuple %v", loc)
+			return
+		}
+		stored = again
+	}
+}
+
+// visibleVersion finds the version in an update chain visible in a snapshot
+// a nil snapshot sees the latest version
+func visibleVersion(s *Snapshot, chain []version) (v version, ok bool) {
+	for _, candidate := range chain {
+		if candidate.header.flags&tupleRedirect == 0 && s.visible(candidate.header) {
+			v, ok = candidate, true
+		}
+	}
 	return
 }
 
+// readStored reads the stored tuple at a location, latching its page while reading
+func (t *Table) readStored(loc TupleLocation) (stored Tuple, err error) {
+	pageCount, err := t.countPages()
+	if err != nil {
+		return
+	}
+	if loc.Page < 0 || loc.Page >= pageCount {
+		err = ErrTupleNotFound
+		return
+	}
+	latch := t.latches.get(loc.Page)
+	latch.RLock()
+	defer latch.RUnlock()
+	return NewPage(t.data, uint64(loc.Page*pageSize)).Get(loc.Offset)
+}
+
+// batchChain reads the update chain of the tuple at a location as seen by a batch
+func (t *Table) batchChain(b *Batch, loc TupleLocation) (chain []version, err error) {
+	data := b.file(t.data)
+	read := func(loc TupleLocation) (Tuple, error) {
+		return NewPage(data, uint64(loc.Page*pageSize)).Get(loc.Offset)
+	}
+	stored, err := read(loc)
+	if err != nil {
+		return
+	}
+	return readChain(loc, stored, read)
+}
+
+// autoCommit runs an operation in a batch of its own and commits it,
+// within a transaction of its own if the table is versioned
+func (t *Table) autoCommit(op func(b *Batch) error) (err error) {
+	t.LockWrites()
+	defer t.UnlockWrites()
+	b := NewBatch()
+	if t.txm != nil {
+		var tx *Tx
+		tx, err = t.txm.Begin()
+		if err != nil {
+			return
+		}
+		defer tx.Finish()
+		b = NewTxBatch(tx)
+	}
+	err = op(b)
+	if err != nil {
+		return
+	}
+	return t.commit(b)
+}
+
+// take a snapshot for reading the latest tuples, nil if the table is not versioned
+func (t *Table) snapshot() *Snapshot {
+	if t.txm == nil {
+		return nil
+	}
+	return t.txm.Snapshot()
+}
+
+func (t *Table) release(s *Snapshot) {
+	if t.txm != nil {
+		t.txm.Release(s)
+	}
+}
+
+// the transaction id below which deleted tuples are invisible to everyone
+func (t *Table) horizon() Xid {
+	if t.txm == nil {
+		return 0
+	}
+	return t.txm.Horizon()
+}
+
+// storeTuple prepares a tuple to be stored in a page along with its header
+// a large tuple is compressed, and moved into the overflow file if still too large
+func (t *Table) storeTuple(b *Batch, header tupleHeader, tuple Tuple) (stored Tuple, err error) {
+	data := tuple
+	if tupleHeaderSize+len(data) > overflowThreshold && t.compress {
+		var compressed Tuple
+		var ok bool
+		compressed, ok, err = compressTuple(data)
+		if err != nil {
+			err = fmt.Errorf("failed to compress tuple: %w", err)
+			return
+		}
+		if ok {
+			data = compressed
+			header.flags |= tupleCompressed
+		}
+	}
+	if tupleHeaderSize+len(data) > overflowThreshold && t.ovf != nil {
+		data, err = writeOverflow(b.file(t.ovf), data)
+		if err != nil {
+			return
+		}
+		header.flags |= tupleExternal
+	}
+	stored = append(header.toBytes(), data...)
+	return
+}
+
+// loadTuple restores a tuple from the data stored in a page
+// reading it from the overflow file and decompressing it if needed
+func (t *Table) loadTuple(header tupleHeader, data Tuple) (tuple Tuple, err error) {
+	tuple = data
+	if header.flags&tupleExternal != 0 {
+		if t.ovf == nil {
+			err = errors.New("tuple stored in the overflow file but the table has none")
+			return
+		}
+		tuple, err = readOverflow(t.ovf, data)
+		if err != nil {
+			return
+		}
+	}
+	if header.flags&tupleCompressed != 0 {
+		tuple, err = decompressTuple(tuple)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// discard releases the overflow pages of a stored tuple being removed
+func (t *Table) discard(b *Batch, header tupleHeader, data Tuple) (err error) {
+	if header.flags&tupleExternal == 0 {
+		return
+	}
+	if t.ovf == nil {
+		return errors.New("tuple stored in the overflow file but the table has none")
+	}
+	return freeOverflow(b.file(t.ovf), data)
+}
+
+// dead tells whether a version of a tuple is deleted or updated and no longer visible to anyone
+func dead(header tupleHeader, horizon Xid) bool {
+	return header.flags&tupleRedirect != 0 || header.xmax != 0 && header.xmax < horizon
+}
+
+// alive returns the index of the first version in an update chain that is not dead
+// the versions before it are no longer visible to anyone, the same for the whole chain if it's len(chain)
+func alive(chain []version, horizon Xid) int {
+	for i, v := range chain {
+		if !dead(v.header, horizon) {
+			return i
+		}
+	}
+	return len(chain)
+}
+
+// commit makes the writes of an operation take effect,
+// going through the write-ahead log if there is one
+func (t *Table) commit(b *Batch) (err error) {
+	if t.wal != nil {
+		return t.wal.Commit(b)
+	}
+	return b.apply()
+}
+
+// Vacuum compacts every page of the table in place,
+// so that the space taken by deleted tuples can be reused by new ones.
+// Deleted tuples still visible to some snapshot are kept.
+// Each page is compacted in its own operation.
+// Tuples stay at their locations, while the locations of the removed ones may be reused
+func (t *Table) Vacuum() (err error) {
+	t.LockWrites()
+	defer t.UnlockWrites()
+	pageCount, err := t.countPages()
+	if err != nil {
+		return
+	}
+	horizon := t.horizon()
+	for i := int64(0); i < pageCount; i++ {
+		b := NewBatch()
+		b.touch(t)
+		page := NewPage(b.file(t.data), uint64(i*pageSize))
+		err = t.prune(b, page, horizon)
+		if err != nil {
+			err = fmt.Errorf("failed to prune page %d: %w", i, err)
+			return
+		}
+		var free uint32
+		free, err = page.Vacuum()
+		if err != nil {
+			err = fmt.Errorf("failed to vacuum page %d: %w", i, err)
+			return
+		}
+		err = updateFsm(b.file(t.fsm), i, free)
+		if err != nil {
+			return
+		}
+		err = t.commit(b)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// prune removes the versions of the tuples in a page that are no longer visible to anyone
+// the first version of a tuple is left as a redirect to the next version kept,
+// so that the tuple keeps its location
+func (t *Table) prune(b *Batch, page *Page, horizon Xid) (err error) {
+	tuples, indexes, err := page.readTuples()
+	if err != nil {
+		return
+	}
+	pageIdx := int64(page.offset / pageSize)
+	for i, tuple := range tuples {
+		var header tupleHeader
+		header, _, err = decodeTuple(tuple)
+		if err != nil {
+			return
+		}
+		if header.flags&tupleHeapOnly != 0 {
+			// pruned along with the first version
+			continue
+		}
+		var chain []version
+		chain, err = t.batchChain(b, TupleLocation{Page: pageIdx, Offset: indexes[i]})
+		if err != nil {
+			return
+		}
+		first := alive(chain, horizon)
+		if first == 0 || first == 1 && chain[0].header.flags&tupleRedirect != 0 {
+			continue
+		}
+		for j, v := range chain[:first] {
+			err = t.discard(b, v.header, v.data)
+			if err != nil {
+				return
+			}
+			if j == 0 && first < len(chain) {
+				// the first version holds the location of the tuple
+				redirect := tupleHeader{
+					xmin:  v.header.xmin,
+					xmax:  chain[first].header.xmin,
+					flags: tupleUpdated | tupleRedirect,
+					next:  chain[first].loc,
+				}
+				_, err = page.Replace(v.loc.Offset, redirect.toBytes())
+			} else {
+				err = NewPage(b.file(t.data), uint64(v.loc.Page*pageSize)).Remove(v.loc.Offset)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// VacuumFull rewrites the whole table, packing all remaining tuples
+// into as few pages as possible and truncating the pages left empty.
+// The versions of a tuple still visible to some snapshot are packed next to each other.
+// The rewrite is a single operation, so the whole table is buffered in memory,
+// and a logged table too large for one log record is refused.
+// Note that tuples are moved, so their locations change after vacuuming
+func (t *Table) VacuumFull() (err error) {
+	t.LockWrites()
+	defer t.UnlockWrites()
+	horizon := t.horizon()
+	b := NewBatch()
+	b.touch(t)
+	data, fsm := b.file(t.data), b.file(t.fsm)
+	size, err := data.Size()
+	if err != nil {
+		return
+	}
+	if t.wal != nil && size > maxWalRecordSize {
+		err = fmt.Errorf("table of %d bytes is too large to be fully vacuumed in one wal record", size)
+		return
+	}
+	pageCount := size / pageSize
+
+	// read the versions of all tuples to keep before any page is written
+	var chains [][]version
+	for i := int64(0); i < pageCount; i++ {
+		var tuples []Tuple
+		var indexes []uint32
+		tuples, indexes, err = NewPage(data, uint64(i*pageSize)).readTuples()
+		if err != nil {
+			return
+		}
+		for j, tuple := range tuples {
+			var header tupleHeader
+			header, _, err = decodeTuple(tuple)
+			if err != nil {
+				return
+			}
+			if header.flags&tupleHeapOnly != 0 {
+				continue
+			}
+			var chain []version
+			chain, err = t.batchChain(b, TupleLocation{Page: i, Offset: indexes[j]})
+			if err != nil {
+				return
+			}
+			first := alive(chain, horizon)
+			for _, v := range chain[:first] {
+				err = t.discard(b, v.header, v.data)
+				if err != nil {
+					return
+				}
+			}
+			if first < len(chain) {
+				chains = append(chains, chain[first:])
+			}
+		}
+	}
+
+	// lay out the versions in order, so that each of them knows the location of the next one
+	var locations [][]TupleLocation
+	var page int64
+	var count, used uint32
+	for _, chain := range chains {
+		var locs []TupleLocation
+		for _, v := range chain {
+			tupleSize := uint32(tupleHeaderSize + len(v.data))
+			if !tuplesFit(count+1, used+tupleSize) {
+				page++
+				count, used = 0, 0
+			}
+			locs = append(locs, TupleLocation{Page: page, Offset: count})
+			count++
+			used += tupleSize
+		}
+		locations = append(locations, locs)
+	}
+
+	var pending []Tuple
+	var capacities []byte
+	flush := func() error {
+		image, header := newPageImage(pending, nil)
+		_, err := data.WriteAt(image, int64(len(capacities))*pageSize)
+		if err != nil {
+			return err
+		}
+		capacities = append(capacities, fsmFreeSpaceToCapacity(header.freeSpace()))
+		pending = nil
+		return nil
+	}
+	for i, chain := range chains {
+		for j, v := range chain {
+			if locations[i][j].Page > int64(len(capacities)) {
+				err = flush()
+				if err != nil {
+					return
+				}
+			}
+			header := v.header
+			if j == 0 {
+				// the first version kept holds the location of the tuple
+				header.flags &^= tupleHeapOnly
+			}
+			if j+1 < len(chain) {
+				header.next = locations[i][j+1]
+			}
+			pending = append(pending, append(header.toBytes(), v.data...))
+		}
+	}
+	if len(pending) > 0 {
+		err = flush()
+		if err != nil {
+			return
+		}
+	}
+
+	err = data.Truncate(int64(len(capacities)) * pageSize)
+	if err != nil {
+		return
+	}
+	_, err = fsm.WriteAt(capacities, 0)
+	if err != nil {
+		return
+	}
+	err = fsm.Truncate(int64(len(capacities)))
+	if err != nil {
+		return
+	}
+	return t.commit(b)
+}
+
 func (t *Table) Flush() (err error) {
-	err = t.Data.Sync()
+	err = t.data.Sync()
 	if err != nil {
 		err = fmt.Errorf("failed to flush table Data file: %w", err)
 		return
 	}
-	err = t.Fsm.Sync()
+	err = t.fsm.Sync()
 	if err != nil {
 		err = fmt.Errorf("failed to flush table Fsm file: %w", err)
 		return
 	}
+	if t.ovf != nil {
+		err = t.ovf.Sync()
+		if err != nil {
+			err = fmt.Errorf("failed to flush table overflow file: %w", err)
+			return
+		}
+	}
 	return
 }
 
+// Close flushes the table and stops using its files
+// the files themselves are left open
 func (t *Table) Close() (err error) {
 	err = t.Flush()
 	if err != nil {
 		return
 	}
+	for _, f := range []dataFile{t.data, t.fsm, t.ovf} {
+		if pooled, ok := f.(*pooledFile); ok {
+			err = pooled.release()
+			if err != nil {
+				return
+			}
+		}
+	}
+	if t.wal != nil {
+		t.wal.unregister(t)
+	}
+	return
+}
+
+// count the pages in the Data file
+func (t *Table) countPages() (count int64, err error) {
+	size, err := t.data.Size()
+	if err != nil {
+		return
+	}
+	if size%pageSize != 0 {
+		log.Warn().Msgf("size of file %s %d is not a multiple of the page size %d", t.Data.Name(), size, pageSize)
+	}
+	count = size / pageSize
 	return
 }
 
 // find the page index that can hold a tuple with size |minSize|
-func (t *Table) getFreePageIndex(minSize uint32) (idx int64, err error) {
+func getFreePageIndex(fsm *shadowFile, minSize uint32) (idx int64, err error) {
 	chunkSize := 1024
 	buff := make([]byte, chunkSize)
 	for i := 0; ; i++ {
-		_, err = t.Fsm.Seek(0, io.SeekStart)
-		if err != nil {
-			return
-		}
 		var read int
-		read, err = t.Fsm.Read(buff)
+		read, err = fsm.ReadAt(buff, int64(i*chunkSize))
 		if read == 0 {
 			return -1, nil
 		}
 		// find a free page from the bytes read from FSM
 		// this is a simplified version of
 		// https://github.com/postgres/postgres/blob/7db0cde6b58eef2ba0c70437324cbc7622230320/src/backend/storage/freespace/README
-		for j, b := range buff {
+		for j, b := range buff[:read] {
 			freeSpace := fsmCapacityToFreeSpace(b)
 			if freeSpace >= minSize {
 				// found the index of the page that has enough room for the new tuple
-				idx = int64(i*chunkSize + j)
-				return
+				return int64(i*chunkSize + j), nil
 			}
 		}
 		// err check is placed after is because it's possible
@@ -180,14 +1050,13 @@ func (t *Table) getFreePageIndex(minSize uint32) (idx int64, err error) {
 
 // allocate a new page at the end of the table file, so that we can hold more Data
 // returns the new page index
-func (t *Table) allocateNewPage() (idx int64, err error) {
-	// seek to the end of the FSM file
-	// and add a new byte indicating a new page
-	offset, err := t.Fsm.Seek(0, io.SeekEnd)
+func allocateNewPage(fsm *shadowFile) (idx int64, err error) {
+	// add a new byte at the end of the FSM file indicating a new page
+	offset, err := fsm.Size()
 	if err != nil {
 		return
 	}
-	_, err = t.Fsm.Write([]byte{0})
+	_, err = fsm.WriteAt([]byte{0}, offset)
 	if err != nil {
 		err = fmt.Errorf("failed to write new FSM byte: %w", err)
 		return
@@ -197,9 +1066,9 @@ func (t *Table) allocateNewPage() (idx int64, err error) {
 }
 
 // update the remaining free space for a page in the Fsm file
-func (t *Table) updateFsm(idx int64, freeSpace uint32) (err error) {
+func updateFsm(fsm *shadowFile, idx int64, freeSpace uint32) (err error) {
 	capacity := fsmFreeSpaceToCapacity(freeSpace)
-	_, err = t.Fsm.WriteAt([]byte{capacity}, idx)
+	_, err = fsm.WriteAt([]byte{capacity}, idx)
 	if err != nil {
 		return
 	}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -28,7 +30,7 @@ func TestTableCRD(t *testing.T) {
 	table := NewTable(data, fsm)
 	defer table.Close()
 	for _, item := range inputTuples {
-		err := table.Add(item)
+		_, err := table.Add(item)
 		assert.NoError(t, err)
 	}
 
@@ -49,6 +51,7 @@ func TestTableCRD(t *testing.T) {
 
 	// retrieve again
 	outputTuples = []Tuple{}
+	locations = []TupleLocation{}
 	err = table.Scan(func(t Tuple, loc TupleLocation) (bool, error) {
 		outputTuples = append(outputTuples, t)
 		locations = append(locations, loc)
@@ -57,6 +60,13 @@ func TestTableCRD(t *testing.T) {
 	assert.NoError(t, err)
 	// no middle one
 	assert.EqualValues(t, append(inputTuples[:1], inputTuples[2:]...), outputTuples)
+	// locations still point at the same tuples
+	assert.EqualValues(t, []TupleLocation{{Page: 0, Offset: 0}, {Page: 0, Offset: 2}}, locations)
+	tuple, err := table.Get(locations[1])
+	assert.NoError(t, err)
+	assert.EqualValues(t, inputTuples[2], tuple)
+	_, err = table.Get(TupleLocation{Page: 0, Offset: 1})
+	assert.ErrorIs(t, err, ErrTupleNotFound)
 }
 
 func TestTableWriteAndReadBulk(t *testing.T) {
@@ -85,7 +95,7 @@ func TestTableWriteAndReadBulk(t *testing.T) {
 	table := NewTable(data, fsm)
 	defer table.Close()
 	for _, item := range inputTuples {
-		err := table.Add(item)
+		_, err := table.Add(item)
 		assert.NoError(t, err)
 	}
 
@@ -96,4 +106,187 @@ func TestTableWriteAndReadBulk(t *testing.T) {
 	})
 	assert.NoError(t, err)
 	assert.EqualValues(t, inputTuples, outputTuples)
+
+	// or a page at a time
+	pageCount, err := table.PageCount()
+	assert.NoError(t, err)
+	assert.Greater(t, pageCount, int64(1))
+	outputTuples = []Tuple{}
+	for i := int64(0); i < pageCount; i++ {
+		cont, err := table.ScanPage(nil, i, 0, func(t Tuple, loc TupleLocation) (bool, error) {
+			outputTuples = append(outputTuples, t)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, cont)
+	}
+	assert.EqualValues(t, inputTuples, outputTuples)
+	var offsets []uint32
+	cont, err := table.ScanPage(nil, 0, 5, func(t Tuple, loc TupleLocation) (bool, error) {
+		offsets = append(offsets, loc.Offset)
+		return len(offsets) < 2, nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, cont)
+	assert.Equal(t, []uint32{5, 6}, offsets)
+}
+
+func TestTableUpdate(t *testing.T) {
+	data, err := ioutil.TempFile("", "gled_ut_tbl_data_*")
+	assert.NoError(t, err)
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	fsm, err := ioutil.TempFile("", "gled_ut_tbl_fsm_*")
+	assert.NoError(t, err)
+	defer os.Remove(fsm.Name())
+	defer fsm.Close()
+
+	table := NewTable(data, fsm)
+	defer table.Close()
+	loc, err := table.Add(Tuple("a"))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = table.Add(Tuple(fmt.Sprintf("%050d", i)))
+		assert.NoError(t, err)
+	}
+
+	// rewritten in its page
+	assert.NoError(t, table.Update(loc, Tuple("b")))
+	tuple, err := table.Get(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple("b"), tuple)
+
+	// moved into another page, twice
+	for _, size := range []int{1500, 1800} {
+		large := Tuple(fmt.Sprintf("%0*d", size, 0))
+		assert.NoError(t, table.Update(loc, large))
+		tuple, err = table.Get(loc)
+		assert.NoError(t, err)
+		assert.Equal(t, large, tuple)
+		tuples := scanTable(t, table)
+		assert.Equal(t, 101, len(tuples))
+		assert.Equal(t, large, tuples[0])
+	}
+
+	assert.NoError(t, table.Delete(loc))
+	_, err = table.Get(loc)
+	assert.ErrorIs(t, err, ErrTupleNotFound)
+	assert.Equal(t, 100, len(scanTable(t, table)))
+}
+
+func TestTableVacuum(t *testing.T) {
+	data, err := ioutil.TempFile("", "gled_ut_tbl_data_*")
+	assert.NoError(t, err)
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	fsm, err := ioutil.TempFile("", "gled_ut_tbl_fsm_*")
+	assert.NoError(t, err)
+	defer os.Remove(fsm.Name())
+	defer fsm.Close()
+
+	table := NewTable(data, fsm)
+	defer table.Close()
+	// 3 pages of tuples, each of 40 bytes along with its header
+	tuple := Tuple("012345678901234")
+	for i := 0; i < 500; i++ {
+		_, err = table.Add(tuple)
+		assert.NoError(t, err)
+	}
+	pageCount, err := table.countPages()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, pageCount)
+
+	// delete all tuples of the first page
+	locations := []TupleLocation{}
+	err = table.Scan(func(t Tuple, loc TupleLocation) (bool, error) {
+		if loc.Page == 0 {
+			locations = append(locations, loc)
+		}
+		return true, nil
+	})
+	assert.NoError(t, err)
+	for _, loc := range locations {
+		assert.NoError(t, table.Delete(loc))
+	}
+
+	// the first page is reused after vacuuming
+	assert.NoError(t, table.Vacuum())
+	_, err = table.Add(tuple)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 500-len(locations)+1, len(scanTable(t, table)))
+	pageCount, err = table.countPages()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, pageCount)
+
+	// the full rewrite packs remaining tuples into 2 pages
+	assert.NoError(t, table.VacuumFull())
+	pageCount, err = table.countPages()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, pageCount)
+	info, err := fsm.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, info.Size())
+	tuples := scanTable(t, table)
+	assert.EqualValues(t, 500-len(locations)+1, len(tuples))
+	for _, tp := range tuples {
+		assert.EqualValues(t, tuple, tp)
+	}
+}
+
+func scanTable(t *testing.T, table *Table) []Tuple {
+	tuples := []Tuple{}
+	err := table.Scan(func(tp Tuple, loc TupleLocation) (bool, error) {
+		tuples = append(tuples, tp)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return tuples
+}
+
+func TestTableConcurrentAccess(t *testing.T) {
+	table, wal, txm := openVersionedTable(t, t.TempDir())
+	defer wal.Close()
+	defer txm.Close()
+	defer table.Close()
+
+	const writers, perWriter = 4, 200
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				loc, err := table.Add(Tuple(fmt.Sprintf("tuple-%d-%04d", w, i)))
+				assert.NoError(t, err)
+				// every other tuple is deleted right away
+				if i%2 == 1 {
+					assert.NoError(t, table.Delete(loc))
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := table.Scan(func(tuple Tuple, loc TupleLocation) (bool, error) {
+					// tuples are never seen half written
+					assert.Regexp(t, `^tuple-\d-\d{4}$`, string(tuple))
+					return true, nil
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, tuple := range scanTable(t, table) {
+		assert.False(t, seen[string(tuple)])
+		seen[string(tuple)] = true
+	}
+	assert.Equal(t, writers*perWriter/2, len(seen))
 }
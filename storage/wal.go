@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// name of the write-ahead log file within a db directory
+	walFileName = "gled.wal"
+	// the log is checkpointed and truncated once it grows beyond this size
+	walCheckpointSize = 4 * 1024 * 1024
+	// size of the length + checksum prefix of a log record
+	walRecordHeaderSize = 8
+)
+
+var (
+	errWalTruncated = errors.New("truncated wal record")
+	// largest payload of a log record, whose length is stored in 4 bytes
+	// a variable so that tests can lower it
+	maxWalRecordSize int64 = math.MaxUint32
+)
+
+// Wal is a write-ahead log shared by all tables within a directory.
+//
+// Every table operation is written into the log as one record and fsynced
+// before any of its writes reach the table files. The records are physical,
+// i.e. (file, offset, bytes) triples, so that redoing them is idempotent and
+// the log can simply be replayed from the beginning after a crash.
+type Wal struct {
+	dir  string
+	file *os.File
+	// size of the valid content in the log file
+	size int64
+	// tables whose files have to be flushed before the log can be truncated
+	tables map[*Table]struct{}
+	mu     sync.Mutex
+}
+
+// OpenWal opens the write-ahead log in a directory,
+// replaying any operation left in it by a previous crash
+func OpenWal(dir string) (wal *Wal, err error) {
+	walPath := filepath.Join(dir, walFileName)
+	file, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		err = fmt.Errorf("failed to open wal file %s: %w", walPath, err)
+		return
+	}
+	wal = &Wal{
+		dir:    dir,
+		file:   file,
+		tables: map[*Table]struct{}{},
+	}
+	err = wal.recover()
+	if err != nil {
+		_ = file.Close()
+		wal = nil
+		return
+	}
+	return
+}
+
+// Close checkpoints and closes the log
+func (w *Wal) Close() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.checkpoint()
+	if err != nil {
+		return
+	}
+	err = w.file.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to close wal file: %w", err)
+		return
+	}
+	return
+}
+
+func (w *Wal) register(t *Table) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tables[t] = struct{}{}
+}
+
+func (w *Wal) unregister(t *Table) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.tables, t)
+}
+
+// Commit logs a batch and then applies it to the table files,
+// so that either all or none of its writes take effect
+func (w *Wal) Commit(b *Batch) (err error) {
+	if b.empty() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.append(b)
+	if err != nil {
+		return
+	}
+	err = b.apply()
+	if err != nil {
+		return
+	}
+	if w.size >= walCheckpointSize {
+		err = w.checkpoint()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// append writes a batch into the log and makes it durable
+func (w *Wal) append(b *Batch) (err error) {
+	record, err := encodeWalRecord(b)
+	if err != nil {
+		return
+	}
+	_, err = w.file.WriteAt(record, w.size)
+	if err != nil {
+		err = fmt.Errorf("failed to write wal record: %w", err)
+		return
+	}
+	err = w.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync wal file: %w", err)
+		return
+	}
+	w.size += int64(len(record))
+	return
+}
+
+// Checkpoint flushes all opened tables and empties the log,
+// after which the log no longer refers to any file
+func (w *Wal) Checkpoint() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.checkpoint()
+}
+
+// checkpoint flushes all registered tables so that the log is no longer needed,
+// and truncates it
+func (w *Wal) checkpoint() (err error) {
+	for t := range w.tables {
+		err = t.Flush()
+		if err != nil {
+			return
+		}
+	}
+	return w.truncate()
+}
+
+func (w *Wal) truncate() (err error) {
+	err = w.file.Truncate(0)
+	if err != nil {
+		err = fmt.Errorf("failed to truncate wal file: %w", err)
+		return
+	}
+	err = w.file.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync wal file: %w", err)
+		return
+	}
+	w.size = 0
+	return
+}
+
+// recover redoes all operations recorded in the log and truncates it
+func (w *Wal) recover() (err error) {
+	content, err := os.ReadFile(w.file.Name())
+	if err != nil {
+		err = fmt.Errorf("failed to read wal file: %w", err)
+		return
+	}
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	replayed := 0
+	for len(content) > 0 {
+		var writes []walWrite
+		var size int
+		writes, size, err = decodeWalRecord(content)
+		if err != nil {
+			// a torn record at the end of the log belongs to an operation
+			// that was never applied, thus can be safely dropped
+			log.Warn().Err(err).Msgf("dropping %d trailing bytes of wal %s", len(content), w.file.Name())
+			err = nil
+			break
+		}
+		for _, write := range writes {
+			file, exists := files[write.name]
+			if !exists {
+				file, err = os.OpenFile(filepath.Join(w.dir, write.name), os.O_RDWR|os.O_CREATE, filePerm)
+				if err != nil {
+					err = fmt.Errorf("failed to open %s for wal replay: %w", write.name, err)
+					return
+				}
+				files[write.name] = file
+			}
+			if write.truncate {
+				err = file.Truncate(write.offset)
+			} else {
+				_, err = file.WriteAt(write.data, write.offset)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to replay wal write into %s: %w", write.name, err)
+				return
+			}
+		}
+		content = content[size:]
+		replayed++
+	}
+	for name, f := range files {
+		err = f.Sync()
+		if err != nil {
+			err = fmt.Errorf("failed to sync %s after wal replay: %w", name, err)
+			return
+		}
+	}
+	if replayed > 0 {
+		log.Info().Msgf("replayed %d wal records from %s", replayed, w.file.Name())
+	}
+	return w.truncate()
+}
+
+// walWrite is a write recorded in the log
+type walWrite struct {
+	// name of the written file, relative to the log directory
+	name   string
+	offset int64
+	data   []byte
+	// whether the file is truncated to offset instead of written
+	truncate bool
+}
+
+// encodeWalRecord encodes all writes in a batch into a log record:
+// | length (4) | crc32 (4) | write count (4) | writes... |
+// where each write is
+// | truncate flag (1) | name length (2) | name | offset (8) | data length (4) | data |
+// A batch too large for the length is refused, rather than logged as a record that reads as torn
+func encodeWalRecord(b *Batch) (record []byte, err error) {
+	size := int64(4)
+	for _, f := range b.files {
+		for _, w := range f.writes {
+			size += int64(15 + len(filepath.Base(f.file.Name())) + len(w.data))
+		}
+	}
+	if size > maxWalRecordSize {
+		err = fmt.Errorf("wal record of %d bytes exceeds the limit of %d bytes", size, maxWalRecordSize)
+		return
+	}
+	payload := make([]byte, 4)
+	count := uint32(0)
+	for _, f := range b.files {
+		name := filepath.Base(f.file.Name())
+		for _, w := range f.writes {
+			if w.truncate {
+				payload = append(payload, 1)
+			} else {
+				payload = append(payload, 0)
+			}
+			payload = append(payload, uint16ToBytes(uint16(len(name)))...)
+			payload = append(payload, name...)
+			payload = append(payload, uint64ToBytes(uint64(w.offset))...)
+			payload = append(payload, uint32ToBytes(uint32(len(w.data)))...)
+			payload = append(payload, w.data...)
+			count++
+		}
+	}
+	endian.PutUint32(payload, count)
+
+	record = make([]byte, walRecordHeaderSize, walRecordHeaderSize+len(payload))
+	endian.PutUint32(record[0:4], uint32(len(payload)))
+	endian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	return
+}
+
+// decodeWalRecord decodes the log record at the beginning of data
+// returns the recorded writes and the size of the record
+func decodeWalRecord(data []byte) (writes []walWrite, size int, err error) {
+	if len(data) < walRecordHeaderSize {
+		err = errWalTruncated
+		return
+	}
+	length := int(endian.Uint32(data[0:4]))
+	checksum := endian.Uint32(data[4:8])
+	size = walRecordHeaderSize + length
+	if len(data) < size {
+		err = errWalTruncated
+		return
+	}
+	payload := data[walRecordHeaderSize:size]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		err = errors.New("wal record checksum mismatch")
+		return
+	}
+
+	r := byteReader{data: payload}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		truncate := r.bytes(1)
+		name := string(r.bytes(int(r.uint16())))
+		offset := int64(r.uint64())
+		content := r.bytes(int(r.uint32()))
+		if r.err == nil && filepath.Base(name) != name {
+			err = fmt.Errorf("invalid file name in wal record: %s", name)
+			return
+		}
+		writes = append(writes, walWrite{
+			name:     name,
+			offset:   offset,
+			data:     content,
+			truncate: len(truncate) == 1 && truncate[0] == 1,
+		})
+	}
+	if r.err != nil {
+		err = r.err
+		return
+	}
+	return
+}
+
+// byteReader reads big-endian values from a byte slice,
+// remembering the first out-of-range read
+type byteReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *byteReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return endian.Uint16(b)
+}
+
+func (r *byteReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return endian.Uint32(b)
+}
+
+func (r *byteReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return endian.Uint64(b)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openWalTable(t *testing.T, dir string, wal *Wal) *Table {
+	data, err := os.OpenFile(filepath.Join(dir, "tbl.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	fsm, err := os.OpenFile(filepath.Join(dir, "tbl.fsm.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+	assert.NoError(t, err)
+	table, err := OpenTable(data, fsm, TableOptions{Wal: wal})
+	assert.NoError(t, err)
+	return table
+}
+
+func TestWalRecovery(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	table := openWalTable(t, dir, wal)
+
+	_, err = table.Add(Tuple("committed"))
+	assert.NoError(t, err)
+
+	// log an operation but crash before applying it to the table files
+	b := NewBatch()
+	_, err = table.BatchAdd(b, Tuple("logged only"))
+	assert.NoError(t, err)
+	err = wal.append(b)
+	assert.NoError(t, err)
+	assert.NoError(t, table.Data.Close())
+	assert.NoError(t, table.Fsm.Close())
+	assert.NoError(t, wal.file.Close())
+
+	// reopening replays the log
+	wal, err = OpenWal(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+	info, err := wal.file.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, info.Size())
+
+	table = openWalTable(t, dir, wal)
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+	assert.EqualValues(t, []Tuple{Tuple("committed"), Tuple("logged only")}, scanTable(t, table))
+}
+
+func TestWalTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	table := openWalTable(t, dir, wal)
+
+	b := NewBatch()
+	_, err = table.BatchAdd(b, Tuple("half written"))
+	assert.NoError(t, err)
+	record, err := encodeWalRecord(b)
+	assert.NoError(t, err)
+	// only part of the record made it to disk
+	_, err = wal.file.WriteAt(record[:len(record)/2], 0)
+	assert.NoError(t, err)
+	assert.NoError(t, table.Data.Close())
+	assert.NoError(t, table.Fsm.Close())
+	assert.NoError(t, wal.file.Close())
+
+	wal, err = OpenWal(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+	table = openWalTable(t, dir, wal)
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+	assert.EqualValues(t, []Tuple{}, scanTable(t, table))
+}
+
+func TestShadowFileReadsOwnWrites(t *testing.T) {
+	file, err := os.CreateTemp("", "gled_ut_shadow_*")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = file.WriteAt([]byte("abcdef"), 0)
+	assert.NoError(t, err)
+
+	shadow := newShadowFile(osFile{file})
+	_, err = shadow.WriteAt([]byte("XY"), 4)
+	assert.NoError(t, err)
+	_, err = shadow.WriteAt([]byte("Z"), 8)
+	assert.NoError(t, err)
+
+	buffer := make([]byte, 9)
+	n, err := shadow.ReadAt(buffer, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, n)
+	assert.Equal(t, []byte("abcdXY\x00\x00Z"), buffer)
+
+	// the file itself is untouched until the shadow is applied
+	content, err := os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcdef"), content)
+	assert.NoError(t, shadow.apply())
+	content, err = os.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcdXY\x00\x00Z"), content)
+}
+
+func TestWalBatchAcrossTables(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	openTable := func(name string) *Table {
+		data, err := os.OpenFile(filepath.Join(dir, name+".gled"), os.O_RDWR|os.O_CREATE, filePerm)
+		assert.NoError(t, err)
+		fsm, err := os.OpenFile(filepath.Join(dir, name+".fsm.gled"), os.O_RDWR|os.O_CREATE, filePerm)
+		assert.NoError(t, err)
+		table, err := OpenTable(data, fsm, TableOptions{Wal: wal})
+		assert.NoError(t, err)
+		return table
+	}
+	table1, table2 := openTable("tbl1"), openTable("tbl2")
+
+	b := NewBatch()
+	_, err = table1.BatchAdd(b, Tuple("first"))
+	assert.NoError(t, err)
+	_, err = table1.BatchAdd(b, Tuple("second"))
+	assert.NoError(t, err)
+	_, err = table2.BatchAdd(b, Tuple("third"))
+	assert.NoError(t, err)
+	// nothing is visible before committed
+	assert.Empty(t, scanTable(t, table1))
+	assert.NoError(t, wal.Commit(b))
+	assert.EqualValues(t, []Tuple{Tuple("first"), Tuple("second")}, scanTable(t, table1))
+	assert.EqualValues(t, []Tuple{Tuple("third")}, scanTable(t, table2))
+
+	for _, table := range []*Table{table1, table2} {
+		assert.NoError(t, table.Close())
+		assert.NoError(t, table.Data.Close())
+		assert.NoError(t, table.Fsm.Close())
+	}
+	assert.NoError(t, wal.Close())
+}
+
+func TestWalRecordLimit(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir)
+	assert.NoError(t, err)
+	defer wal.Close()
+	table := openWalTable(t, dir, wal)
+	defer table.Data.Close()
+	defer table.Fsm.Close()
+	defer table.Close()
+	for i := 0; i < 500; i++ {
+		_, err = table.Add(Tuple("012345678901234"))
+		assert.NoError(t, err)
+	}
+
+	limit := maxWalRecordSize
+	defer func() { maxWalRecordSize = limit }()
+	maxWalRecordSize = 2 * pageSize
+	// the table takes 3 pages, too large to be rewritten in one record
+	assert.Error(t, table.VacuumFull())
+	b := NewBatch()
+	_, err = b.file(table.data).WriteAt(make([]byte, 3*pageSize), 0)
+	assert.NoError(t, err)
+	_, err = encodeWalRecord(b)
+	assert.Error(t, err)
+	assert.Error(t, wal.Commit(b))
+	assert.Equal(t, 500, len(scanTable(t, table)))
+
+	maxWalRecordSize = limit
+	assert.NoError(t, table.VacuumFull())
+	assert.Equal(t, 500, len(scanTable(t, table)))
+}
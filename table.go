@@ -7,6 +7,7 @@ import (
 	"github.com/luminocean/gled/storage"
 	"github.com/vmihailenco/msgpack/v5"
 	"regexp"
+	"sync"
 )
 
 const (
@@ -18,8 +19,35 @@ var (
 	tableNameRegex = regexp.MustCompile(`^[0-9a-zA-Z_-]{1,32}$`)
 )
 
+// baseTable is the part of a table that does not depend on the item type
+type baseTable struct {
+	// db the table belongs to
+	db *GledDB
+	// name of the table
+	name    string
+	table   *storage.Table
+	indexes []*index
+	// schema version of the items and the migrations of older ones
+	versions schemaVersions
+	// held for reading by selects and writes, which rely on the indexes,
+	// and for writing by operations replacing the indexes
+	mu sync.RWMutex
+	// number of handles sharing the table, guarded by the db
+	refs int
+	// constraints declared by the item type, guarded by mu
+	constraints constraints
+	// largest integer primary key given, loaded on the first insert with a generated key.
+	// Guarded by the write lock of the table
+	lastKey   int64
+	keyLoaded bool
+	// number of times the items are moved by a full vacuum, guarded by mu
+	relocations int
+}
+
+// GledTable is a table of items of type T
+// a table is safe for concurrent use by multiple goroutines
 type GledTable[T any] struct {
-	table *storage.Table
+	*baseTable
 }
 
 func (t *GledTable[T]) Insert(item T) (err error) {
@@ -28,7 +56,7 @@ func (t *GledTable[T]) Insert(item T) (err error) {
 		err = fmt.Errorf("failed to marshal item into JSON: %w", err)
 		return
 	}
-	err = t.table.Add(data)
+	err = t.db.autoCommit([]txOp{{table: t.baseTable, tuple: data}})
 	if err != nil {
 		err = fmt.Errorf("failed to insert item: %w", err)
 		return
@@ -36,42 +64,276 @@ func (t *GledTable[T]) Insert(item T) (err error) {
 	return
 }
 
-func (t *GledTable[T]) Select(ex exp.Ex) (items []T, locations []storage.TupleLocation, err error) {
-	err = t.table.Scan(func(tuple storage.Tuple, loc storage.TupleLocation) (cont bool, err error) {
-		var unmarshalled map[string]any
-		err = msgpack.Unmarshal(tuple, &unmarshalled)
-		if err != nil {
-			return
-		}
-		pass := exp.Eval(unmarshalled, ex)
-		if pass {
-			var item T
-			err = msgpack.Unmarshal(tuple, &item)
-			if err != nil {
-				return
-			}
-			items = append(items, item)
-			locations = append(locations, loc)
+// Order is the order of the values of a column to sort items by
+type Order int
+
+const (
+	// Asc sorts nil first, then numbers from the smallest, then strings lexically
+	Asc Order = iota
+	// Desc sorts in the reverse of Asc
+	Desc
+)
+
+// SelectOption is an option of Select
+type SelectOption func(q *selectQuery)
+
+// selectQuery is the options of a select
+type selectQuery struct {
+	orderBy []sortKey
+	// max number of items to select, negative if there's no limit
+	limit int
+	// number of items to skip
+	offset int
+	// the item to select after, nil to select from the first
+	after *sortRow
+	// error of the options, returned when selecting
+	err error
+}
+
+func newSelectQuery(opts []SelectOption) *selectQuery {
+	q := &selectQuery{limit: -1}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// OrderBy sorts the selected items by a column, after the columns of OrderBy options given before it.
+// Items too many to sort in memory are sorted in temporary files in the db directory
+func OrderBy(column string, order Order) SelectOption {
+	return func(q *selectQuery) {
+		q.orderBy = append(q.orderBy, sortKey{column: exp.C(column), order: order})
+	}
+}
+
+// Limit selects no more than n items, the first n in the order of OrderBy if given
+// a negative n means no limit
+func Limit(n int) SelectOption {
+	return func(q *selectQuery) {
+		q.limit = n
+	}
+}
+
+// Offset skips the first n items, which are still scanned.
+// Use After to continue from where a previous select stopped instead
+func Offset(n int) SelectOption {
+	return func(q *selectQuery) {
+		if n > 0 {
+			q.offset = n
 		}
-		cont = true
+	}
+}
+
+// Select selects the items matching an expression along with their locations
+// a location identifies an item until it is deleted or the table is fully vacuumed.
+// Items are in the order of the table unless sorted by OrderBy, or found through an index.
+// Items inserted or deleted while selecting are not seen
+func (t *GledTable[T]) Select(ex exp.Ex, opts ...SelectOption) (items []T, locations []storage.TupleLocation, err error) {
+	return collect(t.Iter(ex, opts...))
+}
+
+// select the items visible in a snapshot
+func (t *GledTable[T]) selectSnapshot(s *storage.Snapshot, ex exp.Ex, opts ...SelectOption) (items []T, locations []storage.TupleLocation, err error) {
+	return collect(&Cursor[T]{c: t.newCursor(s, nil, ex, opts)})
+}
+
+// collect all items of a cursor
+func collect[T any](c *Cursor[T]) (items []T, locations []storage.TupleLocation, err error) {
+	defer c.Close()
+	for c.Next() {
+		items = append(items, c.Item())
+		locations = append(locations, c.Location())
+	}
+	return items, locations, c.Err()
+}
+
+// Get gets the item at a location without scanning the table
+// returns storage.ErrTupleNotFound if there's no item at the location
+func (t *GledTable[T]) Get(loc storage.TupleLocation) (item T, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	s := txm.Snapshot()
+	defer txm.Release(s)
+	return t.getSnapshot(s, loc)
+}
+
+// get the item at a location if it is visible in a snapshot
+func (t *GledTable[T]) getSnapshot(s *storage.Snapshot, loc storage.TupleLocation) (item T, err error) {
+	tuple, err := t.table.GetSnapshot(s, loc)
+	if err != nil {
+		err = fmt.Errorf("failed to get item at %v: %w", loc, err)
+		return
+	}
+	tuple, err = t.upgrade(tuple)
+	if err != nil {
+		return
+	}
+	err = msgpack.Unmarshal(tuple, &item)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal item: %w", err)
 		return
-	})
+	}
 	return
 }
 
 func (t *GledTable[T]) Delete(loc storage.TupleLocation) (err error) {
-	err = t.table.Delete(loc)
+	err = t.db.autoCommit([]txOp{{table: t.baseTable, kind: opDelete, loc: loc}})
+	if err != nil {
+		return
+	}
+	return
+}
+
+// Update replaces the item at a location, which stays the location of the item
+// returns storage.ErrTupleNotFound if there's no item at the location
+func (t *GledTable[T]) Update(loc storage.TupleLocation, item T) (err error) {
+	data, err := msgpack.Marshal(item)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal item: %w", err)
+		return
+	}
+	err = t.db.autoCommit([]txOp{{table: t.baseTable, kind: opUpdate, tuple: data, loc: loc}})
 	if err != nil {
+		err = fmt.Errorf("failed to update item: %w", err)
 		return
 	}
 	return
 }
 
+// UpdateWhere changes the items matching an expression with |fn| and updates them all at once
+// returns the number of items updated
+func (t *GledTable[T]) UpdateWhere(ex exp.Ex, fn func(item *T)) (count int, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	stx, err := txm.Begin()
+	if err != nil {
+		return
+	}
+	defer stx.Finish()
+	items, locations, err := t.selectSnapshot(stx.Snapshot(), ex)
+	if err != nil {
+		return
+	}
+	ops := make([]txOp, 0, len(items))
+	for i := range items {
+		fn(&items[i])
+		var data []byte
+		data, err = msgpack.Marshal(items[i])
+		if err != nil {
+			err = fmt.Errorf("failed to marshal item: %w", err)
+			return
+		}
+		ops = append(ops, txOp{table: t.baseTable, kind: opUpdate, tuple: data, loc: locations[i]})
+	}
+	err = t.db.apply(stx, ops)
+	if err != nil {
+		err = fmt.Errorf("failed to update items: %w", err)
+		return
+	}
+	return len(ops), nil
+}
+
+// DeleteWhere deletes the items matching an expression all at once
+// returns the number of items deleted
+func (t *GledTable[T]) DeleteWhere(ex exp.Ex) (count int, err error) {
+	_, txm, err := t.db.open()
+	if err != nil {
+		return
+	}
+	stx, err := txm.Begin()
+	if err != nil {
+		return
+	}
+	defer stx.Finish()
+	_, locations, err := t.selectSnapshot(stx.Snapshot(), ex)
+	if err != nil {
+		return
+	}
+	ops := make([]txOp, 0, len(locations))
+	for _, loc := range locations {
+		ops = append(ops, txOp{table: t.baseTable, kind: opDelete, loc: loc})
+	}
+	err = t.db.apply(stx, ops)
+	if err != nil {
+		err = fmt.Errorf("failed to delete items: %w", err)
+		return
+	}
+	return len(ops), nil
+}
+
+// Vacuum reclaims the space of deleted items and the older versions of updated ones within each page of the table.
+// Remaining items keep their locations
+func (t *GledTable[T]) Vacuum() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.table.Vacuum()
+	if err != nil {
+		err = fmt.Errorf("failed to vacuum table: %w", err)
+		return
+	}
+	// locations of the removed items may be reused, so they are dropped from indexes
+	return t.rebuildIndexes(t.indexes...)
+}
+
+// VacuumFull rewrites the whole table compactly, releasing pages left empty.
+// The rewrite is held in memory and logged as one operation, so tables over 4 GiB are refused.
+// Locations returned by previous selects are invalidated, and cursors iterating meanwhile fail with ErrTableVacuumed
+func (t *GledTable[T]) VacuumFull() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.table.VacuumFull()
+	if err != nil {
+		err = fmt.Errorf("failed to fully vacuum table: %w", err)
+		return
+	}
+	t.relocations++
+	return t.rebuildIndexes(t.indexes...)
+}
+
+// Close closes the handle of the table
+// the table itself is closed along with its last handle
 func (t *GledTable[T]) Close() (err error) {
+	return t.release()
+}
+
+// release a handle of the table, closing the table along with the last handle
+func (t *baseTable) release() (err error) {
+	db := t.db
+	db.mu.Lock()
+	if db.tables[t.name] != t {
+		db.mu.Unlock()
+		return fmt.Errorf("table %s already closed", t.name)
+	}
+	t.refs--
+	if t.refs > 0 {
+		db.mu.Unlock()
+		return
+	}
+	delete(db.tables, t.name)
+	db.mu.Unlock()
+	return t.close()
+}
+
+// close the files of the table and its indexes
+func (t *baseTable) close() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	errMsg := ""
+	// flush the table so that the write-ahead log no longer needs to cover it
+	flushErr := t.table.Close()
+	if flushErr != nil {
+		errMsg += fmt.Sprintf("failed to flush table: %s", flushErr)
+	}
 	dataCloseErr := t.table.Data.Close()
 	if dataCloseErr != nil {
-		errMsg += fmt.Sprintf("failed to close data file %s", t.table.Fsm.Name())
+		if errMsg != "" {
+			errMsg += "; "
+		}
+		errMsg += fmt.Sprintf("failed to close data file %s", t.table.Data.Name())
 	}
 	fsmCloseErr := t.table.Fsm.Close()
 	if fsmCloseErr != nil {
@@ -80,6 +342,22 @@ func (t *GledTable[T]) Close() (err error) {
 		}
 		errMsg += fmt.Sprintf("failed to close fsm file %s", t.table.Fsm.Name())
 	}
+	ovfCloseErr := t.table.Ovf.Close()
+	if ovfCloseErr != nil {
+		if errMsg != "" {
+			errMsg += "; "
+		}
+		errMsg += fmt.Sprintf("failed to close overflow file %s", t.table.Ovf.Name())
+	}
+	for _, idx := range t.indexes {
+		indexCloseErr := idx.close()
+		if indexCloseErr != nil {
+			if errMsg != "" {
+				errMsg += "; "
+			}
+			errMsg += fmt.Sprintf("failed to close index file %s", idx.file.Name())
+		}
+	}
 	if errMsg != "" {
 		err = errors.New(errMsg)
 		return
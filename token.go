@@ -0,0 +1,102 @@
+package gled
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	// ErrInvalidToken is returned when selecting after a resume token that is malformed,
+	// made by a select sorted differently, or through an index the select is not planned with
+	ErrInvalidToken = errors.New("invalid resume token")
+)
+
+// resumeToken is the position of an item in the order of a select
+// encoded with msgpack and then base64, so that it can be passed around as an opaque string
+type resumeToken struct {
+	Page   int64
+	Offset uint32
+	// values of the sort keys, if sorted
+	Keys []any
+	// the column of the index the item is found through and its key in the index, if unsorted
+	Index string
+	Key   []byte
+}
+
+// token of the position of a row
+func encodeToken(row *sortRow) string {
+	// keys are numbers, strings or nil, which are always marshalled
+	data, _ := msgpack.Marshal(resumeToken{Page: row.loc.Page, Offset: row.loc.Offset, Keys: row.keys, Index: string(row.index), Key: row.key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeToken decodes the position of a row from a token
+func decodeToken(token string) (row *sortRow, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidToken, err)
+		return
+	}
+	var decoded resumeToken
+	err = msgpack.Unmarshal(data, &decoded)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidToken, err)
+		return
+	}
+	if (decoded.Index == "") != (decoded.Key == nil) {
+		err = fmt.Errorf("%w: index %q without a key", ErrInvalidToken, decoded.Index)
+		return
+	}
+	row = &sortRow{
+		loc:   storage.TupleLocation{Page: decoded.Page, Offset: decoded.Offset},
+		index: exp.Column(decoded.Index),
+		key:   decoded.Key,
+	}
+	for _, key := range decoded.Keys {
+		// msgpack decodes numbers into the narrowest types
+		key = normalizeValue(key)
+		switch key.(type) {
+		case nil, int64, float64, string:
+		default:
+			err = fmt.Errorf("%w: unexpected key %v", ErrInvalidToken, key)
+			return
+		}
+		row.keys = append(row.keys, key)
+	}
+	return
+}
+
+// After continues a select from where a previous one stopped, after the item of a token given by Cursor.Token.
+// The select must be sorted by the same OrderBy options as the previous one, but may have a different expression.
+// Without OrderBy, the items before the item are not fetched again, scanning the table from the item if the previous
+// select scans it. If it finds the items through an index, the select must be planned with the same index,
+// otherwise ErrInvalidToken is returned rather than skipping the items missing from the index.
+// An empty token selects from the first item
+func After(token string) SelectOption {
+	return func(q *selectQuery) {
+		if token == "" {
+			q.after = nil
+			return
+		}
+		q.after, q.err = decodeToken(token)
+	}
+}
+
+// Token returns a token to continue from the current item by After
+// returns the token the cursor is made after if no item has been iterated
+func (c *Cursor[T]) Token() string {
+	if c.c == nil {
+		return ""
+	}
+	if c.c.last != nil {
+		return encodeToken(c.c.last)
+	}
+	if c.c.q.after != nil {
+		return encodeToken(c.c.q.after)
+	}
+	return ""
+}
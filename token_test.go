@@ -0,0 +1,101 @@
+package gled
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// page through the items of a select by resume tokens, |size| items at a time
+func paginate(t *testing.T, books *GledTable[cursorBook], ex exp.Ex, size int, opts ...SelectOption) (names []string, pages int) {
+	token := ""
+	for {
+		c := books.Iter(ex, append(opts, After(token), Limit(size))...)
+		count := 0
+		for c.Next() {
+			names = append(names, c.Item().Name)
+			count++
+		}
+		assert.NoError(t, c.Err())
+		token = c.Token()
+		if count == 0 {
+			return
+		}
+		pages++
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[cursorBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	var all []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("book-%03d", i)
+		all = append(all, name)
+		assert.NoError(t, books.Insert(cursorBook{Name: name, Count: i % 7}))
+	}
+
+	names, pages := paginate(t, books, exp.AndEx{}, 60)
+	assert.Equal(t, all, names)
+	assert.Equal(t, 9, pages)
+	assert.NoError(t, books.CreateIndex("Count"))
+	names, _ = paginate(t, books, exp.C("Count").Eq(3), 10)
+	assert.Equal(t, 71, len(names))
+	assert.Equal(t, "book-003", names[0])
+	assert.Equal(t, "book-010", names[1])
+	// pages through an index follow its keys, and continue only through the same index
+	var counted []string
+	for count := 5; count < 7; count++ {
+		for i := count; i < 500; i += 7 {
+			counted = append(counted, all[i])
+		}
+	}
+	names, _ = paginate(t, books, exp.C("Count").Gte(5), 30)
+	assert.Equal(t, counted, names)
+	c := books.Iter(exp.C("Count").Gte(5), Limit(100))
+	for c.Next() {
+	}
+	items, _, err := books.Select(exp.C("Count").Gte(6), After(c.Token()))
+	assert.NoError(t, err)
+	assert.Equal(t, len(counted)-100, len(items))
+	assert.Equal(t, counted[100], items[0].Name)
+	_, _, err = books.Select(exp.C("Name").Gt(""), After(c.Token()))
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+
+	// sorted pages follow the sort keys, so items moved or added between pages are not seen twice
+	var expected []string
+	for count := 6; count >= 0; count-- {
+		for i := count; i < 500; i += 7 {
+			expected = append(expected, all[i])
+		}
+	}
+	names, _ = paginate(t, books, exp.AndEx{}, 45, OrderBy("Count", Desc))
+	assert.Equal(t, expected, names)
+
+	c = books.Iter(exp.AndEx{}, OrderBy("Count", Desc), Limit(3))
+	for c.Next() {
+	}
+	token := c.Token()
+	items, _, err = books.Select(exp.AndEx{}, OrderBy("Count", Desc), After(token), Offset(2), Limit(2))
+	assert.NoError(t, err)
+	assert.Equal(t, []cursorBook{{Name: expected[5], Count: 6}, {Name: expected[6], Count: 6}}, items)
+	assert.NoError(t, books.Insert(cursorBook{Name: "new", Count: 6}))
+	_, err = books.UpdateWhere(exp.C("Name").Eq(expected[0]), func(item *cursorBook) { item.Count = 0 })
+	assert.NoError(t, err)
+	items, _, err = books.Select(exp.AndEx{}, OrderBy("Count", Desc), After(token), Limit(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []cursorBook{{Name: expected[3], Count: 6}}, items)
+
+	_, _, err = books.Select(exp.AndEx{}, After(token))
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	_, _, err = books.Select(exp.AndEx{}, After("not a token"))
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+	items, _, err = books.Select(exp.AndEx{}, Offset(498))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(items))
+}
@@ -0,0 +1,302 @@
+package gled
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/vmihailenco/msgpack/v5"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrTxDone is returned when using a transaction that is already committed or rolled back
+	ErrTxDone = errors.New("transaction already committed or rolled back")
+)
+
+// GledTx is a transaction buffering changes to tables of a db,
+// which take effect all together on Commit or not at all.
+// Selects within the transaction see the items as of when it began
+type GledTx struct {
+	db *GledDB
+	// the storage transaction versioning the changes
+	stx *storage.Tx
+	ops []txOp
+	// closing the table handles held until the transaction is done
+	closers []func() error
+	done    bool
+	mu      sync.Mutex
+}
+
+// txOpKind is the kind of change to a table
+type txOpKind int
+
+const (
+	// insert tuple
+	opInsert txOpKind = iota
+	// delete the tuple at loc
+	opDelete
+	// replace the tuple at loc with tuple
+	opUpdate
+)
+
+// txOp is a change to a table
+type txOp struct {
+	table *baseTable
+	kind  txOpKind
+	tuple storage.Tuple
+	loc   storage.TupleLocation
+}
+
+// Begin starts a new transaction
+func (db *GledDB) Begin() (tx *GledTx, err error) {
+	_, txm, err := db.open()
+	if err != nil {
+		return
+	}
+	stx, err := txm.Begin()
+	if err != nil {
+		err = fmt.Errorf("failed to begin transaction: %w", err)
+		return
+	}
+	tx = &GledTx{db: db, stx: stx}
+	return
+}
+
+// Commit applies all changes made in the transaction atomically
+func (tx *GledTx) Commit() (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.release()
+	defer tx.stx.Finish()
+	err = tx.db.apply(tx.stx, tx.ops)
+	if err != nil {
+		err = fmt.Errorf("failed to commit transaction: %w", err)
+		return
+	}
+	return
+}
+
+// Rollback discards all changes made in the transaction
+func (tx *GledTx) Rollback() (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	tx.stx.Finish()
+	tx.release()
+	return
+}
+
+func (tx *GledTx) add(op txOp) (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, op)
+	return
+}
+
+// hold adds changes to a table whose handle is closed by |closer| when the transaction is done
+func (tx *GledTx) hold(closer func() error, ops ...txOp) (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, ops...)
+	tx.closers = append(tx.closers, closer)
+	return
+}
+
+// close the table handles held by the transaction
+func (tx *GledTx) release() {
+	for _, closer := range tx.closers {
+		err := closer()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to close table held by transaction")
+		}
+	}
+	tx.closers = nil
+}
+
+// GledTxTable is a view of a table within a transaction
+type GledTxTable[T any] struct {
+	tx    *GledTx
+	table *GledTable[T]
+}
+
+// TxTable makes a view of a table to change it within a transaction
+// the table must be opened from the same db as the transaction
+func TxTable[T any](tx *GledTx, table *GledTable[T]) (view *GledTxTable[T], err error) {
+	if table.db != tx.db {
+		err = fmt.Errorf("table %s does not belong to the db of the transaction", table.name)
+		return
+	}
+	view = &GledTxTable[T]{
+		tx:    tx,
+		table: table,
+	}
+	return
+}
+
+// Insert inserts an item when the transaction is committed
+func (v *GledTxTable[T]) Insert(item T) (err error) {
+	data, err := msgpack.Marshal(item)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal item into JSON: %w", err)
+		return
+	}
+	return v.tx.add(txOp{table: v.table.baseTable, tuple: data})
+}
+
+// Delete deletes the item at a location when the transaction is committed
+func (v *GledTxTable[T]) Delete(loc storage.TupleLocation) (err error) {
+	return v.tx.add(txOp{table: v.table.baseTable, kind: opDelete, loc: loc})
+}
+
+// Update replaces the item at a location when the transaction is committed
+func (v *GledTxTable[T]) Update(loc storage.TupleLocation, item T) (err error) {
+	data, err := msgpack.Marshal(item)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal item: %w", err)
+		return
+	}
+	return v.tx.add(txOp{table: v.table.baseTable, kind: opUpdate, tuple: data, loc: loc})
+}
+
+// Select selects items from the table as of when the transaction began
+// changes made in the transaction are not visible until it is committed
+func (v *GledTxTable[T]) Select(ex exp.Ex, opts ...SelectOption) (items []T, locations []storage.TupleLocation, err error) {
+	return collect(v.Iter(ex, opts...))
+}
+
+// Get gets the item at a location as of when the transaction began
+func (v *GledTxTable[T]) Get(loc storage.TupleLocation) (item T, err error) {
+	tx := v.tx
+	tx.mu.Lock()
+	done := tx.done
+	tx.mu.Unlock()
+	if done {
+		err = ErrTxDone
+		return
+	}
+	return v.table.getSnapshot(tx.stx.Snapshot(), loc)
+}
+
+// autoCommit makes changes to tables take effect in a transaction of their own
+func (db *GledDB) autoCommit(ops []txOp) (err error) {
+	_, txm, err := db.open()
+	if err != nil {
+		return
+	}
+	stx, err := txm.Begin()
+	if err != nil {
+		return
+	}
+	defer stx.Finish()
+	return db.apply(stx, ops)
+}
+
+// apply makes changes to tables take effect atomically
+// all changes are written as one batch into the write-ahead log,
+// and indexes are updated after the batch is committed.
+// Deleted tuples and the older versions of updated ones stay in indexes
+// until the table is vacuumed, since they are still visible to earlier snapshots
+func (db *GledDB) apply(stx *storage.Tx, ops []txOp) (err error) {
+	if len(ops) == 0 {
+		return
+	}
+	wal, _, err := db.open()
+	if err != nil {
+		return
+	}
+	unlock := lockTables(ops)
+	defer unlock()
+	ops, err = enforceConstraints(ops)
+	if err != nil {
+		return
+	}
+	b := storage.NewTxBatch(stx)
+	locations := make([]storage.TupleLocation, len(ops))
+	for i, op := range ops {
+		var tuple storage.Tuple
+		if op.kind != opDelete {
+			tuple, err = op.table.tag(op.tuple)
+			if err != nil {
+				return
+			}
+		}
+		switch op.kind {
+		case opInsert:
+			locations[i], err = op.table.table.BatchAdd(b, tuple)
+		case opDelete:
+			err = op.table.table.BatchDelete(b, op.loc)
+		case opUpdate:
+			locations[i] = op.loc
+			err = op.table.table.BatchUpdate(b, op.loc, tuple)
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = wal.Commit(b)
+	if err != nil {
+		return
+	}
+
+	for i, op := range ops {
+		if op.kind == opDelete {
+			continue
+		}
+		err = indexTuple(op.table.indexes, op.tuple, locations[i])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// lockTables locks the tables changed by ops for writing, in the order of their names
+// returns a function unlocking them
+func lockTables(ops []txOp) (unlock func()) {
+	var tables []*baseTable
+	for _, op := range ops {
+		found := false
+		for _, table := range tables {
+			if table == op.table {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tables = append(tables, op.table)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].name < tables[j].name
+	})
+	// indexes must stay in place until they are updated
+	for _, table := range tables {
+		table.mu.RLock()
+	}
+	for _, table := range tables {
+		table.table.LockWrites()
+	}
+	return func() {
+		for _, table := range tables {
+			table.table.UnlockWrites()
+			table.mu.RUnlock()
+		}
+	}
+}
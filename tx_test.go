@@ -0,0 +1,186 @@
+package gled
+
+import (
+	"fmt"
+	"github.com/luminocean/gled/exp"
+	"github.com/luminocean/gled/storage"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+type txBook struct {
+	Name  string
+	Count int
+}
+
+type txAuthor struct {
+	Name string
+}
+
+func TestTxCommitAndRollback(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[txBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	authors, err := Table[txAuthor](db, "authors")
+	assert.NoError(t, err)
+	defer authors.Close()
+	assert.NoError(t, books.Insert(txBook{Name: "old", Count: 1}))
+
+	// rolled back changes never take effect
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	txBooks, err := TxTable(tx, books)
+	assert.NoError(t, err)
+	assert.NoError(t, txBooks.Insert(txBook{Name: "discarded", Count: 2}))
+	assert.NoError(t, tx.Rollback())
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	assert.ErrorIs(t, txBooks.Insert(txBook{Name: "late", Count: 3}), ErrTxDone)
+
+	// committed changes across tables take effect together
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	txBooks, err = TxTable(tx, books)
+	assert.NoError(t, err)
+	txAuthors, err := TxTable(tx, authors)
+	assert.NoError(t, err)
+	_, locations, err := txBooks.Select(exp.C("Name").Eq("old"))
+	assert.NoError(t, err)
+	assert.NoError(t, txBooks.Delete(locations[0]))
+	assert.NoError(t, txBooks.Insert(txBook{Name: "new", Count: 4}))
+	assert.NoError(t, txAuthors.Insert(txAuthor{Name: "someone"}))
+
+	// not visible before committed
+	items, _, err := books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []txBook{{Name: "old", Count: 1}}, items)
+	assert.NoError(t, tx.Commit())
+
+	items, _, err = books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []txBook{{Name: "new", Count: 4}}, items)
+	authorItems, _, err := authors.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []txAuthor{{Name: "someone"}}, authorItems)
+}
+
+func TestTxAtomicity(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[txBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	assert.NoError(t, books.CreateIndex("Name"))
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	txBooks, err := TxTable(tx, books)
+	assert.NoError(t, err)
+	assert.NoError(t, txBooks.Insert(txBook{Name: "never", Count: 1}))
+	// deleting a tuple that does not exist fails the whole transaction
+	assert.NoError(t, txBooks.Delete(storage.TupleLocation{Page: 0, Offset: 10}))
+	assert.Error(t, tx.Commit())
+
+	items, _, err := books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	items, _, err = books.Select(exp.C("Name").Eq("never"))
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func TestTxTableFromAnotherDB(t *testing.T) {
+	dir := t.TempDir()
+	db := NewGleDB(dir)
+	defer db.Close()
+	books, err := Table[txBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+
+	tx, err := NewGleDB(t.TempDir()).Begin()
+	assert.NoError(t, err)
+	_, err = TxTable(tx, books)
+	assert.Error(t, err)
+}
+
+func TestTxSnapshotIsolation(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[txBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	assert.NoError(t, books.Insert(txBook{Name: "a", Count: 1}))
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	txBooks, err := TxTable(tx, books)
+	assert.NoError(t, err)
+
+	// changes committed after the transaction began are not seen by it
+	assert.NoError(t, books.Insert(txBook{Name: "b", Count: 2}))
+	_, locations, err := books.Select(exp.C("Name").Eq("a"))
+	assert.NoError(t, err)
+	assert.NoError(t, books.Delete(locations[0]))
+	items, _, err := txBooks.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []txBook{{Name: "a", Count: 1}}, items)
+
+	// deleting an item deleted by a later transaction conflicts
+	assert.NoError(t, txBooks.Delete(locations[0]))
+	assert.ErrorIs(t, tx.Commit(), storage.ErrWriteConflict)
+
+	items, _, err = books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, []txBook{{Name: "b", Count: 2}}, items)
+}
+
+func TestConcurrentInsertSelectDelete(t *testing.T) {
+	db := NewGleDB(t.TempDir())
+	defer db.Close()
+	books, err := Table[txBook](db, "books")
+	assert.NoError(t, err)
+	defer books.Close()
+	assert.NoError(t, books.CreateIndex("Count"))
+
+	const writers, perWriter = 4, 50
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				assert.NoError(t, books.Insert(txBook{Name: fmt.Sprintf("book-%d-%02d", w, i), Count: w}))
+			}
+			// each writer deletes the first half of its own books
+			_, locations, err := books.Select(exp.C("Count").Eq(w))
+			assert.NoError(t, err)
+			assert.Equal(t, perWriter, len(locations))
+			for _, loc := range locations[:perWriter/2] {
+				assert.NoError(t, books.Delete(loc))
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, _, err := books.Select(exp.C("Count").Gte(0))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for w := 0; w < writers; w++ {
+		items, _, err := books.Select(exp.C("Count").Eq(w))
+		assert.NoError(t, err)
+		assert.Equal(t, perWriter/2, len(items))
+	}
+	assert.NoError(t, books.Vacuum())
+	items, _, err := books.Select(exp.AndEx{})
+	assert.NoError(t, err)
+	assert.Equal(t, writers*perWriter/2, len(items))
+}